@@ -8,7 +8,9 @@ import android.content.Context;
 import android.content.pm.PackageManager;
 import android.net.ConnectivityManager;
 import android.net.NetworkInfo;
+import android.os.BatteryManager;
 import android.os.Handler;
+import android.os.PowerManager;
 import android.util.Log;
 import android.view.View;
 import java.lang.String;
@@ -89,5 +91,15 @@ public class Jni extends Fragment {
     return 0;
   }
 
+  static int isCharging(Context ctx) {
+    BatteryManager bm = (BatteryManager) ctx.getSystemService(Context.BATTERY_SERVICE);
+    return bm.isCharging() ? 1 : 0;
+  }
+
+  static int isInteractive(Context ctx) {
+    PowerManager pm = (PowerManager) ctx.getSystemService(Context.POWER_SERVICE);
+    return pm.isInteractive() ? 1 : 0;
+  }
+
   static private native void permissionResult(boolean allowed);
 }
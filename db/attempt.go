@@ -0,0 +1,129 @@
+package db
+
+import (
+	"time"
+
+	"github.com/retailnext/unixtime"
+)
+
+type AttemptPhase string
+
+var (
+	PhaseHash      AttemptPhase = "hash"
+	PhaseNegotiate AttemptPhase = "negotiate"
+	PhaseTransfer  AttemptPhase = "transfer"
+	PhaseConfirm   AttemptPhase = "confirm"
+)
+
+// AttemptFailure is the kind of error an attempt ended with.
+type AttemptFailure string
+
+var (
+	FailureStatus      AttemptFailure = "status"      // the server answered with an error
+	FailureMismatch    AttemptFailure = "mismatch"    // the stored copy didn't match what was sent
+	FailureUnavailable AttemptFailure = "unavailable" // the destination couldn't be used this run
+	FailureOther       AttemptFailure = "other"
+)
+
+// Attempt is a single try at uploading a file. Err is empty
+// for attempts that succeeded.
+type Attempt struct {
+	ID          int64
+	Name        string
+	RunID       int64
+	Started     time.Time
+	Ended       time.Time
+	Phase       AttemptPhase
+	HTTPStatus  int
+	ServerError string
+	Err         string
+	BytesSent   int64
+	// Failure is empty for attempts that succeeded.
+	Failure AttemptFailure
+
+	DestinationID int64
+}
+
+func (a Attempt) Duration() time.Duration {
+	return a.Ended.Sub(a.Started)
+}
+
+func (db *DB) RecordAttempt(a *Attempt) error {
+	startTS := unixtime.ToUnix(a.Started, time.Millisecond)
+	endTS := unixtime.ToUnix(a.Ended, time.Millisecond)
+	if a.DestinationID == 0 {
+		a.DestinationID = PrimaryDestinationID
+	}
+	result, err := db.DB.Exec("insert into attempt (name, run_id, started_epoch_ms, ended_epoch_ms, phase, http_status, server_error, err, bytes_sent, destination_id, failure) values (?,?,?,?,?,?,?,?,?,?,?)",
+		a.Name, a.RunID, startTS, endTS, a.Phase, a.HTTPStatus, a.ServerError, a.Err, a.BytesSent, a.DestinationID, a.Failure)
+	if err != nil {
+		return err
+	}
+	a.ID, err = result.LastInsertId()
+	return err
+}
+
+// FileAttempts returns all attempts for a file, newest first.
+func (db *DB) FileAttempts(name string) ([]Attempt, error) {
+	return db.queryAttempts("select id, name, run_id, started_epoch_ms, ended_epoch_ms, phase, http_status, server_error, err, bytes_sent, destination_id, failure from attempt where name = ? order by id desc", name)
+}
+
+// LatestFailedAttempts returns the most recent attempt for each file
+// whose latest attempt ended in an error, keyed by file name.
+func (db *DB) LatestFailedAttempts() (map[string]Attempt, error) {
+	attempts, err := db.queryAttempts(`select a.id, a.name, a.run_id, a.started_epoch_ms, a.ended_epoch_ms, a.phase, a.http_status, a.server_error, a.err, a.bytes_sent, a.destination_id, a.failure
+from attempt a join (select max(id) id from attempt group by name) latest on a.id = latest.id
+where a.err != ''`)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]Attempt)
+	for _, a := range attempts {
+		m[a.Name] = a
+	}
+	return m, nil
+}
+
+// RecentMismatches counts the attempts at sending name to destination
+// destID that failed verification since the last attempt that ended
+// any other way.
+func (db *DB) RecentMismatches(name string, destID int64) (int, error) {
+	var n int
+	err := db.DB.QueryRow(`select count(*) from attempt
+where name = ? and destination_id = ? and failure = ?
+and id > coalesce((select max(id) from attempt where name = ? and destination_id = ? and failure != ?), 0)`,
+		name, destID, FailureMismatch, name, destID, FailureMismatch).Scan(&n)
+	return n, err
+}
+
+func (db *DB) queryAttempts(query string, args ...interface{}) ([]Attempt, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []Attempt
+
+	for rows.Next() {
+		var (
+			a         Attempt
+			startedMS int64
+			endedMS   int64
+		)
+		err = rows.Scan(&a.ID, &a.Name, &a.RunID, &startedMS, &endedMS, &a.Phase, &a.HTTPStatus, &a.ServerError, &a.Err, &a.BytesSent, &a.DestinationID, &a.Failure)
+		if err != nil {
+			return nil, err
+		}
+		a.Started = unixtime.ToTime(startedMS, time.Millisecond)
+		a.Ended = unixtime.ToTime(endedMS, time.Millisecond)
+
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
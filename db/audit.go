@@ -0,0 +1,142 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/retailnext/unixtime"
+)
+
+// Audit is one pass checking that files recorded as uploaded still
+// exist on the server.
+type Audit struct {
+	ID           int64
+	Started      time.Time
+	Ended        time.Time
+	Checked      int
+	OK           int
+	Missing      int
+	Mismatched   int
+	BytesChecked int64
+	Err          string
+}
+
+type AuditFile struct {
+	AuditID int64
+	Name    string
+	Problem string
+}
+
+var confKeyLastAudit = "last_audit_epoch_ms"
+
+func (db *DB) StartAudit() (*Audit, error) {
+	now := time.Now()
+	result, err := db.DB.Exec("insert into audit (started_epoch_ms) values (?)", unixtime.ToUnix(now, time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &Audit{ID: id, Started: now}, nil
+}
+
+func (db *DB) EndAudit(a *Audit) error {
+	a.Ended = time.Now()
+	ts := unixtime.ToUnix(a.Ended, time.Millisecond)
+	_, err := db.DB.Exec("update audit set ended_epoch_ms = ?, checked = ?, ok = ?, missing = ?, mismatched = ?, bytes_checked = ?, err = ? where id = ?",
+		ts, a.Checked, a.OK, a.Missing, a.Mismatched, a.BytesChecked, a.Err, a.ID)
+	if err != nil {
+		return err
+	}
+	return db.confSet(confKeyLastAudit, ts)
+}
+
+func (db *DB) AddAuditFile(auditID int64, name, problem string) error {
+	_, err := db.DB.Exec("insert into audit_file (audit_id, name, problem) values (?, ?, ?)", auditID, name, problem)
+	return err
+}
+
+func (db *DB) LastAuditTime() (time.Time, error) {
+	var lastMS int64
+	err := db.confGet(confKeyLastAudit, &lastMS)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return unixtime.ToTime(lastMS, time.Millisecond), err
+}
+
+// FilesToAudit returns files with a known hash that destID holds,
+// least recently audited first, with the uploaded hash and size
+// recorded there. Files no longer on the device are left out since
+// they can't be requeued.
+func (db *DB) FilesToAudit(destID int64, limit int) ([]File, error) {
+	return db.queryFiles("select "+fileColumnsAt(destID)+" from file where exists (select 1 from file_destination fd where fd.name = file.name and fd.destination_id = ? and fd.state in (?, ?) and (fd.uploaded_sha256 != '' or file.sha256 != '')) and state not in (?, ?, ?) order by audited_epoch_ms asc, created_epoch_ms asc limit ?",
+		destID, UploadSuccess, UploadSkipped, UploadFileDeleted, UploadTrashed, UploadCleaned, limit)
+}
+
+func (db *DB) MarkAudited(name string, ts time.Time) error {
+	_, err := db.DB.Exec("update file set audited_epoch_ms = ? where name = ?", unixtime.ToUnix(ts, time.Millisecond), name)
+	return err
+}
+
+// RequeueFile puts a file that was previously uploaded to destID
+// back to pending there.
+func (db *DB) RequeueFile(name string, destID int64) error {
+	return db.SetFileDestinationState(name, destID, UploadPending, time.Time{}, "")
+}
+
+func (db *DB) RecentAudits(limit int) ([]Audit, error) {
+	rows, err := db.DB.Query("select id, started_epoch_ms, ended_epoch_ms, checked, ok, missing, mismatched, bytes_checked, err from audit order by id desc limit ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var audits []Audit
+	for rows.Next() {
+		var (
+			a         Audit
+			startedMS int64
+			endedMS   *int64
+		)
+		err = rows.Scan(&a.ID, &startedMS, &endedMS, &a.Checked, &a.OK, &a.Missing, &a.Mismatched, &a.BytesChecked, &a.Err)
+		if err != nil {
+			return nil, err
+		}
+		a.Started = unixtime.ToTime(startedMS, time.Millisecond)
+		if endedMS != nil {
+			a.Ended = unixtime.ToTime(*endedMS, time.Millisecond)
+		}
+		audits = append(audits, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
+func (db *DB) AuditFiles(auditID int64) ([]AuditFile, error) {
+	rows, err := db.DB.Query("select audit_id, name, problem from audit_file where audit_id = ? order by rowid", auditID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []AuditFile
+	for rows.Next() {
+		var f AuditFile
+		err = rows.Scan(&f.AuditID, &f.Name, &f.Problem)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
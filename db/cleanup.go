@@ -0,0 +1,44 @@
+package db
+
+import (
+	"time"
+
+	"github.com/retailnext/unixtime"
+)
+
+// CleanupCandidates returns files created before ts that are safely
+// on the server: uploaded by us, or skipped because the server already
+// had a copy with the same hash. Files that were transformed before
+// upload to any destination are left alone since that copy isn't the
+// original.
+func (db *DB) CleanupCandidates(before time.Time) ([]File, error) {
+	return db.queryFiles("select "+fileColumns+" from file where (state = ? or (state = ? and sha256 != '')) and not exists (select 1 from file_destination fd where fd.name = file.name and fd.uploaded_sha256 not in ('', file.sha256)) and created_epoch_ms < ? order by created_epoch_ms asc",
+		UploadSuccess, UploadSkipped, unixtime.ToUnix(before, time.Millisecond))
+}
+
+// TrashFile records that a file's local copy was moved to trashPath.
+// The file's state is kept so UntrashFile can put it back.
+func (db *DB) TrashFile(name, trashPath string) error {
+	ts := unixtime.ToUnix(time.Now(), time.Millisecond)
+	_, err := db.DB.Exec("update file set trashed_from_state = state, state = ?, trash_path = ?, trashed_epoch_ms = ? where name = ?", UploadTrashed, trashPath, ts, name)
+	return err
+}
+
+// UntrashFile records that a trashed file was moved back, restoring
+// the state it had before it was trashed.
+func (db *DB) UntrashFile(name string) error {
+	_, err := db.DB.Exec("update file set state = trashed_from_state, trashed_from_state = 0, trash_path = '', trashed_epoch_ms = 0 where name = ? and state = ?", name, UploadTrashed)
+	return err
+}
+
+// CleanFile records that a trashed file was deleted for good.
+func (db *DB) CleanFile(name string) error {
+	_, err := db.DB.Exec("update file set state = ?, trash_path = '' where name = ?", UploadCleaned, name)
+	return err
+}
+
+// TrashedFiles returns files in the trash that were trashed before ts.
+func (db *DB) TrashedFiles(before time.Time) ([]File, error) {
+	return db.queryFiles("select "+fileColumns+" from file where state = ? and trashed_epoch_ms < ? order by trashed_epoch_ms asc",
+		UploadTrashed, unixtime.ToUnix(before, time.Millisecond))
+}
@@ -1,7 +1,12 @@
 package db
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
@@ -23,25 +28,33 @@ func Open() (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	path := filepath.Join(dir, "mediabackup.db")
-	db, err := sql.Open("sqlite3", path)
+	db, err := OpenPath(filepath.Join(dir, "mediabackup.db"))
 	if err != nil {
 		return nil, err
 	}
 
-	err = initDB(db)
+	db.cacheDir = androiddir.CacheDir()
+
+	log.Printf("cache dir: %s", db.cacheDir)
+
+	return db, nil
+}
+
+// OpenPath opens and migrates the database at path, without the
+// thumbnail cache.
+func OpenPath(path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
 
-	cacheDir := androiddir.CacheDir()
-
-	log.Printf("cache dir: %s", cacheDir)
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	return &DB{
-		DB:       db,
-		cacheDir: cacheDir,
-	}, nil
+	return &DB{DB: db}, nil
 }
 
 type UploadState int
@@ -54,8 +67,22 @@ func (s UploadState) String() string {
 		return "UploadInProgress"
 	case UploadSuccess:
 		return "UploadSuccess"
+	case UploadSkipped:
+		return "UploadSkipped"
 	case UploadFailed:
 		return "UploadFailed"
+	case UploadFileDeleted:
+		return "UploadFileDeleted"
+	case UploadRejected:
+		return "UploadRejected"
+	case UploadCorrupt:
+		return "UploadCorrupt"
+	case UploadTrashed:
+		return "UploadTrashed"
+	case UploadCleaned:
+		return "UploadCleaned"
+	case UploadPreviewed:
+		return "UploadPreviewed"
 	default:
 		return fmt.Sprintf("UnkownState<%d>", s)
 	}
@@ -68,37 +95,13 @@ const (
 	UploadSkipped     UploadState = 4
 	UploadFailed      UploadState = 5
 	UploadFileDeleted UploadState = 6
+	UploadRejected    UploadState = 7  // server refused the file permanently
+	UploadCorrupt     UploadState = 8  // local file no longer matches its original hash
+	UploadTrashed     UploadState = 9  // backed up, local copy moved to the trash
+	UploadCleaned     UploadState = 10 // backed up, local copy deleted to free space
+	UploadPreviewed   UploadState = 11 // reduced copy uploaded, original still pending
 )
 
-func initDB(db *sql.DB) error {
-	var createConfig = `CREATE TABLE IF NOT EXISTS config (
-key text PRIMARY KEY,
-val
-)`
-
-	_, err := db.Exec(createConfig)
-	if err != nil {
-		return err
-	}
-
-	var createFile = `CREATE TABLE IF NOT EXISTS file (
-name text PRIMARY KEY,
-created_epoch_ms int,
-upload_started_epoch_ms int,
-upload_end_epoch_ms int,
-size int,
-path text,
-state int
-)`
-
-	_, err = db.Exec(createFile)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 type File struct {
 	Name          string
 	Path          string
@@ -107,13 +110,82 @@ type File struct {
 	UploadEnd     time.Time
 	Size          int64
 	State         UploadState
+	ServerError   string
+	RetryAfter    time.Time
+	SHA256        string
+	Audited       time.Time
+
+	// OriginalSHA256 is the hash the first time the file was read,
+	// used to detect local corruption.
+	OriginalSHA256 string
+	Verified       time.Time
+
+	TrashPath string
+	Trashed   time.Time
+
+	// Captured is when the photo or video was taken according to its
+	// metadata, or its mtime if it has none. Zero until the file has
+	// been read.
+	Captured time.Time
+
+	// UploadedSHA256 and UploadedSize describe the bytes stored at a
+	// destination, which differ from the local file when it was
+	// transformed before upload. They are read for the primary
+	// destination unless a query asks for another.
+	UploadedSHA256 string
+	UploadedSize   int64
+}
+
+// ObjectID is the id of the file's copy on the server.
+func (f File) ObjectID() string {
+	if f.UploadedSHA256 != "" {
+		return f.UploadedSHA256
+	}
+	return f.SHA256
+}
+
+// ObjectSize is the size of the file's copy on the server.
+func (f File) ObjectSize() int64 {
+	if f.UploadedSize > 0 {
+		return f.UploadedSize
+	}
+	return f.Size
+}
+
+var fileColumns = fileColumnsAt(PrimaryDestinationID)
+
+// fileColumnsAt is the file columns with the uploaded hash and size
+// recorded for destID.
+func fileColumnsAt(destID int64) string {
+	return fmt.Sprintf("name, created_epoch_ms, upload_started_epoch_ms, upload_end_epoch_ms, size, path, state, server_error, retry_after_epoch_ms, sha256, audited_epoch_ms, original_sha256, verified_epoch_ms, trash_path, trashed_epoch_ms, captured_epoch_ms, "+
+		"(select fd.uploaded_sha256 from file_destination fd where fd.name = file.name and fd.destination_id = %[1]d), (select fd.uploaded_size from file_destination fd where fd.name = file.name and fd.destination_id = %[1]d)", destID)
+}
+
+func (db *DB) Close() error {
+	return db.DB.Close()
 }
 
 func (db *DB) GetFiles() ([]File, error) {
-	rows, err := db.DB.Query("select name, created_epoch_ms, upload_started_epoch_ms, upload_end_epoch_ms, size, path, state from file order by created_epoch_ms desc")
+	return db.queryFiles("select " + fileColumns + " from file order by coalesce(nullif(captured_epoch_ms, 0), created_epoch_ms) desc")
+}
+
+func (db *DB) GetFile(name string) (*File, error) {
+	files, err := db.queryFiles("select "+fileColumns+" from file where name = ?", name)
 	if err != nil {
 		return nil, err
 	}
+	if len(files) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &files[0], nil
+}
+
+func (db *DB) queryFiles(query string, args ...interface{}) ([]File, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
 	var files []File
 
@@ -123,8 +195,19 @@ func (db *DB) GetFiles() ([]File, error) {
 			createdMS     *int64
 			uploadStartMS *int64
 			uploadEndMS   *int64
+			serverErr     *string
+			retryAfterMS  *int64
+			sha256        *string
+			auditedMS     *int64
+			origSHA256    *string
+			verifiedMS    *int64
+			trashPath     *string
+			trashedMS     *int64
+			capturedMS    *int64
+			uploadedSHA   *string
+			uploadedSize  *int64
 		)
-		err = rows.Scan(&file.Name, &createdMS, &uploadStartMS, &uploadEndMS, &file.Size, &file.Path, &file.State)
+		err = rows.Scan(&file.Name, &createdMS, &uploadStartMS, &uploadEndMS, &file.Size, &file.Path, &file.State, &serverErr, &retryAfterMS, &sha256, &auditedMS, &origSHA256, &verifiedMS, &trashPath, &trashedMS, &capturedMS, &uploadedSHA, &uploadedSize)
 		if err != nil {
 			return nil, err
 		}
@@ -138,6 +221,39 @@ func (db *DB) GetFiles() ([]File, error) {
 		if uploadEndMS != nil {
 			file.UploadEnd = unixtime.ToTime(*uploadEndMS, time.Millisecond)
 		}
+		if serverErr != nil {
+			file.ServerError = *serverErr
+		}
+		if retryAfterMS != nil && *retryAfterMS > 0 {
+			file.RetryAfter = unixtime.ToTime(*retryAfterMS, time.Millisecond)
+		}
+		if sha256 != nil {
+			file.SHA256 = *sha256
+		}
+		if auditedMS != nil && *auditedMS > 0 {
+			file.Audited = unixtime.ToTime(*auditedMS, time.Millisecond)
+		}
+		if origSHA256 != nil {
+			file.OriginalSHA256 = *origSHA256
+		}
+		if verifiedMS != nil && *verifiedMS > 0 {
+			file.Verified = unixtime.ToTime(*verifiedMS, time.Millisecond)
+		}
+		if trashPath != nil {
+			file.TrashPath = *trashPath
+		}
+		if trashedMS != nil && *trashedMS > 0 {
+			file.Trashed = unixtime.ToTime(*trashedMS, time.Millisecond)
+		}
+		if capturedMS != nil && *capturedMS > 0 {
+			file.Captured = unixtime.ToTime(*capturedMS, time.Millisecond)
+		}
+		if uploadedSHA != nil {
+			file.UploadedSHA256 = *uploadedSHA
+		}
+		if uploadedSize != nil {
+			file.UploadedSize = *uploadedSize
+		}
 
 		files = append(files, file)
 	}
@@ -166,36 +282,124 @@ func (db *DB) CreatePending(name, path string, modTime time.Time, size int64) (*
 	return &file, nil
 }
 
+// CreateRestored records a file that was downloaded from the server,
+// so it is treated as already uploaded.
+func (db *DB) CreateRestored(name, path string, modTime time.Time, size int64, sha256 string) error {
+	ts := unixtime.ToUnix(modTime, time.Millisecond)
+	now := unixtime.ToUnix(time.Now(), time.Millisecond)
+	_, err := db.DB.Exec(`insert into file (name, created_epoch_ms, upload_end_epoch_ms, size, path, state, sha256, original_sha256) values (?,?,?,?,?,?,?,?)
+on conflict(name) do update set created_epoch_ms = excluded.created_epoch_ms, upload_end_epoch_ms = excluded.upload_end_epoch_ms, size = excluded.size, path = excluded.path,
+state = excluded.state, sha256 = excluded.sha256, original_sha256 = excluded.original_sha256, trash_path = '', trashed_epoch_ms = 0, retry_after_epoch_ms = 0, server_error = ''`,
+		name, ts, now, size, path, UploadSuccess, sha256, sha256)
+	if err != nil {
+		return err
+	}
+	return db.EndUpload(name, UploadSuccess)
+}
+
 func (db *DB) StartUpload(name string) error {
 	ts := unixtime.ToUnix(time.Now(), time.Millisecond)
 	_, err := db.DB.Exec("update file set state = ?, upload_started_epoch_ms = ? where name = ?", UploadInProgress, ts, name)
 	return err
 }
 
+// EndUpload records the result of uploading name to the primary
+// destination. The file's overall state also depends on any other
+// required destinations.
 func (db *DB) EndUpload(name string, state UploadState) error {
-	ts := unixtime.ToUnix(time.Now(), time.Millisecond)
+	_, err := db.DB.Exec("update file set state = ? where name = ?", state, name)
+	if err != nil {
+		return err
+	}
+	return db.SetFileDestinationState(name, PrimaryDestinationID, state, time.Time{}, "")
+}
+
+// SetFileSHA256 records the hash of the file as it was uploaded. The
+// first hash ever recorded is also kept as the original hash.
+func (db *DB) SetFileSHA256(name, sum string) error {
+	_, err := db.DB.Exec("update file set sha256 = ?, original_sha256 = case when original_sha256 = '' then ? else original_sha256 end where name = ?", sum, sum, name)
+	return err
+}
+
+// SetUploaded records the hash and size of the bytes stored for a
+// file at destID.
+func (db *DB) SetUploaded(name string, destID int64, sum string, size int64) error {
+	_, err := db.DB.Exec(`insert into file_destination (name, destination_id, state, uploaded_sha256, uploaded_size) values (?,?,?,?,?)
+on conflict(name, destination_id) do update set uploaded_sha256 = excluded.uploaded_sha256, uploaded_size = excluded.uploaded_size`,
+		name, destID, UploadPending, sum, size)
+	return err
+}
+
+func (db *DB) SetCaptureTime(name string, ts time.Time) error {
+	_, err := db.DB.Exec("update file set captured_epoch_ms = ? where name = ?", unixtime.ToUnix(ts, time.Millisecond), name)
+	return err
+}
+
+// FilesWithoutCaptureTime returns files still on the device whose
+// capture metadata hasn't been read.
+func (db *DB) FilesWithoutCaptureTime(limit int) ([]File, error) {
+	return db.queryFiles("select "+fileColumns+" from file where (captured_epoch_ms is null or captured_epoch_ms = 0) and state not in (?, ?, ?) order by created_epoch_ms desc limit ?",
+		UploadFileDeleted, UploadTrashed, UploadCleaned, limit)
+}
+
+func (db *DB) SetFileState(name string, state UploadState) error {
+	_, err := db.DB.Exec("update file set state = ? where name = ?", state, name)
+	return err
+}
 
-	_, err := db.DB.Exec("update file set state = ?, upload_end_epoch_ms = ? where name = ?", state, ts, name)
+// FilesToVerify returns files with a known original hash, least
+// recently verified first.
+func (db *DB) FilesToVerify(limit int) ([]File, error) {
+	return db.queryFiles("select "+fileColumns+" from file where original_sha256 != '' and state in (?, ?, ?) order by verified_epoch_ms asc limit ?",
+		UploadSuccess, UploadSkipped, UploadPending, limit)
+}
+
+func (db *DB) MarkVerified(name string, ts time.Time) error {
+	_, err := db.DB.Exec("update file set verified_epoch_ms = ? where name = ?", unixtime.ToUnix(ts, time.Millisecond), name)
 	return err
 }
 
+func (db *DB) CorruptFiles() (int, error) {
+	row := db.DB.QueryRow("select count(*) from file where state = ?", UploadCorrupt)
+	var count int
+	err := row.Scan(&count)
+	return count, err
+}
+
 func (db *DB) ResetFiles() error {
-	_, err := db.DB.Exec("delete from file")
+	_, err := db.DB.Exec("delete from file_destination")
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("delete from file")
 	return err
 }
 
 func (db *DB) ResetFailedUploads() error {
-	_, err := db.DB.Exec("update file set state = ? where state = ?", UploadPending, UploadFailed)
+	_, err := db.DB.Exec("update file_destination set state = ? where state = ?", UploadPending, UploadFailed)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("update file set state = ? where state = ?", UploadPending, UploadFailed)
 	return err
 }
 
 var (
 	confKeyEnabled     = "enabled"
-	confKeyURL         = "url"
-	confKeyUsername    = "username"
-	confKeyPassword    = "password"
-	confKeyAllowMobile = "allow_mobile_upload"
 	confKeyLastCheck   = "last_check_epoch_ms"
+	confKeyCaps        = "server_capabilities"
+	confKeyCapsURL     = "server_capabilities_url"
+	confKeyCapsTime    = "server_capabilities_epoch_ms"
+	confKeyCleanupDays = "cleanup_age_days"
+	confKeyDeviceID    = "device_id"
+	confKeyDeviceName  = "device_name"
+	confKeyDeviceKey   = "device_key"
+	confKeyStripMeta   = "strip_metadata"
+	confKeyStripDirs   = "strip_metadata_dirs"
+	confKeyTransforms  = "transform_chain"
+	confKeyPreview     = "preview_on_mobile"
+	confKeyPreviewSize = "preview_size"
+	confKeyPreviewQual = "preview_quality"
 )
 
 func (db *DB) Enabled() (bool, error) {
@@ -208,50 +412,58 @@ func (db *DB) SetEnabled(val bool) error {
 	return db.confSet(confKeyEnabled, val)
 }
 
+// URL, Username, Password and AllowMobileUpload are the settings of
+// the primary destination.
 func (db *DB) URL() (string, error) {
 	var url string
-	err := db.confGet(confKeyURL, &url)
+	err := db.primaryGet("url", &url)
 	return url, err
 }
 
 func (db *DB) SetURL(url string) error {
-	return db.confSet(confKeyURL, url)
+	return db.primarySet("url", url)
 }
 
 func (db *DB) Username() (string, error) {
 	var username string
-	err := db.confGet(confKeyUsername, &username)
-	if err == sql.ErrNoRows {
-		return "", nil
-	}
+	err := db.primaryGet("username", &username)
 	return username, err
 }
 
 func (db *DB) SetUsername(username string) error {
-	return db.confSet(confKeyUsername, username)
+	return db.primarySet("username", username)
 }
 
 func (db *DB) Password() (string, error) {
 	var password string
-	err := db.confGet(confKeyPassword, &password)
-	if err == sql.ErrNoRows {
-		return "", nil
-	}
+	err := db.primaryGet("password", &password)
 	return password, err
 }
 
 func (db *DB) SetPassword(password string) error {
-	return db.confSet(confKeyPassword, password)
+	return db.primarySet("password", password)
+}
+
+// ServerOptions holds the primary destination's options, such as how
+// it authenticates.
+func (db *DB) ServerOptions() (string, error) {
+	var options string
+	err := db.primaryGet("options", &options)
+	return options, err
+}
+
+func (db *DB) SetServerOptions(options string) error {
+	return db.primarySet("options", options)
 }
 
 func (db *DB) AllowMobileUpload() (bool, error) {
 	var allowMobile bool
-	err := db.confGet(confKeyAllowMobile, &allowMobile)
+	err := db.primaryGet("allow_mobile", &allowMobile)
 	return allowMobile, err
 }
 
 func (db *DB) SetAllowMobileUpload(allowMobile bool) error {
-	return db.confSet(confKeyAllowMobile, allowMobile)
+	return db.primarySet("allow_mobile", allowMobile)
 }
 
 func (db *DB) SetLastCheckTime(ts time.Time) error {
@@ -264,6 +476,288 @@ func (db *DB) LastCheckTime() (time.Time, error) {
 	return unixtime.ToTime(lastCheckMS, time.Millisecond), err
 }
 
+// DeviceID returns a random id for this install, creating it on first
+// use. Servers use it to keep each device's files separate.
+func (db *DB) DeviceID() (string, error) {
+	var id string
+	err := db.confGet(confKeyDeviceID, &id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	err = db.confSetDefault(confKeyDeviceID, hex.EncodeToString(buf))
+	if err != nil {
+		return "", err
+	}
+	err = db.confGet(confKeyDeviceID, &id)
+	return id, err
+}
+
+func (db *DB) SetDeviceID(id string) error {
+	return db.confSet(confKeyDeviceID, id)
+}
+
+// DeviceKey returns the key this device signs server requests with,
+// generating it on first use. Only the seed is stored. Concurrent
+// first calls all return the key that was stored first.
+func (db *DB) DeviceKey() (ed25519.PrivateKey, error) {
+	var seedHex string
+	err := db.confGet(confKeyDeviceKey, &seedHex)
+	if err == sql.ErrNoRows {
+		var key ed25519.PrivateKey
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = db.confSetDefault(confKeyDeviceKey, hex.EncodeToString(key.Seed()))
+		if err != nil {
+			return nil, err
+		}
+		err = db.confGet(confKeyDeviceKey, &seedHex)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("stored device key is corrupt")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// DeviceName labels this device's backups at destinations that group
+// them by machine, such as restic snapshots. It defaults to android-
+// and the start of the device id.
+func (db *DB) DeviceName() (string, error) {
+	var name string
+	err := db.confGet(confKeyDeviceName, &name)
+	if err == sql.ErrNoRows || (err == nil && name == "") {
+		id, err := db.DeviceID()
+		if err != nil {
+			return "", err
+		}
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		return "android-" + id, nil
+	}
+	return name, err
+}
+
+func (db *DB) SetDeviceName(name string) error {
+	return db.confSet(confKeyDeviceName, name)
+}
+
+// CleanupAgeDays is how old a backed up file must be before free up
+// space will remove it. It defaults to 30.
+func (db *DB) CleanupAgeDays() (int, error) {
+	days := 30
+	err := db.confGet(confKeyCleanupDays, &days)
+	if err == sql.ErrNoRows {
+		return 30, nil
+	}
+	return days, err
+}
+
+func (db *DB) SetCleanupAgeDays(days int) error {
+	return db.confSet(confKeyCleanupDays, days)
+}
+
+// PreviewOnMobile reports whether reduced copies of photos are uploaded
+// over mobile data while originals wait for wifi.
+func (db *DB) PreviewOnMobile() (bool, error) {
+	var preview bool
+	err := db.confGet(confKeyPreview, &preview)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return preview, err
+}
+
+func (db *DB) SetPreviewOnMobile(preview bool) error {
+	return db.confSet(confKeyPreview, preview)
+}
+
+// PreviewSize is the longest edge of a preview, in pixels.
+func (db *DB) PreviewSize() (int, error) {
+	size := 1600
+	err := db.confGet(confKeyPreviewSize, &size)
+	if err == sql.ErrNoRows {
+		return 1600, nil
+	}
+	return size, err
+}
+
+func (db *DB) SetPreviewSize(size int) error {
+	return db.confSet(confKeyPreviewSize, size)
+}
+
+// PreviewQuality is the JPEG quality of previews, 1-100.
+func (db *DB) PreviewQuality() (int, error) {
+	quality := 70
+	err := db.confGet(confKeyPreviewQual, &quality)
+	if err == sql.ErrNoRows {
+		return 70, nil
+	}
+	return quality, err
+}
+
+func (db *DB) SetPreviewQuality(quality int) error {
+	return db.confSet(confKeyPreviewQual, quality)
+}
+
+// StripMetadata reports whether GPS and serial number tags are removed
+// from photos before upload, unless a directory overrides it.
+func (db *DB) StripMetadata() (bool, error) {
+	var strip bool
+	err := db.confGet(confKeyStripMeta, &strip)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return strip, err
+}
+
+func (db *DB) SetStripMetadata(strip bool) error {
+	return db.confSet(confKeyStripMeta, strip)
+}
+
+// StripMetadataOverrides returns the per-directory strip settings,
+// keyed by directory.
+func (db *DB) StripMetadataOverrides() (map[string]bool, error) {
+	var raw []byte
+	err := db.confGet(confKeyStripDirs, &raw)
+	if err == sql.ErrNoRows {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]bool)
+	err = json.Unmarshal(raw, &overrides)
+	return overrides, err
+}
+
+// SetStripMetadataOverride sets whether files in dir are stripped,
+// regardless of the global setting.
+func (db *DB) SetStripMetadataOverride(dir string, strip bool) error {
+	overrides, err := db.StripMetadataOverrides()
+	if err != nil {
+		return err
+	}
+	overrides[filepath.Clean(dir)] = strip
+	return db.setStripOverrides(overrides)
+}
+
+func (db *DB) RemoveStripMetadataOverride(dir string) error {
+	overrides, err := db.StripMetadataOverrides()
+	if err != nil {
+		return err
+	}
+	delete(overrides, filepath.Clean(dir))
+	return db.setStripOverrides(overrides)
+}
+
+func (db *DB) setStripOverrides(overrides map[string]bool) error {
+	raw, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	return db.confSet(confKeyStripDirs, raw)
+}
+
+// TransformChain returns the names of the enabled pre-upload
+// transforms, in the order they run. It returns nil if the chain has
+// never been configured.
+func (db *DB) TransformChain() ([]string, error) {
+	var raw []byte
+	err := db.confGet(confKeyTransforms, &raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	chain := []string{}
+	err = json.Unmarshal(raw, &chain)
+	return chain, err
+}
+
+func (db *DB) SetTransformChain(chain []string) error {
+	if chain == nil {
+		chain = []string{}
+	}
+	raw, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+	return db.confSet(confKeyTransforms, raw)
+}
+
+// ShouldStripMetadata reports whether files in dir are stripped.
+func (db *DB) ShouldStripMetadata(dir string) (bool, error) {
+	overrides, err := db.StripMetadataOverrides()
+	if err != nil {
+		return false, err
+	}
+	if strip, ok := overrides[filepath.Clean(dir)]; ok {
+		return strip, nil
+	}
+	return db.StripMetadata()
+}
+
+// SetRetryAfter records that the primary server asked us not to send
+// any requests before ts.
+func (db *DB) SetRetryAfter(ts time.Time) error {
+	return db.SetDestinationRetryAfter(PrimaryDestinationID, ts)
+}
+
+func (db *DB) RetryAfter() (time.Time, error) {
+	var retryMS int64
+	err := db.primaryGet("retry_after_epoch_ms", &retryMS)
+	return unixtime.ToTime(retryMS, time.Millisecond), err
+}
+
+// ServerCapabilities returns the cached capabilities document for
+// the server at url, along with when it was fetched. It returns
+// sql.ErrNoRows if nothing is cached.
+func (db *DB) ServerCapabilities() (url string, caps []byte, fetched time.Time, err error) {
+	err = db.confGet(confKeyCapsURL, &url)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	err = db.confGet(confKeyCaps, &caps)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	var fetchedMS int64
+	err = db.confGet(confKeyCapsTime, &fetchedMS)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	return url, caps, unixtime.ToTime(fetchedMS, time.Millisecond), nil
+}
+
+func (db *DB) SetServerCapabilities(url string, caps []byte, fetched time.Time) error {
+	err := db.confSet(confKeyCapsURL, url)
+	if err != nil {
+		return err
+	}
+	err = db.confSet(confKeyCaps, caps)
+	if err != nil {
+		return err
+	}
+	return db.confSet(confKeyCapsTime, unixtime.ToUnix(fetched, time.Millisecond))
+}
+
 func (db *DB) confGet(key string, val interface{}) error {
 	row := db.DB.QueryRow("select val from config where key = ?", key)
 	return row.Scan(val)
@@ -274,6 +768,12 @@ func (db *DB) confSet(key string, val interface{}) error {
 	return err
 }
 
+// confSetDefault sets key to val unless it already has a value.
+func (db *DB) confSetDefault(key string, val interface{}) error {
+	_, err := db.DB.Exec("insert or ignore into config (key, val) values (?, ?)", key, val)
+	return err
+}
+
 func (db *DB) LastFileUpload() (time.Time, error) {
 	row := db.DB.QueryRow("select upload_end_epoch_ms from file where state = ? order by upload_end_epoch_ms desc limit 1", UploadSuccess)
 	var epochMS int64
@@ -282,7 +782,7 @@ func (db *DB) LastFileUpload() (time.Time, error) {
 }
 
 func (db *DB) PendingUploads() (int, error) {
-	row := db.DB.QueryRow("select count(*) from file where state = ?", UploadPending)
+	row := db.DB.QueryRow("select count(*) from file where state in (?, ?)", UploadPending, UploadPreviewed)
 	var pendingCount int
 	err := row.Scan(&pendingCount)
 	return pendingCount, err
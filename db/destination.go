@@ -0,0 +1,465 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/retailnext/unixtime"
+)
+
+// PrimaryDestinationID is the destination configured by the URL,
+// username and password settings. Audit, restore and inventory talk
+// to it.
+const PrimaryDestinationID int64 = 1
+
+var (
+	BackendHTTP   = "http"   // media-backup protocol server
+	BackendLocal  = "local"  // directory on the device: SD card, USB drive or mounted share
+	BackendImmich = "immich" // Immich server, password is an api key
+	BackendRestic = "restic" // restic repository, password is the repository password
+	BackendForm   = "form"   // multipart form POST to a file drop
+)
+
+// Destination is a place files are backed up to. A file is only
+// considered safe once every enabled, required destination has it.
+type Destination struct {
+	ID       int64
+	Name     string
+	Backend  string
+	URL      string
+	Username string
+	Password string
+	Enabled  bool
+	Required bool
+	// Options holds backend specific settings as a url query string,
+	// such as file_field=upload&success_status=200.
+	Options string
+
+	// AllowMobile permits uploads over mobile data.
+	AllowMobile bool
+	// MinInterval is the shortest time between background runs that
+	// upload to this destination. Zero means every run.
+	MinInterval time.Duration
+	LastRun     time.Time
+	// RetryAfter is set when the destination asked us to stop sending
+	// requests until then.
+	RetryAfter time.Time
+
+	// AccessToken and RefreshToken are issued by the destination's
+	// OAuth server after the user signs in.
+	AccessToken  string
+	RefreshToken string
+	TokenExpiry  time.Time
+
+	TLS TLSSettings
+}
+
+// TLSSettings customize how a destination's certificate is checked
+// and what client certificate is presented. Certificates and keys are
+// PEM.
+type TLSSettings struct {
+	// CA is trusted in addition to the system roots.
+	CA string
+	// Pin is the sha256/ fingerprint of the server's public key,
+	// trusted instead of any CA.
+	Pin        string
+	ClientCert string
+	ClientKey  string
+}
+
+// Due reports whether a background run at now should upload to d.
+func (d Destination) Due(now time.Time) bool {
+	return d.MinInterval <= 0 || now.Sub(d.LastRun) >= d.MinInterval
+}
+
+// Local reports whether d is on the device, so uploading to it needs
+// no network: the local backend, or a restic repository that isn't a
+// rest: url.
+func (d Destination) Local() bool {
+	switch d.Backend {
+	case BackendLocal:
+		return true
+	case BackendRestic:
+		return !strings.HasPrefix(d.URL, "rest:")
+	}
+	return false
+}
+
+// FileDestination is the upload state of one file at one destination.
+type FileDestination struct {
+	Name          string
+	DestinationID int64
+	State         UploadState
+	UploadEnd     time.Time
+	RetryAfter    time.Time
+	ServerError   string
+	// UploadedSHA256 and UploadedSize describe the copy stored at
+	// the destination; see File.
+	UploadedSHA256 string
+	UploadedSize   int64
+}
+
+var destinationColumns = "id, name, backend, url, username, password, enabled, required, options, allow_mobile, min_interval_ms, last_run_epoch_ms, retry_after_epoch_ms, access_token, refresh_token, token_expiry_epoch_ms, tls_ca, tls_pin, tls_client_cert, tls_client_key"
+
+func (db *DB) Destinations() ([]Destination, error) {
+	return db.queryDestinations("select " + destinationColumns + " from destination order by id")
+}
+
+func (db *DB) Destination(id int64) (*Destination, error) {
+	dests, err := db.queryDestinations("select "+destinationColumns+" from destination where id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(dests) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &dests[0], nil
+}
+
+func (db *DB) queryDestinations(query string, args ...interface{}) ([]Destination, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dests []Destination
+
+	for rows.Next() {
+		var (
+			d            Destination
+			intervalMS   int64
+			lastRunMS    int64
+			retryAfterMS int64
+			expiryMS     int64
+		)
+		err = rows.Scan(&d.ID, &d.Name, &d.Backend, &d.URL, &d.Username, &d.Password, &d.Enabled, &d.Required, &d.Options, &d.AllowMobile, &intervalMS, &lastRunMS, &retryAfterMS, &d.AccessToken, &d.RefreshToken, &expiryMS, &d.TLS.CA, &d.TLS.Pin, &d.TLS.ClientCert, &d.TLS.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		d.MinInterval = time.Duration(intervalMS) * time.Millisecond
+		if lastRunMS > 0 {
+			d.LastRun = unixtime.ToTime(lastRunMS, time.Millisecond)
+		}
+		if retryAfterMS > 0 {
+			d.RetryAfter = unixtime.ToTime(retryAfterMS, time.Millisecond)
+		}
+		if expiryMS > 0 {
+			d.TokenExpiry = unixtime.ToTime(expiryMS, time.Millisecond)
+		}
+		dests = append(dests, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dests, nil
+}
+
+// SaveDestination inserts d if its ID is zero and updates it
+// otherwise. File states are recomputed since d may have become
+// required or been disabled.
+func (db *DB) SaveDestination(d *Destination) error {
+	if d.Backend == "" {
+		d.Backend = BackendHTTP
+	}
+	intervalMS := d.MinInterval.Milliseconds()
+	if d.ID == 0 {
+		result, err := db.DB.Exec("insert into destination (name, backend, url, username, password, enabled, required, options, allow_mobile, min_interval_ms) values (?,?,?,?,?,?,?,?,?,?)",
+			d.Name, d.Backend, d.URL, d.Username, d.Password, d.Enabled, d.Required, d.Options, d.AllowMobile, intervalMS)
+		if err != nil {
+			return err
+		}
+		d.ID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := db.DB.Exec("update destination set name = ?, backend = ?, url = ?, username = ?, password = ?, enabled = ?, required = ?, options = ?, allow_mobile = ?, min_interval_ms = ? where id = ?",
+			d.Name, d.Backend, d.URL, d.Username, d.Password, d.Enabled, d.Required, d.Options, d.AllowMobile, intervalMS, d.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return db.RefreshFileStates()
+}
+
+// DeleteDestination removes a destination and its per-file state.
+// The primary destination can't be removed.
+func (db *DB) DeleteDestination(id int64) error {
+	if id == PrimaryDestinationID {
+		return errors.New("the primary destination can't be removed")
+	}
+	_, err := db.DB.Exec("delete from file_destination where destination_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("delete from destination where id = ?", id)
+	if err != nil {
+		return err
+	}
+	return db.RefreshFileStates()
+}
+
+func (db *DB) SetDestinationLastRun(id int64, ts time.Time) error {
+	_, err := db.DB.Exec("update destination set last_run_epoch_ms = ? where id = ?", unixtime.ToUnix(ts, time.Millisecond), id)
+	return err
+}
+
+func (db *DB) SetDestinationRetryAfter(id int64, ts time.Time) error {
+	_, err := db.DB.Exec("update destination set retry_after_epoch_ms = ? where id = ?", unixtime.ToUnix(ts, time.Millisecond), id)
+	return err
+}
+
+// SetDestinationTokens stores the tokens from an OAuth sign in or
+// refresh. A zero expiry means the access token doesn't expire.
+func (db *DB) SetDestinationTokens(id int64, access, refresh string, expiry time.Time) error {
+	var expiryMS int64
+	if !expiry.IsZero() {
+		expiryMS = unixtime.ToUnix(expiry, time.Millisecond)
+	}
+	_, err := db.DB.Exec("update destination set access_token = ?, refresh_token = ?, token_expiry_epoch_ms = ? where id = ?", access, refresh, expiryMS, id)
+	return err
+}
+
+// SetDestinationTLS replaces a destination's TLS settings.
+func (db *DB) SetDestinationTLS(id int64, t TLSSettings) error {
+	_, err := db.DB.Exec("update destination set tls_ca = ?, tls_pin = ?, tls_client_cert = ?, tls_client_key = ? where id = ?", t.CA, t.Pin, t.ClientCert, t.ClientKey, id)
+	return err
+}
+
+func (db *DB) primaryGet(column string, val interface{}) error {
+	return db.DB.QueryRow("select "+column+" from destination where id = ?", PrimaryDestinationID).Scan(val)
+}
+
+func (db *DB) primarySet(column string, val interface{}) error {
+	_, err := db.DB.Exec("update destination set "+column+" = ? where id = ?", val, PrimaryDestinationID)
+	return err
+}
+
+// FileDestinations returns the state of name at every destination
+// that has one recorded. Destinations without a row are pending.
+func (db *DB) FileDestinations(name string) ([]FileDestination, error) {
+	return db.queryFileDestinations("select name, destination_id, state, upload_end_epoch_ms, retry_after_epoch_ms, server_error, uploaded_sha256, uploaded_size from file_destination where name = ?", name)
+}
+
+// AllFileDestinations returns every recorded per-destination state,
+// keyed by file name.
+func (db *DB) AllFileDestinations() (map[string][]FileDestination, error) {
+	fds, err := db.queryFileDestinations("select name, destination_id, state, upload_end_epoch_ms, retry_after_epoch_ms, server_error, uploaded_sha256, uploaded_size from file_destination order by destination_id")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]FileDestination)
+	for _, fd := range fds {
+		m[fd.Name] = append(m[fd.Name], fd)
+	}
+	return m, nil
+}
+
+func (db *DB) queryFileDestinations(query string, args ...interface{}) ([]FileDestination, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fds []FileDestination
+
+	for rows.Next() {
+		var (
+			fd           FileDestination
+			uploadEndMS  int64
+			retryAfterMS int64
+		)
+		err = rows.Scan(&fd.Name, &fd.DestinationID, &fd.State, &uploadEndMS, &retryAfterMS, &fd.ServerError, &fd.UploadedSHA256, &fd.UploadedSize)
+		if err != nil {
+			return nil, err
+		}
+		if uploadEndMS > 0 {
+			fd.UploadEnd = unixtime.ToTime(uploadEndMS, time.Millisecond)
+		}
+		if retryAfterMS > 0 {
+			fd.RetryAfter = unixtime.ToTime(retryAfterMS, time.Millisecond)
+		}
+		fds = append(fds, fd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return fds, nil
+}
+
+// SetFileDestinationState records the result of uploading name to a
+// destination and recomputes the file's overall state.
+func (db *DB) SetFileDestinationState(name string, destID int64, state UploadState, retryAfter time.Time, serverErr string) error {
+	ts := unixtime.ToUnix(time.Now(), time.Millisecond)
+	var retryTS int64
+	if !retryAfter.IsZero() {
+		retryTS = unixtime.ToUnix(retryAfter, time.Millisecond)
+	}
+	_, err := db.DB.Exec(`insert into file_destination (name, destination_id, state, upload_end_epoch_ms, retry_after_epoch_ms, server_error) values (?,?,?,?,?,?)
+on conflict(name, destination_id) do update set state = excluded.state, upload_end_epoch_ms = excluded.upload_end_epoch_ms, retry_after_epoch_ms = excluded.retry_after_epoch_ms, server_error = excluded.server_error`,
+		name, destID, state, ts, retryTS, serverErr)
+	if err != nil {
+		return err
+	}
+	return db.refreshFileState(name)
+}
+
+// RefreshFileStates recomputes the overall state of every file.
+func (db *DB) RefreshFileStates() error {
+	rows, err := db.DB.Query("select name from file")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := db.refreshFileState(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshFileState sets file.state from the states at the enabled,
+// required destinations. With no destination enabled nothing holds
+// the file, so it goes back to pending. Files that are deleted,
+// corrupt or trashed keep their state.
+func (db *DB) refreshFileState(name string) error {
+	var current UploadState
+	err := db.DB.QueryRow("select state from file where name = ?", name).Scan(&current)
+	if err != nil {
+		return err
+	}
+	switch current {
+	case UploadFileDeleted, UploadCorrupt, UploadTrashed, UploadCleaned:
+		return nil
+	}
+
+	fds, err := db.countedFileDestinations(name)
+	if err != nil {
+		return err
+	}
+	if len(fds) == 0 {
+		_, err = db.DB.Exec("update file set state = ?, retry_after_epoch_ms = 0, server_error = '' where name = ?", UploadPending, name)
+		return err
+	}
+
+	agg := AggregateState(fds)
+
+	uploadEnd := unixtime.ToTime(0, time.Millisecond)
+	retryAfter := uploadEnd
+	var serverErr string
+	for _, fd := range fds {
+		if fd.UploadEnd.After(uploadEnd) {
+			uploadEnd = fd.UploadEnd
+		}
+		if fd.State == UploadPending && fd.RetryAfter.After(retryAfter) {
+			retryAfter = fd.RetryAfter
+		}
+		if fd.ServerError != "" {
+			serverErr = fd.ServerError
+		}
+	}
+
+	_, err = db.DB.Exec("update file set state = ?, upload_end_epoch_ms = ?, retry_after_epoch_ms = ?, server_error = ? where name = ?",
+		agg, unixtime.ToUnix(uploadEnd, time.Millisecond), unixtime.ToUnix(retryAfter, time.Millisecond), serverErr, name)
+	return err
+}
+
+// countedFileDestinations returns name's state at the destinations
+// that decide its overall state: the enabled required ones, or every
+// enabled one when none is required.
+func (db *DB) countedFileDestinations(name string) ([]FileDestination, error) {
+	rows, err := db.DB.Query(`select d.id, d.required, coalesce(fd.state, ?), coalesce(fd.upload_end_epoch_ms, 0), coalesce(fd.retry_after_epoch_ms, 0), coalesce(fd.server_error, '')
+from destination d left join file_destination fd on fd.destination_id = d.id and fd.name = ?
+where d.enabled = 1`, UploadPending, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var required, optional []FileDestination
+	for rows.Next() {
+		var (
+			fd           = FileDestination{Name: name}
+			isRequired   bool
+			uploadEndMS  int64
+			retryAfterMS int64
+		)
+		err = rows.Scan(&fd.DestinationID, &isRequired, &fd.State, &uploadEndMS, &retryAfterMS, &fd.ServerError)
+		if err != nil {
+			return nil, err
+		}
+		fd.UploadEnd = unixtime.ToTime(uploadEndMS, time.Millisecond)
+		fd.RetryAfter = unixtime.ToTime(retryAfterMS, time.Millisecond)
+		if isRequired {
+			required = append(required, fd)
+		} else {
+			optional = append(optional, fd)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(required) > 0 {
+		return required, nil
+	}
+	return optional, nil
+}
+
+// UploadedEverywhere reports whether name is stored at every
+// destination that decides its overall state, going by each
+// destination's own record rather than the file's cached state.
+func (db *DB) UploadedEverywhere(name string) (bool, error) {
+	fds, err := db.countedFileDestinations(name)
+	if err != nil {
+		return false, err
+	}
+	if len(fds) == 0 {
+		return false, nil
+	}
+	for _, fd := range fds {
+		if fd.State != UploadSuccess && fd.State != UploadSkipped {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// AggregateState combines the states of a file at several
+// destinations. The file is only uploaded once every destination
+// has it; otherwise the state that most needs attention wins.
+func AggregateState(fds []FileDestination) UploadState {
+	has := make(map[UploadState]bool)
+	for _, fd := range fds {
+		has[fd.State] = true
+	}
+	for _, s := range []UploadState{UploadInProgress, UploadFailed, UploadRejected, UploadPending, UploadPreviewed} {
+		if has[s] {
+			return s
+		}
+	}
+	if has[UploadSuccess] {
+		return UploadSuccess
+	}
+	return UploadSkipped
+}
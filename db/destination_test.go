@@ -0,0 +1,88 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateFollowsDestinations(t *testing.T) {
+	db, err := OpenPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const name = "IMG_0001.jpg"
+	_, err = db.CreatePending(name, "/sdcard/DCIM/Camera/"+name, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.EndUpload(name, UploadSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkState := func(step string, want UploadState) {
+		t.Helper()
+		f, err := db.GetFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.State != want {
+			t.Errorf("%s: file state = %s, want %s", step, f.State, want)
+		}
+	}
+	save := func(d *Destination) {
+		t.Helper()
+		err := db.SaveDestination(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkState("uploaded to primary", UploadSuccess)
+
+	second := &Destination{Name: "second", Backend: BackendLocal, URL: "/sdcard/Backup", Enabled: true, Required: true}
+	save(second)
+	checkState("second destination added", UploadPending)
+
+	err = db.SetFileDestinationState(name, second.ID, UploadFailed, time.Time{}, "disk full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState("second destination failed", UploadFailed)
+
+	second.Enabled = false
+	save(second)
+	checkState("second destination disabled", UploadSuccess)
+
+	primary, err := db.Destination(PrimaryDestinationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.Enabled = false
+	save(primary)
+	checkState("every destination disabled", UploadPending)
+
+	second.Enabled = true
+	save(second)
+	checkState("second destination enabled", UploadFailed)
+
+	primary.Enabled = true
+	save(primary)
+	checkState("primary destination enabled", UploadFailed)
+
+	err = db.DeleteDestination(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkState("second destination deleted", UploadSuccess)
+
+	fds, err := db.FileDestinations(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 1 || fds[0].DestinationID != PrimaryDestinationID {
+		t.Errorf("file destinations after delete = %+v, want only the primary", fds)
+	}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"bytes"
 	"container/list"
 	"errors"
 	"image"
@@ -10,6 +11,7 @@ import (
 	"image/jpeg"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -26,8 +28,24 @@ var (
 
 	imgCacheMux sync.Mutex
 	imgCache    = list.New()
+
+	remoteThumbDir        = "remote"
+	startRemoteThumbsOnce sync.Once
+	remoteThumbReqChan    = make(chan remoteThumbReq, 10)
+	remoteThumbFailedMux  sync.Mutex
+	remoteThumbFailed     = make(map[string]bool)
 )
 
+type remoteThumbReq struct {
+	dst   string
+	fetch func() ([]byte, error)
+}
+
+// CacheDir is the app's cache directory, where thumbnails are kept.
+func (db *DB) CacheDir() string {
+	return db.cacheDir
+}
+
 func (db *DB) Thumbnail(dbf File) (image.Image, error) {
 	if db.cacheDir == "" {
 		log.Printf("no cache dir!")
@@ -44,13 +62,7 @@ func (db *DB) Thumbnail(dbf File) (image.Image, error) {
 		default:
 		}
 
-		myimage := image.NewRGBA(image.Rect(0, 0, size, size)) // x1,y1,  x2,y2
-		mygreen := color.RGBA{0, 100, 0, 255}                  //  R, G, B, Alpha
-
-		// backfill entire surface with green
-		draw.Draw(myimage, myimage.Bounds(), &image.Uniform{mygreen}, image.ZP, draw.Src)
-
-		return myimage, nil
+		return placeholderThumb(), nil
 	}
 	defer f.Close()
 
@@ -67,6 +79,59 @@ func (db *DB) Thumbnail(dbf File) (image.Image, error) {
 	return img, nil
 }
 
+// RemoteThumbnail returns the thumbnail for a server object, cached
+// under its id. Uncached thumbnails are downloaded in the background
+// with fetch, and a placeholder is returned until then. fetch may be
+// nil if the server has no thumbnail for the object.
+func (db *DB) RemoteThumbnail(id string, fetch func() ([]byte, error)) (image.Image, error) {
+	if db.cacheDir == "" {
+		return nil, errors.New("No cachedir found")
+	}
+	key := filepath.Join(remoteThumbDir, filepath.Base(id))
+
+	img := lruGet(key)
+	if img != nil {
+		return img, nil
+	}
+
+	dst := filepath.Join(db.cacheDir, key)
+	f, err := os.Open(dst)
+	if err != nil {
+		remoteThumbFailedMux.Lock()
+		failed := remoteThumbFailed[dst]
+		remoteThumbFailedMux.Unlock()
+
+		if fetch != nil && !failed {
+			startRemoteThumbsOnce.Do(func() {
+				go processRemoteThumbs()
+			})
+			select {
+			case remoteThumbReqChan <- remoteThumbReq{dst: dst, fetch: fetch}:
+			default:
+			}
+		}
+		return placeholderThumb(), nil
+	}
+	defer f.Close()
+
+	img, _, err = image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	lruPut(key, img)
+	return img, nil
+}
+
+func placeholderThumb() image.Image {
+	myimage := image.NewRGBA(image.Rect(0, 0, size, size)) // x1,y1,  x2,y2
+	mygreen := color.RGBA{0, 100, 0, 255}                  //  R, G, B, Alpha
+
+	// backfill entire surface with green
+	draw.Draw(myimage, myimage.Bounds(), &image.Uniform{mygreen}, image.ZP, draw.Src)
+
+	return myimage
+}
+
 type cacheImg struct {
 	name string
 	img  image.Image
@@ -103,6 +168,26 @@ func lruPut(name string, img image.Image) {
 	}
 }
 
+// downscale decodes the image in r, applies its EXIF orientation, and
+// shrinks it to fit in maxSize x maxSize.
+func downscale(r io.Reader, maxSize int) (image.Image, error) {
+	img, _, err := imageorient.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return resize.Thumbnail(uint(maxSize), uint(maxSize), img, resize.NearestNeighbor), nil
+}
+
+// EncodePreview writes a JPEG copy of the image in r, shrunk to fit in
+// maxSize x maxSize, using the same scaling as thumbnails.
+func EncodePreview(w io.Writer, r io.Reader, maxSize, quality int) error {
+	img, err := downscale(r, maxSize)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
 func processThumbs(cacheDir string) {
 	for srcFile := range thumbReqChan {
 		func() {
@@ -122,14 +207,12 @@ func processThumbs(cacheDir string) {
 			}
 			defer f.Close()
 
-			img, _, err := imageorient.Decode(f)
+			img, err := downscale(f, size)
 			if err != nil {
 				log.Printf("thumb err process file=%s err=%s", srcFile.Path, err)
 				return
 			}
 
-			img = resize.Thumbnail(uint(size), uint(size), img, resize.NearestNeighbor)
-
 			tmpFile, err := os.CreateTemp(cacheDir, srcFile.Name+".tmp")
 			if err != nil {
 				log.Printf("thumb err open tmp file=%s err=%s", srcFile.Name, err)
@@ -148,3 +231,59 @@ func processThumbs(cacheDir string) {
 		}()
 	}
 }
+
+// processRemoteThumbs downloads server thumbnails into the cache.
+// Thumbnails that fail are not retried until the app restarts.
+func processRemoteThumbs() {
+	for req := range remoteThumbReqChan {
+		func() {
+			_, err := os.Stat(req.dst)
+			if err == nil {
+				return
+			}
+
+			fail := func(err error) {
+				log.Printf("remote thumb err file=%s err=%s", req.dst, err)
+				remoteThumbFailedMux.Lock()
+				remoteThumbFailed[req.dst] = true
+				remoteThumbFailedMux.Unlock()
+			}
+
+			body, err := req.fetch()
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(body))
+			if err != nil {
+				fail(err)
+				return
+			}
+			img = resize.Thumbnail(uint(size), uint(size), img, resize.NearestNeighbor)
+
+			dir := filepath.Dir(req.dst)
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			tmpFile, err := os.CreateTemp(dir, filepath.Base(req.dst)+".tmp")
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer os.Remove(tmpFile.Name())
+			defer tmpFile.Close()
+
+			err = jpeg.Encode(tmpFile, img, nil)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			os.Rename(tmpFile.Name(), req.dst)
+		}()
+	}
+}
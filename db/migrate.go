@@ -0,0 +1,438 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A migration moves the schema from version-1 to version. Each
+// migration runs in its own transaction along with the schema_version
+// bump, and must be safe to re-run against a database that was
+// partially created by older app versions that had no schema_version
+// table (use IF NOT EXISTS and addColumn).
+type migration struct {
+	version int
+	name    string
+	fn      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create config and file tables",
+		fn: execAll(
+			`CREATE TABLE IF NOT EXISTS config (
+key text PRIMARY KEY,
+val
+)`,
+			`CREATE TABLE IF NOT EXISTS file (
+name text PRIMARY KEY,
+created_epoch_ms int,
+upload_started_epoch_ms int,
+upload_end_epoch_ms int,
+size int,
+path text,
+state int
+)`,
+		),
+	},
+	{
+		version: 2,
+		name:    "create run tables",
+		fn: execAll(
+			`CREATE TABLE IF NOT EXISTS run (
+id integer PRIMARY KEY AUTOINCREMENT,
+trigger text,
+started_epoch_ms int,
+ended_epoch_ms int,
+net_state text,
+attempted int default 0,
+succeeded int default 0,
+skipped int default 0,
+failed int default 0,
+bytes_sent int default 0,
+err text
+)`,
+			`CREATE TABLE IF NOT EXISTS run_file (
+run_id int,
+name text,
+state int,
+bytes int
+)`,
+		),
+	},
+	{
+		version: 3,
+		name:    "create attempt table",
+		fn: execAll(
+			`CREATE TABLE IF NOT EXISTS attempt (
+id integer PRIMARY KEY AUTOINCREMENT,
+name text,
+run_id int,
+started_epoch_ms int,
+ended_epoch_ms int,
+phase text,
+http_status int default 0,
+server_error text default '',
+err text default '',
+bytes_sent int default 0
+)`,
+			`CREATE INDEX IF NOT EXISTS attempt_name on attempt (name)`,
+		),
+	},
+	{
+		version: 4,
+		name:    "add file server_error and retry_after",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file", "server_error", "text default ''")
+			if err != nil {
+				return err
+			}
+			return addColumn(tx, "file", "retry_after_epoch_ms", "int default 0")
+		},
+	},
+	{
+		version: 5,
+		name:    "add file sha256 and audit tables",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file", "sha256", "text default ''")
+			if err != nil {
+				return err
+			}
+			err = addColumn(tx, "file", "audited_epoch_ms", "int default 0")
+			if err != nil {
+				return err
+			}
+			return execAll(
+				`CREATE TABLE IF NOT EXISTS audit (
+id integer PRIMARY KEY AUTOINCREMENT,
+started_epoch_ms int,
+ended_epoch_ms int,
+checked int default 0,
+ok int default 0,
+missing int default 0,
+mismatched int default 0,
+bytes_checked int default 0,
+err text default ''
+)`,
+				`CREATE TABLE IF NOT EXISTS audit_file (
+audit_id int,
+name text,
+problem text
+)`,
+			)(tx)
+		},
+	},
+	{
+		version: 6,
+		name:    "add file original_sha256 and verified",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file", "original_sha256", "text default ''")
+			if err != nil {
+				return err
+			}
+			return addColumn(tx, "file", "verified_epoch_ms", "int default 0")
+		},
+	},
+	{
+		version: 7,
+		name:    "add file trash columns",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file", "trash_path", "text default ''")
+			if err != nil {
+				return err
+			}
+			return addColumn(tx, "file", "trashed_epoch_ms", "int default 0")
+		},
+	},
+	{
+		version: 8,
+		name:    "add file capture time",
+		fn: func(tx *sql.Tx) error {
+			return addColumn(tx, "file", "captured_epoch_ms", "int default 0")
+		},
+	},
+	{
+		version: 9,
+		name:    "add file uploaded hash",
+		fn: func(tx *sql.Tx) error {
+			return addColumn(tx, "file", "uploaded_sha256", "text default ''")
+		},
+	},
+	{
+		version: 10,
+		name:    "add file uploaded size",
+		fn: func(tx *sql.Tx) error {
+			return addColumn(tx, "file", "uploaded_size", "int default 0")
+		},
+	},
+	{
+		version: 11,
+		name:    "create destination tables",
+		fn: func(tx *sql.Tx) error {
+			err := execAll(
+				`CREATE TABLE IF NOT EXISTS destination (
+id integer PRIMARY KEY AUTOINCREMENT,
+name text UNIQUE,
+backend text default 'http',
+url text default '',
+username text default '',
+password text default '',
+enabled int default 1,
+required int default 1,
+allow_mobile int default 0,
+min_interval_ms int default 0,
+last_run_epoch_ms int default 0,
+retry_after_epoch_ms int default 0
+)`,
+				`CREATE TABLE IF NOT EXISTS file_destination (
+name text,
+destination_id int,
+state int,
+upload_end_epoch_ms int default 0,
+retry_after_epoch_ms int default 0,
+server_error text default '',
+PRIMARY KEY (name, destination_id)
+)`,
+				// the single server configured by older versions becomes
+				// the primary destination
+				`INSERT OR IGNORE INTO destination (id, name, url, username, password, allow_mobile, retry_after_epoch_ms) values (1, 'default',
+coalesce((select val from config where key = 'url'), ''),
+coalesce((select val from config where key = 'username'), ''),
+coalesce((select val from config where key = 'password'), ''),
+coalesce((select val from config where key = 'allow_mobile_upload'), 0),
+coalesce((select val from config where key = 'retry_after_epoch_ms'), 0))`,
+				`INSERT OR IGNORE INTO file_destination (name, destination_id, state, upload_end_epoch_ms, retry_after_epoch_ms, server_error)
+select name, 1, case when state in (9, 10) then 3 else state end, coalesce(upload_end_epoch_ms, 0), coalesce(retry_after_epoch_ms, 0), coalesce(server_error, '')
+from file where state in (2, 3, 4, 5, 7, 9, 10, 11)`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+			return addColumn(tx, "attempt", "destination_id", "int default 1")
+		},
+	},
+	{
+		version: 12,
+		name:    "add destination options",
+		fn: func(tx *sql.Tx) error {
+			return addColumn(tx, "destination", "options", "text default ''")
+		},
+	},
+	{
+		version: 13,
+		name:    "add destination oauth tokens",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "destination", "access_token", "text default ''")
+			if err != nil {
+				return err
+			}
+			err = addColumn(tx, "destination", "refresh_token", "text default ''")
+			if err != nil {
+				return err
+			}
+			return addColumn(tx, "destination", "token_expiry_epoch_ms", "int default 0")
+		},
+	},
+	{
+		version: 14,
+		name:    "add destination tls settings",
+		fn: func(tx *sql.Tx) error {
+			for _, col := range []string{"tls_ca", "tls_pin", "tls_client_cert", "tls_client_key"} {
+				err := addColumn(tx, "destination", col, "text default ''")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 15,
+		name:    "add attempt failure kind",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "attempt", "failure", "text default ''")
+			if err != nil {
+				return err
+			}
+			// earlier versions only recorded mismatches in the error text
+			_, err = tx.Exec("update attempt set failure = 'mismatch' where phase = 'confirm' and err like '%mismatch%'")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("update attempt set failure = 'other' where err != '' and failure = ''")
+			return err
+		},
+	},
+	{
+		version: 16,
+		name:    "add file pre-trash state",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file", "trashed_from_state", "int default 0")
+			if err != nil {
+				return err
+			}
+			// files trashed by earlier versions were all uploaded
+			_, err = tx.Exec("update file set trashed_from_state = 3 where state in (9, 10)")
+			return err
+		},
+	},
+	{
+		version: 17,
+		name:    "add file destination uploaded object",
+		fn: func(tx *sql.Tx) error {
+			err := addColumn(tx, "file_destination", "uploaded_sha256", "text default ''")
+			if err != nil {
+				return err
+			}
+			err = addColumn(tx, "file_destination", "uploaded_size", "int default 0")
+			if err != nil {
+				return err
+			}
+			// earlier versions kept one uploaded hash per file, which
+			// only the primary destination was checked against. The
+			// file columns are left in place but no longer read.
+			_, err = tx.Exec(`update file_destination set
+uploaded_sha256 = coalesce((select f.uploaded_sha256 from file f where f.name = file_destination.name), ''),
+uploaded_size = coalesce((select f.uploaded_size from file f where f.name = file_destination.name), 0)
+where destination_id = 1`)
+			return err
+		},
+	},
+}
+
+// SchemaVersion is the version the db will be at after migrate runs.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func migrate(db *sql.DB) error {
+	return runMigrations(db, migrations)
+}
+
+// runMigrations applies each of ms newer than the db's version, in
+// order.
+func runMigrations(db *sql.DB, ms []migration) error {
+	err := checkMigrations(ms)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version int)")
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if m.version <= current {
+			continue
+		}
+
+		log.Printf("migrate db %d -> %d: %s", current, m.version, m.name)
+
+		err := runMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		current = m.version
+	}
+
+	return nil
+}
+
+// checkMigrations makes sure versions count up from 1 with no gaps,
+// so a misnumbered migration can't be skipped on some devices.
+func checkMigrations(ms []migration) error {
+	for i, m := range ms {
+		if m.version != i+1 {
+			return fmt.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+	return nil
+}
+
+func runMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.fn(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from schema_version")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into schema_version (version) values (?)", m.version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("select version from schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column to table unless it already exists, since
+// sqlite has no ADD COLUMN IF NOT EXISTS.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			typ       string
+			notNull   bool
+			dfltValue interface{}
+			pk        int
+		)
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dfltValue, &pk)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// baselineSchema is the schema created by versions before
+// schema_version existed.
+var baselineSchema = []string{
+	`CREATE TABLE config (
+key text PRIMARY KEY,
+val
+)`,
+	`CREATE TABLE file (
+name text PRIMARY KEY,
+created_epoch_ms int,
+upload_started_epoch_ms int,
+upload_end_epoch_ms int,
+size int,
+path text,
+state int
+)`,
+	`INSERT INTO config (key, val) values ('url', 'https://backup.example.com/upload'), ('username', 'alice'), ('password', 'hunter2'), ('enabled', 1)`,
+	`INSERT INTO file (name, created_epoch_ms, upload_started_epoch_ms, upload_end_epoch_ms, size, path, state) values
+('pending.jpg', 1000, 0, 0, 10, '/sdcard/DCIM/Camera/pending.jpg', 1),
+('done.jpg', 1000, 2000, 3000, 20, '/sdcard/DCIM/Camera/done.jpg', 3),
+('trashed.jpg', 1000, 2000, 4000, 30, '/sdcard/DCIM/Camera/trashed.jpg', 9),
+('cleaned.jpg', 1000, 2000, 5000, 40, '/sdcard/DCIM/Camera/cleaned.jpg', 10)`,
+}
+
+// migratedColumns lists the tables and columns that migrations 1-17
+// create.
+var migratedColumns = map[string][]string{
+	"config": {"key", "val"},
+	"file": {
+		"name", "created_epoch_ms", "upload_started_epoch_ms", "upload_end_epoch_ms", "size", "path", "state",
+		"server_error", "retry_after_epoch_ms", "sha256", "audited_epoch_ms", "original_sha256", "verified_epoch_ms",
+		"trash_path", "trashed_epoch_ms", "captured_epoch_ms", "uploaded_sha256", "uploaded_size", "trashed_from_state",
+	},
+	"run":        {"id", "trigger", "started_epoch_ms", "ended_epoch_ms", "net_state", "attempted", "succeeded", "skipped", "failed", "bytes_sent", "err"},
+	"run_file":   {"run_id", "name", "state", "bytes"},
+	"attempt":    {"id", "name", "run_id", "started_epoch_ms", "ended_epoch_ms", "phase", "http_status", "server_error", "err", "bytes_sent", "destination_id", "failure"},
+	"audit":      {"id", "started_epoch_ms", "ended_epoch_ms", "checked", "ok", "missing", "mismatched", "bytes_checked", "err"},
+	"audit_file": {"audit_id", "name", "problem"},
+	"destination": {
+		"id", "name", "backend", "url", "username", "password", "enabled", "required", "allow_mobile", "min_interval_ms",
+		"last_run_epoch_ms", "retry_after_epoch_ms", "options", "access_token", "refresh_token", "token_expiry_epoch_ms",
+		"tls_ca", "tls_pin", "tls_client_cert", "tls_client_key",
+	},
+	"file_destination": {"name", "destination_id", "state", "upload_end_epoch_ms", "retry_after_epoch_ms", "server_error", "uploaded_sha256", "uploaded_size"},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableColumns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rows, err := db.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cols[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cols
+}
+
+func TestMigrateFromBaseline(t *testing.T) {
+	db := openTestDB(t)
+	for _, stmt := range baselineSchema {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Fatalf("schema version %d, want %d", version, SchemaVersion())
+	}
+
+	for table, want := range migratedColumns {
+		have := tableColumns(t, db, table)
+		if len(have) == 0 {
+			t.Errorf("table %s missing", table)
+			continue
+		}
+		for _, col := range want {
+			if !have[col] {
+				t.Errorf("column %s.%s missing", table, col)
+			}
+		}
+	}
+
+	var url, username, password string
+	err = db.QueryRow("select val from config where key = 'url'").Scan(&url)
+	if err != nil || url != "https://backup.example.com/upload" {
+		t.Errorf("config url = %q, %v", url, err)
+	}
+	err = db.QueryRow("select url, username, password from destination where id = ?", PrimaryDestinationID).Scan(&url, &username, &password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://backup.example.com/upload" || username != "alice" || password != "hunter2" {
+		t.Errorf("primary destination = %q %q %q, want the old config", url, username, password)
+	}
+
+	var files int
+	err = db.QueryRow("select count(*) from file").Scan(&files)
+	if err != nil || files != 4 {
+		t.Errorf("file rows = %d, %v, want 4", files, err)
+	}
+
+	wantStates := map[string]UploadState{
+		"done.jpg":    UploadSuccess,
+		"trashed.jpg": UploadSuccess,
+		"cleaned.jpg": UploadSuccess,
+	}
+	rows, err := db.Query("select name, state from file_destination where destination_id = ?", PrimaryDestinationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStates := make(map[string]UploadState)
+	for rows.Next() {
+		var (
+			name  string
+			state UploadState
+		)
+		err = rows.Scan(&name, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStates[name] = state
+	}
+	rows.Close()
+	if len(gotStates) != len(wantStates) {
+		t.Errorf("file_destination rows = %v, want %v", gotStates, wantStates)
+	}
+	for name, want := range wantStates {
+		if gotStates[name] != want {
+			t.Errorf("file_destination %s state = %s, want %s", name, gotStates[name], want)
+		}
+	}
+
+	// a second run has nothing to do
+	var ran bool
+	second := append([]migration(nil), migrations...)
+	for i := range second {
+		fn := second[i].fn
+		second[i].fn = func(tx *sql.Tx) error {
+			ran = true
+			return fn(tx)
+		}
+	}
+	err = runMigrations(db, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Error("second migrate ran a migration")
+	}
+	version, err = schemaVersion(db)
+	if err != nil || version != SchemaVersion() {
+		t.Errorf("schema version after second run = %d, %v", version, err)
+	}
+}
+
+func TestMigrateRejectsBadVersions(t *testing.T) {
+	noop := func(tx *sql.Tx) error { return nil }
+
+	for _, tc := range []struct {
+		name     string
+		versions []int
+	}{
+		{"out of order", []int{1, 3, 2}},
+		{"gap", []int{1, 2, 4}},
+		{"not from 1", []int{2, 3}},
+		{"duplicate", []int{1, 1, 2}},
+	} {
+		var ms []migration
+		for _, v := range tc.versions {
+			ms = append(ms, migration{version: v, name: "test", fn: noop})
+		}
+		db := openTestDB(t)
+		err := runMigrations(db, ms)
+		if err == nil {
+			t.Errorf("%s: versions %v accepted", tc.name, tc.versions)
+		}
+	}
+}
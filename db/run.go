@@ -0,0 +1,131 @@
+package db
+
+import (
+	"time"
+
+	"github.com/retailnext/unixtime"
+)
+
+type Run struct {
+	ID        int64
+	Trigger   string
+	Started   time.Time
+	Ended     time.Time
+	NetState  string
+	Attempted int
+	Succeeded int
+	Skipped   int
+	Failed    int
+	BytesSent int64
+	Err       string
+}
+
+type RunFile struct {
+	RunID int64
+	Name  string
+	State UploadState
+	Bytes int64
+}
+
+func (db *DB) StartRun(trigger string) (*Run, error) {
+	now := time.Now()
+	ts := unixtime.ToUnix(now, time.Millisecond)
+	result, err := db.DB.Exec("insert into run (trigger, started_epoch_ms) values (?, ?)", trigger, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	run := Run{
+		ID:      id,
+		Trigger: trigger,
+		Started: now,
+	}
+
+	return &run, nil
+}
+
+func (db *DB) EndRun(run *Run) error {
+	run.Ended = time.Now()
+	ts := unixtime.ToUnix(run.Ended, time.Millisecond)
+	_, err := db.DB.Exec("update run set ended_epoch_ms = ?, net_state = ?, attempted = ?, succeeded = ?, skipped = ?, failed = ?, bytes_sent = ?, err = ? where id = ?",
+		ts, run.NetState, run.Attempted, run.Succeeded, run.Skipped, run.Failed, run.BytesSent, run.Err, run.ID)
+	return err
+}
+
+func (db *DB) AddRunFile(runID int64, name string, state UploadState, bytes int64) error {
+	_, err := db.DB.Exec("insert into run_file (run_id, name, state, bytes) values (?, ?, ?, ?)", runID, name, state, bytes)
+	return err
+}
+
+func (db *DB) RecentRuns(limit int) ([]Run, error) {
+	rows, err := db.DB.Query("select id, trigger, started_epoch_ms, ended_epoch_ms, net_state, attempted, succeeded, skipped, failed, bytes_sent, err from run order by id desc limit ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+
+	for rows.Next() {
+		var run Run
+		var (
+			startedMS *int64
+			endedMS   *int64
+			netState  *string
+			runErr    *string
+		)
+		err = rows.Scan(&run.ID, &run.Trigger, &startedMS, &endedMS, &netState, &run.Attempted, &run.Succeeded, &run.Skipped, &run.Failed, &run.BytesSent, &runErr)
+		if err != nil {
+			return nil, err
+		}
+
+		if startedMS != nil {
+			run.Started = unixtime.ToTime(*startedMS, time.Millisecond)
+		}
+		if endedMS != nil {
+			run.Ended = unixtime.ToTime(*endedMS, time.Millisecond)
+		}
+		if netState != nil {
+			run.NetState = *netState
+		}
+		if runErr != nil {
+			run.Err = *runErr
+		}
+
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func (db *DB) RunFiles(runID int64) ([]RunFile, error) {
+	rows, err := db.DB.Query("select run_id, name, state, bytes from run_file where run_id = ? order by rowid", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []RunFile
+
+	for rows.Next() {
+		var f RunFile
+		err = rows.Scan(&f.RunID, &f.Name, &f.State, &f.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
@@ -8,9 +8,12 @@ require (
 	git.wow.st/gmp/jni v0.0.0-20200827154156-014cd5c7c4c0
 	github.com/disintegration/imageorient v0.0.0-20180920195336-8147d86e83ec
 	github.com/dustin/go-humanize v1.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/restic/chunker v0.4.0
 	github.com/retailnext/unixtime v0.0.0-20171004230528-01070448a2fe
+	golang.org/x/crypto v0.25.0
 )
 
 require (
@@ -13,6 +13,7 @@ import (
 	"gioui.org/app"
 	_ "gioui.org/app/permission/storage"
 	"git.wow.st/gmp/jni"
+	"github.com/psanford/android-media-backup/db"
 	"github.com/psanford/android-media-backup/upload"
 )
 
@@ -110,11 +111,33 @@ func Java_io_sanford_media_1backup_Jni_permissionResult(env *C.JNIEnv, cls C.jcl
 
 //export Java_io_sanford_media_1backup_BackgroundWorker_runBackgroundJob
 func Java_io_sanford_media_1backup_BackgroundWorker_runBackgroundJob() {
+	store, err := db.Open()
+	if err != nil {
+		log.Printf("open db err: %s", err)
+		return
+	}
+	defer store.Close()
+
 	log.Printf("begin upload work")
-	err := upload.Upload()
+	err = upload.Upload(store, upload.TriggerBackground)
 	if err != nil {
 		log.Printf("upload work err: %s", err)
 	} else {
 		log.Printf("upload work complete")
 	}
+
+	err = upload.ReadCaptureTimes(store)
+	if err != nil {
+		log.Printf("read capture times err: %s", err)
+	}
+
+	err = upload.CheckIntegrity(store)
+	if err != nil {
+		log.Printf("integrity check err: %s", err)
+	}
+
+	err = upload.PurgeTrash(store, upload.TrashRetention)
+	if err != nil {
+		log.Printf("purge trash err: %s", err)
+	}
 }
@@ -0,0 +1,51 @@
+package power
+
+/*
+#include <jni.h>
+*/
+import "C"
+
+import (
+	"log"
+	"unsafe"
+
+	"gioui.org/app"
+	"git.wow.st/gmp/jni"
+)
+
+// Charging reports whether the device is plugged in and charging.
+func Charging() (bool, error) {
+	return callBool("isCharging")
+}
+
+// Idle reports whether the screen is off. A device whose state can't
+// be read is not idle.
+func Idle() (bool, error) {
+	interactive, err := callBool("isInteractive")
+	if err != nil {
+		return false, err
+	}
+	return !interactive, nil
+}
+
+func callBool(method string) (bool, error) {
+	jvm := jni.JVMFor(app.JavaVM())
+	var result int
+	err := jni.Do(jvm, func(env jni.Env) error {
+
+		var uptr = app.AppContext()
+		appCtx := *(*jni.Object)(unsafe.Pointer(&uptr))
+		loader := jni.ClassLoaderFor(env, appCtx)
+		cls, err := jni.LoadClass(env, loader, "io.sanford.media_backup.Jni")
+		if err != nil {
+			log.Printf("Load io.sanford.media_backup.Jni error: %s", err)
+		}
+
+		mid := jni.GetStaticMethodID(env, cls, method, "(Landroid/content/Context;)I")
+		result, err = jni.CallStaticIntMethod(env, cls, mid, jni.Value(appCtx))
+
+		return err
+	})
+
+	return result == 1, err
+}
@@ -1,11 +1,16 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"log"
+	neturl "net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -70,6 +75,22 @@ func (ui *UI) loop(w *app.Window) error {
 	if err != nil {
 		plog.Printf("get allowMobile err: %s", err)
 	}
+	stripMetadata, err := ui.db.StripMetadata()
+	if err != nil {
+		plog.Printf("get strip metadata err: %s", err)
+	}
+	previewOnMobile, err := ui.db.PreviewOnMobile()
+	if err != nil {
+		plog.Printf("get preview on mobile err: %s", err)
+	}
+	previewSize, err := ui.db.PreviewSize()
+	if err != nil {
+		plog.Printf("get preview size err: %s", err)
+	}
+	previewQuality, err := ui.db.PreviewQuality()
+	if err != nil {
+		plog.Printf("get preview quality err: %s", err)
+	}
 
 	url, err := ui.db.URL()
 	if err != nil {
@@ -83,29 +104,65 @@ func (ui *UI) loop(w *app.Window) error {
 	if err != nil {
 		plog.Printf("get password err: %s", err)
 	}
+	serverOptions, err := ui.db.ServerOptions()
+	if err != nil {
+		plog.Printf("get server options err: %s", err)
+	}
+	cleanupDays, err := ui.db.CleanupAgeDays()
+	if err != nil {
+		plog.Printf("get cleanup days err: %s", err)
+	}
+	deviceID, err := ui.db.DeviceID()
+	if err != nil {
+		plog.Printf("get device id err: %s", err)
+	}
+	deviceName, err := ui.db.DeviceName()
+	if err != nil {
+		plog.Printf("get device name err: %s", err)
+	}
 
 	urlEditor.SetText(url)
 	usernameEditor.SetText(username)
 	if password != "" {
 		passwordEditor.SetText(password)
 	}
+	serverOptionsEditor.SetText(serverOptions)
+	loadTLSSettings(ui.db, db.PrimaryDestinationID, "the server")
+	cleanupDaysEditor.SetText(strconv.Itoa(cleanupDays))
+	deviceIDEditor.SetText(deviceID)
+	deviceNameEditor.SetText(deviceName)
+	devicePublicKey, err = upload.DevicePublicKey(ui.db)
+	if err != nil {
+		plog.Printf("get device key err: %s", err)
+	}
+	serverRestoreDirEditor.SetText(upload.MediaPath())
 	enabledToggle.Value = enabledConf
 	wifiOnlyToggle.Value = !allowMobileUpload
+	stripToggle.Value = stripMetadata
+	previewToggle.Value = previewOnMobile
+	previewSizeEditor.SetText(strconv.Itoa(previewSize))
+	previewQualityEditor.SetText(strconv.Itoa(previewQuality))
+	stripDirEditor.SetText(upload.MediaPath())
 
 	var (
 		permResult <-chan jgo.PermResult
 		viewEvent  app.ViewEvent
 
 		th           = material.NewTheme()
-		manualUpload = make(chan chan struct{})
+		manualUpload = make(chan uploadRequest)
+		statsChanged = make(chan struct{}, 1)
 		minuteTicker = time.NewTicker(1 * time.Minute)
 	)
 
 	go func() {
-		for result := range manualUpload {
-			upload.Upload()
+		for req := range manualUpload {
+			upload.Upload(ui.db, req.trigger)
+			select {
+			case req.result <- struct{}{}:
+			default:
+			}
 			select {
-			case result <- struct{}{}:
+			case statsChanged <- struct{}{}:
 			default:
 			}
 			w.Invalidate()
@@ -116,11 +173,50 @@ func (ui *UI) loop(w *app.Window) error {
 		lastSyncTime, _ = ui.db.LastCheckTime()
 		lastFileUpload, _ = ui.db.LastFileUpload()
 		pendingUploads, _ = ui.db.PendingUploads()
+		corruptFiles, _ = ui.db.CorruptFiles()
+		cleanupPreview, _ = upload.PreviewCleanup(ui.db, time.Duration(cleanupDays)*24*time.Hour)
+		trashSummary, _ = upload.TrashSummary(ui.db)
 		recentUploads, _ = ui.db.UploadsSince(time.Now().Add(-30*24*time.Hour), db.UploadSuccess)
 		recentFailedUploads, _ = ui.db.UploadsSince(time.Now().Add(-30*24*time.Hour), db.UploadFailed)
 
 		files, _ = ui.db.GetFiles()
+		fileDests, _ = ui.db.AllFileDestinations()
+		loadDestinations(ui.db)
+		runs, _ = ui.db.RecentRuns(50)
+		fileErrors, _ = ui.db.LatestFailedAttempts()
+		serverCaps, serverCapsFetched = upload.CachedCapabilities(ui.db)
+		if selectedRun != nil {
+			runFiles, _ = ui.db.RunFiles(selectedRun.ID)
+		}
+		stripOverrides, _ = ui.db.StripMetadataOverrides()
+		stripOverrideDirs = stripOverrideDirs[:0]
+		for dir := range stripOverrides {
+			stripOverrideDirs = append(stripOverrideDirs, dir)
+		}
+		sort.Strings(stripOverrideDirs)
+		loadTransforms(ui.db)
+		audits, _ = ui.db.RecentAudits(5)
+		auditProblems = nil
+		if len(audits) > 0 {
+			auditProblems, _ = ui.db.AuditFiles(audits[0].ID)
+		}
+	}
 
+	startUpload := func(trigger upload.Trigger) {
+		req := uploadRequest{
+			trigger: trigger,
+			result:  make(chan struct{}, 1),
+		}
+		select {
+		case manualUpload <- req:
+			uploadInProgress = true
+			go func() {
+				<-req.result
+				uploadInProgress = false
+			}()
+		default:
+			plog.Printf("upload already in progress")
+		}
 	}
 	recheckStats()
 
@@ -143,6 +239,8 @@ func (ui *UI) loop(w *app.Window) error {
 		select {
 		case <-minuteTicker.C:
 			recheckStats()
+		case <-statsChanged:
+			recheckStats()
 		case result := <-permResult:
 			permResult = nil
 			plog.Printf("Perm result: %t %s", result.Authorized, result.Err)
@@ -173,9 +271,9 @@ func (ui *UI) loop(w *app.Window) error {
 			case app.FrameEvent:
 				gtx := app.NewContext(&ops, e)
 
-				var testUploadClicked bool
+				var uploadNowClicked bool
 				if uploadBtn.Clicked(gtx) {
-					testUploadClicked = true
+					uploadNowClicked = true
 				}
 
 				var resetFilesOnce sync.Once
@@ -197,6 +295,16 @@ func (ui *UI) loop(w *app.Window) error {
 					ui.db.SetURL(url)
 				}
 
+				if id := strings.TrimSpace(deviceIDEditor.Text()); id != "" && id != deviceID {
+					deviceID = id
+					ui.db.SetDeviceID(id)
+				}
+
+				if name := strings.TrimSpace(deviceNameEditor.Text()); name != "" && name != deviceName {
+					deviceName = name
+					ui.db.SetDeviceName(name)
+				}
+
 				if usernameEditor.Text() != username {
 					username = usernameEditor.Text()
 					ui.db.SetUsername(username)
@@ -207,19 +315,242 @@ func (ui *UI) loop(w *app.Window) error {
 					ui.db.SetPassword(password)
 				}
 
-				if testUploadClicked {
-					plog.Printf("start test upload")
-					result := make(chan struct{}, 1)
-					select {
-					case manualUpload <- result:
-						uploadInProgress = true
-						go func() {
-							<-result
-							uploadInProgress = false
-						}()
-					default:
-						plog.Printf("upload already in progress")
+				if opts := strings.TrimSpace(serverOptionsEditor.Text()); opts != serverOptions {
+					if _, err := neturl.ParseQuery(opts); err == nil {
+						serverOptions = opts
+						ui.db.SetServerOptions(opts)
+					}
+				}
+
+				if days, err := strconv.Atoi(cleanupDaysEditor.Text()); err == nil && days > 0 && days != cleanupDays {
+					cleanupDays = days
+					ui.db.SetCleanupAgeDays(days)
+					recheckStats()
+				}
+
+				runCleanup := func(name string, f func() error) {
+					if cleanupRunning {
+						return
+					}
+					cleanupRunning = true
+					go func() {
+						err := f()
+						if err != nil {
+							plog.Printf("%s err: %s", name, err)
+						}
+						cleanupRunning = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
+				}
+
+				if freeSpaceBtn.Clicked(gtx) {
+					olderThan := time.Duration(cleanupDays) * 24 * time.Hour
+					runCleanup("free up space", func() error {
+						_, err := upload.FreeUpSpace(ui.db, olderThan)
+						return err
+					})
+				}
+				if emptyTrashBtn.Clicked(gtx) {
+					runCleanup("empty trash", func() error {
+						return upload.PurgeTrash(ui.db, 0)
+					})
+				}
+				if restoreTrashBtn.Clicked(gtx) {
+					runCleanup("restore trash", func() error {
+						return upload.RestoreTrash(ui.db)
+					})
+				}
+
+				if tlsSaveBtn.Clicked(gtx) {
+					err := upload.SetServerTLS(ui.db, tlsDestID, tlsCAEditor.Text(), tlsCertEditor.Text(), tlsKeyEditor.Text())
+					if err != nil {
+						plog.Printf("save tls settings err: %s", err)
+						tlsStatus = "TLS settings not saved: " + err.Error()
+					} else {
+						tlsStatus = "TLS settings saved"
+					}
+				}
+
+				if tlsCheckBtn.Clicked(gtx) && !tlsRunning {
+					tlsRunning = true
+					tlsCandidate = nil
+					destID := tlsDestID
+					go func() {
+						cert, err := upload.FetchServerCertificate(ui.db, destID)
+						switch {
+						case err != nil:
+							plog.Printf("fetch server certificate err: %s", err)
+							tlsStatus = "couldn't get the server certificate: " + err.Error()
+						case cert.Err == nil:
+							tlsStatus = fmt.Sprintf("The server certificate is trusted (key %s)", cert.Fingerprint)
+						case destID != tlsDestID:
+							// another destination was picked meanwhile
+						default:
+							tlsStatus = fmt.Sprintf("The server certificate isn't trusted: %s", cert.Err)
+							tlsCandidate = cert
+						}
+						tlsRunning = false
+						w.Invalidate()
+					}()
+				}
+
+				if tlsTrustBtn.Clicked(gtx) && tlsCandidate != nil {
+					err := upload.PinServerKey(ui.db, tlsDestID, tlsCandidate.Fingerprint)
+					if err != nil {
+						plog.Printf("pin server key err: %s", err)
+						tlsStatus = "couldn't trust the key: " + err.Error()
+					} else {
+						tlsPin = tlsCandidate.Fingerprint
+						tlsStatus = "Trusting key " + tlsPin
+					}
+					tlsCandidate = nil
+				}
+
+				if tlsRejectBtn.Clicked(gtx) {
+					tlsCandidate = nil
+					tlsStatus = ""
+				}
+
+				if tlsPrimaryBtn.Clicked(gtx) {
+					loadTLSSettings(ui.db, db.PrimaryDestinationID, "the server")
+				}
+
+				if tlsClearPinBtn.Clicked(gtx) {
+					err := upload.PinServerKey(ui.db, tlsDestID, "")
+					if err != nil {
+						plog.Printf("clear server key pin err: %s", err)
+					} else {
+						tlsPin = ""
+					}
+				}
+
+				if enrollBtn.Clicked(gtx) && !enrollRunning {
+					enrollRunning = true
+					code := strings.TrimSpace(enrollCodeEditor.Text())
+					go func() {
+						err := upload.Enroll(ui.db, db.PrimaryDestinationID, code)
+						if err != nil {
+							plog.Printf("enroll err: %s", err)
+							enrollSummary = "enrollment failed: " + err.Error()
+						} else {
+							enrollSummary = "device enrolled"
+						}
+						enrollRunning = false
+						w.Invalidate()
+					}()
+				}
+
+				if importBtn.Clicked(gtx) && !importRunning {
+					importRunning = true
+					go func() {
+						result, err := upload.ImportInventory(ui.db)
+						if err != nil {
+							plog.Printf("import inventory err: %s", err)
+							importSummary = "import failed: " + err.Error()
+						} else {
+							importSummary = fmt.Sprintf("%d files already on server, %d new", result.Matched+result.HashMatched, result.Unmatched+result.Hashed-result.HashMatched)
+						}
+						importRunning = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
+				}
+
+				if detectCapsBtn.Clicked(gtx) && !detectingCaps {
+					detectingCaps = true
+					go func() {
+						_, err := upload.RefreshCapabilities(ui.db)
+						if err != nil {
+							plog.Printf("detect server capabilities err: %s", err)
+						}
+						detectingCaps = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
+				}
+
+				if uploadNowClicked {
+					plog.Printf("start manual upload")
+					startUpload(upload.TriggerManual)
+				}
+
+				if auditBtn.Clicked(gtx) && !auditRunning {
+					auditRunning = true
+					go func() {
+						_, err := upload.Audit(ui.db)
+						if err != nil {
+							plog.Printf("audit err: %s", err)
+						}
+						auditRunning = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
+				}
+
+				startSignIn := func(destID int64, name string) {
+					if signInRunning {
+						return
 					}
+					signInRunning = true
+					setSignInStatus("Starting sign in to " + name)
+					go func() {
+						defer func() {
+							signInRunning = false
+							w.Invalidate()
+						}()
+						auth, err := upload.StartSignIn(ui.db, destID)
+						if err != nil {
+							plog.Printf("sign in to %s err: %s", name, err)
+							setSignInStatus(fmt.Sprintf("Sign in to %s failed: %s", name, err))
+							return
+						}
+						setSignInStatus(fmt.Sprintf("To sign in to %s, open %s and enter the code %s", name, auth.VerificationURI, auth.UserCode))
+						w.Invalidate()
+
+						err = auth.Wait(context.Background(), ui.db)
+						if err != nil {
+							plog.Printf("sign in to %s err: %s", name, err)
+							setSignInStatus(fmt.Sprintf("Sign in to %s failed: %s", name, err))
+							return
+						}
+						plog.Printf("signed in to %s", name)
+						setSignInStatus("Signed in to " + name)
+					}()
+				}
+
+				if signInBtn.Clicked(gtx) {
+					startSignIn(db.PrimaryDestinationID, "the server")
+				}
+
+				if connTestBtn.Clicked(gtx) && !connTestRunning {
+					connTestRunning = true
+					go func() {
+						upload.TestConnection(ui.db, func(steps []upload.CheckStep) {
+							connTestMux.Lock()
+							connTestSteps = steps
+							connTestMux.Unlock()
+							w.Invalidate()
+						})
+						connTestRunning = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
 				}
 
 				if wifiOnlyToggle.Update(gtx) {
@@ -227,6 +558,137 @@ func (ui *UI) loop(w *app.Window) error {
 					ui.db.SetAllowMobileUpload(allowMobile)
 				}
 
+				for i := range destRows {
+					d := destRows[i]
+					changed := false
+					if destEnabledToggles[i].Update(gtx) {
+						d.Enabled = destEnabledToggles[i].Value
+						changed = true
+					}
+					if destRequiredToggles[i].Update(gtx) {
+						d.Required = destRequiredToggles[i].Value
+						changed = true
+					}
+					if destWifiToggles[i].Update(gtx) {
+						d.AllowMobile = !destWifiToggles[i].Value
+						changed = true
+					}
+					if changed {
+						err := ui.db.SaveDestination(&d)
+						if err != nil {
+							plog.Printf("save destination err: %s", err)
+						}
+						recheckStats()
+						break
+					}
+					if destEditBtns[i].Clicked(gtx) {
+						destEditID = d.ID
+						destNameEditor.SetText(d.Name)
+						destBackendEditor.SetText(d.Backend)
+						destURLEditor.SetText(d.URL)
+						destUsernameEditor.SetText(d.Username)
+						destPasswordEditor.SetText(d.Password)
+						destIntervalEditor.SetText(strconv.Itoa(int(d.MinInterval.Hours())))
+						destOptionsEditor.SetText(d.Options)
+						destErr = ""
+					}
+					if destSignInBtns[i].Clicked(gtx) {
+						startSignIn(d.ID, d.Name)
+					}
+					if destTLSBtns[i].Clicked(gtx) {
+						loadTLSSettings(ui.db, d.ID, d.Name)
+					}
+					if destRemoveBtns[i].Clicked(gtx) {
+						err := ui.db.DeleteDestination(d.ID)
+						if err != nil {
+							plog.Printf("remove destination err: %s", err)
+						}
+						recheckStats()
+						break
+					}
+				}
+				if destCancelBtn.Clicked(gtx) {
+					clearDestForm()
+				}
+				if destSaveBtn.Clicked(gtx) {
+					d, err := destFromForm()
+					if err == nil {
+						err = ui.db.SaveDestination(d)
+					}
+					if err != nil {
+						destErr = err.Error()
+					} else {
+						clearDestForm()
+						recheckStats()
+					}
+				}
+
+				for i := range transformRows {
+					toggled := transformToggles[i].Update(gtx)
+					up := transformUpBtns[i].Clicked(gtx) && i > 0 && transformToggles[i].Value
+					if !toggled && !up {
+						continue
+					}
+					rows := append([]upload.Transform(nil), transformRows...)
+					on := make([]bool, len(rows))
+					for j := range on {
+						on[j] = transformToggles[j].Value
+					}
+					if up {
+						rows[i-1], rows[i] = rows[i], rows[i-1]
+						on[i-1], on[i] = on[i], on[i-1]
+					}
+					var chain []upload.Transform
+					for j, name := range rows {
+						if on[j] {
+							chain = append(chain, name)
+						}
+					}
+					err := upload.SetTransformChain(ui.db, chain)
+					if err != nil {
+						plog.Printf("save transform chain err: %s", err)
+					}
+					loadTransforms(ui.db)
+					break
+				}
+
+				if previewToggle.Update(gtx) {
+					ui.db.SetPreviewOnMobile(previewToggle.Value)
+				}
+				if size, err := strconv.Atoi(previewSizeEditor.Text()); err == nil && size > 0 && size != previewSize {
+					previewSize = size
+					ui.db.SetPreviewSize(size)
+				}
+				if quality, err := strconv.Atoi(previewQualityEditor.Text()); err == nil && quality > 0 && quality <= 100 && quality != previewQuality {
+					previewQuality = quality
+					ui.db.SetPreviewQuality(quality)
+				}
+
+				if stripToggle.Update(gtx) {
+					ui.db.SetStripMetadata(stripToggle.Value)
+				}
+				if dir := strings.TrimSpace(stripDirEditor.Text()); dir != "" {
+					changed := false
+					if stripAlwaysBtn.Clicked(gtx) {
+						ui.db.SetStripMetadataOverride(dir, true)
+						changed = true
+					}
+					if stripNeverBtn.Clicked(gtx) {
+						ui.db.SetStripMetadataOverride(dir, false)
+						changed = true
+					}
+					if changed {
+						recheckStats()
+					}
+				}
+				for i := range stripRemoveBtns {
+					if stripRemoveBtns[i].Clicked(gtx) && i < len(stripOverrideDirs) {
+						ui.db.RemoveStripMetadataOverride(stripOverrideDirs[i])
+						recheckStats()
+						break
+					}
+				}
+
 				if enabledToggle.Update(gtx) {
 					enabled := enabledToggle.Value
 					ui.db.SetEnabled(enabled)
@@ -236,6 +698,160 @@ func (ui *UI) loop(w *app.Window) error {
 					}
 				}
 
+				for i := range runBtns {
+					if runBtns[i].Clicked(gtx) && i < len(runs) {
+						run := runs[i]
+						selectedRun = &run
+						runFiles, _ = ui.db.RunFiles(run.ID)
+					}
+				}
+				if runBackBtn.Clicked(gtx) {
+					selectedRun = nil
+					runFiles = nil
+				}
+
+				for i := range fileBtns {
+					if fileBtns[i].Clicked(gtx) && i < len(files) {
+						file := files[i]
+						selectedFile = &file
+						fileAttempts, _ = ui.db.FileAttempts(file.Name)
+					}
+				}
+				if fileBackBtn.Clicked(gtx) {
+					selectedFile = nil
+					fileAttempts = nil
+				}
+
+				if restoreBtn.Clicked(gtx) && selectedFile != nil && !restoreRunning {
+					restoreRunning = true
+					name := selectedFile.Name
+					go func() {
+						err := upload.RestoreFromServer(ui.db, name)
+						if err != nil {
+							plog.Printf("restore %s err: %s", name, err)
+						}
+						restoreRunning = false
+						select {
+						case statsChanged <- struct{}{}:
+						default:
+						}
+						w.Invalidate()
+					}()
+				}
+
+				loadRemote := func(cursor string) {
+					if remoteLoading {
+						return
+					}
+					remoteLoading = true
+					go func() {
+						page, fromCache, err := upload.BrowseInventory(ui.db, cursor, remotePageSize)
+						onDevice := make(map[string]bool)
+						if page != nil {
+							for _, obj := range page.Objects {
+								onDevice[obj.ID] = upload.OnDevice(obj)
+							}
+						}
+
+						remoteMux.Lock()
+						if err != nil {
+							plog.Printf("remote inventory err: %s", err)
+							remoteErr = err.Error()
+						} else {
+							remoteErr = ""
+							remotePage = page
+							remoteFromCache = fromCache
+							remoteCursor = cursor
+							remoteOnDevice = onDevice
+						}
+						remoteMux.Unlock()
+						remoteLoading = false
+						w.Invalidate()
+					}()
+				}
+
+				if tabs.tabs[tabs.selected].Title == "Remote" && remotePage == nil && remoteErr == "" {
+					loadRemote("")
+				}
+				if remoteRefreshBtn.Clicked(gtx) {
+					loadRemote(remoteCursor)
+				}
+				if remoteNextBtn.Clicked(gtx) && remotePage != nil && remotePage.NextCursor != "" && !remoteLoading {
+					remotePrevCursors = append(remotePrevCursors, remoteCursor)
+					loadRemote(remotePage.NextCursor)
+				}
+				if remotePrevBtn.Clicked(gtx) && len(remotePrevCursors) > 0 && !remoteLoading {
+					prev := remotePrevCursors[len(remotePrevCursors)-1]
+					remotePrevCursors = remotePrevCursors[:len(remotePrevCursors)-1]
+					loadRemote(prev)
+				}
+
+				if remotePage != nil {
+					for i := range remoteBtns {
+						if !remoteBtns[i].Clicked(gtx) || i >= len(remotePage.Objects) {
+							continue
+						}
+						obj := remotePage.Objects[i]
+						remoteMux.Lock()
+						busy := remoteDownloading[obj.ID]
+						remoteDownloading[obj.ID] = true
+						remoteMux.Unlock()
+						if busy {
+							continue
+						}
+						go func() {
+							err := upload.RestoreObject(ui.db, obj)
+							if err != nil {
+								plog.Printf("download %s err: %s", obj.Name, err)
+							}
+							remoteMux.Lock()
+							delete(remoteDownloading, obj.ID)
+							remoteOnDevice[obj.ID] = upload.OnDevice(obj)
+							remoteMux.Unlock()
+							select {
+							case statsChanged <- struct{}{}:
+							default:
+							}
+							w.Invalidate()
+						}()
+					}
+				}
+
+				if serverRestoreBtn.Clicked(gtx) && !serverRestoreRunning {
+					from, to, err := parseRestoreRange(serverRestoreFromEditor.Text(), serverRestoreToEditor.Text())
+					if err != nil {
+						serverRestoreErr = err.Error()
+					} else {
+						serverRestoreRunning = true
+						serverRestoreErr = ""
+						opts := upload.RestoreOptions{
+							Dir:  strings.TrimSpace(serverRestoreDirEditor.Text()),
+							From: from,
+							To:   to,
+						}
+						go func() {
+							_, err := upload.Restore(ui.db, opts, func(p upload.RestoreProgress) {
+								serverRestoreMux.Lock()
+								serverRestoreProgress = &p
+								serverRestoreMux.Unlock()
+								w.Invalidate()
+							})
+							if err != nil {
+								plog.Printf("restore from server err: %s", err)
+								serverRestoreMux.Lock()
+								serverRestoreErr = err.Error()
+								serverRestoreMux.Unlock()
+							}
+							serverRestoreRunning = false
+							select {
+							case statsChanged <- struct{}{}:
+							default:
+							}
+							w.Invalidate()
+						}()
+					}
+				}
+
 				ui.drawTabs(gtx, th)
 				e.Frame(gtx.Ops)
 				acks <- struct{}{}
@@ -262,16 +878,82 @@ var (
 		SingleLine: true,
 		Submit:     true,
 	}
+	serverOptionsEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	signInBtn      = new(widget.Clickable)
+	signInRunning  = false
+	signInMux      sync.Mutex
+	signInStatus   string
+	deviceIDEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	deviceNameEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	cleanupDaysEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789",
+	}
 	uploadInProgress = false
 	uploadBtn        = new(widget.Clickable)
+	connTestBtn      = new(widget.Clickable)
+	connTestRunning  = false
+	connTestMux      sync.Mutex
+	connTestSteps    []upload.CheckStep
 	resetBtn         = new(widget.Clickable)
 	resetFailedBtn   = new(widget.Clickable)
+	detectCapsBtn    = new(widget.Clickable)
+	freeSpaceBtn     = new(widget.Clickable)
+	emptyTrashBtn    = new(widget.Clickable)
+	restoreTrashBtn  = new(widget.Clickable)
+	cleanupRunning   = false
+	detectingCaps    = false
+	importBtn        = new(widget.Clickable)
+	importRunning    = false
+	importSummary    string
+	enrollCodeEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	enrollBtn       = new(widget.Clickable)
+	enrollRunning   = false
+	enrollSummary   string
+	devicePublicKey string
+
+	tlsCAEditor    = new(widget.Editor)
+	tlsCertEditor  = new(widget.Editor)
+	tlsKeyEditor   = &widget.Editor{Mask: '*'}
+	tlsSaveBtn     = new(widget.Clickable)
+	tlsCheckBtn    = new(widget.Clickable)
+	tlsTrustBtn    = new(widget.Clickable)
+	tlsRejectBtn   = new(widget.Clickable)
+	tlsClearPinBtn = new(widget.Clickable)
+	tlsPrimaryBtn  = new(widget.Clickable)
+	tlsRunning     = false
+	tlsStatus      string
+	tlsPin         string
+	// tlsCandidate is an untrusted server certificate waiting for the
+	// user to trust or reject its key.
+	tlsCandidate *upload.ServerCertificate
+	// tlsDestID is the destination the TLS settings are shown for.
+	tlsDestID   int64
+	tlsDestName string
 
 	lastSyncTime        time.Time
 	lastFileUpload      time.Time
 	pendingUploads      int
+	corruptFiles        int
+	cleanupPreview      *upload.CleanupPreview
+	trashSummary        *upload.CleanupPreview
 	recentUploads       int
 	recentFailedUploads int
+	serverCaps          *upload.Capabilities
+	serverCapsFetched   time.Time
 
 	settingsList = &layout.List{
 		Axis: layout.Vertical,
@@ -285,11 +967,147 @@ var (
 		Axis: layout.Vertical,
 	}
 
-	files []db.File
+	files     []db.File
+	fileDests map[string][]db.FileDestination
+
+	runs        []db.Run
+	runBtns     []widget.Clickable
+	runBackBtn  = new(widget.Clickable)
+	selectedRun *db.Run
+	runFiles    []db.RunFile
+
+	audits        []db.Audit
+	auditProblems []db.AuditFile
+	auditBtn      = new(widget.Clickable)
+	auditRunning  = false
+
+	fileBtns        []widget.Clickable
+	fileBackBtn     = new(widget.Clickable)
+	restoreBtn      = new(widget.Clickable)
+	restoreRunning  = false
+	fileErrors      map[string]db.Attempt
+	selectedFile    *db.File
+	fileAttempts    []db.Attempt
+	fileHistoryList = &layout.List{
+		Axis: layout.Vertical,
+	}
+
+	serverRestoreDirEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	serverRestoreFromEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789-",
+	}
+	serverRestoreToEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789-",
+	}
+	serverRestoreBtn      = new(widget.Clickable)
+	serverRestoreRunning  = false
+	serverRestoreMux      sync.Mutex
+	serverRestoreProgress *upload.RestoreProgress
+	serverRestoreErr      string
+	restoreList           = &layout.List{
+		Axis: layout.Vertical,
+	}
+
+	remoteList = &layout.List{
+		Axis: layout.Vertical,
+	}
+	remotePageSize    = 50
+	remoteMux         sync.Mutex
+	remoteLoading     = false
+	remotePage        *upload.InventoryPage
+	remoteFromCache   bool
+	remoteErr         string
+	remoteCursor      string
+	remotePrevCursors []string
+	remoteOnDevice    = make(map[string]bool)
+	remoteDownloading = make(map[string]bool)
+	remoteBtns        []widget.Clickable
+	remoteRefreshBtn  = new(widget.Clickable)
+	remoteNextBtn     = new(widget.Clickable)
+	remotePrevBtn     = new(widget.Clickable)
+
+	errColor = color.NRGBA{R: 0xb0, A: 0xff}
 
 	topLabel       = "Android Media Backup"
 	enabledToggle  = new(widget.Bool)
 	wifiOnlyToggle = new(widget.Bool)
+	stripToggle    = new(widget.Bool)
+	previewToggle  = new(widget.Bool)
+
+	previewSizeEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789",
+	}
+	previewQualityEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789",
+	}
+
+	stripDirEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	stripAlwaysBtn    = new(widget.Clickable)
+	stripNeverBtn     = new(widget.Clickable)
+	stripRemoveBtns   []widget.Clickable
+	stripOverrides    map[string]bool
+	stripOverrideDirs []string
+
+	destinations        []db.Destination
+	destRows            []db.Destination
+	destEnabledToggles  []widget.Bool
+	destRequiredToggles []widget.Bool
+	destWifiToggles     []widget.Bool
+	destEditBtns        []widget.Clickable
+	destRemoveBtns      []widget.Clickable
+	destSignInBtns      []widget.Clickable
+	destTLSBtns         []widget.Clickable
+	destEditID          int64
+	destErr             string
+	destNameEditor      = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destBackendEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destURLEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destUsernameEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destPasswordEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destIntervalEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+		Filter:     "0123456789",
+	}
+	destOptionsEditor = &widget.Editor{
+		SingleLine: true,
+		Submit:     true,
+	}
+	destSaveBtn   = new(widget.Clickable)
+	destCancelBtn = new(widget.Clickable)
+
+	transformRows    []upload.Transform
+	transformToggles []widget.Bool
+	transformUpBtns  []widget.Clickable
 
 	tabs = Tabs{
 		tabs: []Tab{
@@ -299,6 +1117,12 @@ var (
 			{
 				Title: "Files",
 			},
+			{
+				Title: "Remote",
+			},
+			{
+				Title: "Restore",
+			},
 			{
 				Title: "Debug",
 			},
@@ -308,6 +1132,11 @@ var (
 
 var slider Slider
 
+type uploadRequest struct {
+	trigger upload.Trigger
+	result  chan struct{}
+}
+
 type Tabs struct {
 	list     layout.List
 	tabs     []Tab
@@ -376,8 +1205,12 @@ func (ui *UI) drawTabs(gtx layout.Context, th *material.Theme) layout.Dimensions
 					return drawSettings(gtx, th)
 				case "Files":
 					return ui.drawFiles(gtx, th)
+				case "Remote":
+					return ui.drawRemote(gtx, th)
+				case "Restore":
+					return drawRestore(gtx, th)
 				case "Debug":
-					return drawDebug(gtx, th)
+					return ui.drawDebug(gtx, th)
 				default:
 					return layout.Center.Layout(gtx,
 						material.H1(th, fmt.Sprintf("Tab content %s", selected)).Layout,
@@ -388,36 +1221,85 @@ func (ui *UI) drawTabs(gtx layout.Context, th *material.Theme) layout.Dimensions
 	)
 }
 
-func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
-	textField := func(label, hint string, editor *widget.Editor) func(layout.Context) layout.Dimensions {
-		return func(gtx layout.Context) layout.Dimensions {
-			flex := layout.Flex{
-				Axis: layout.Vertical,
-			}
-			return flex.Layout(gtx,
-				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-					return material.H5(th, label).Layout(gtx)
-				}),
-				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-					e := material.Editor(th, editor, hint)
-					border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
-					return border.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-						return layout.UniformInset(unit.Dp(8)).Layout(gtx, e.Layout)
-					})
-				}),
-			)
+func textField(th *material.Theme, label, hint string, editor *widget.Editor) layout.Widget {
+	return func(gtx layout.Context) layout.Dimensions {
+		flex := layout.Flex{
+			Axis: layout.Vertical,
 		}
+		return flex.Layout(gtx,
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				return material.H5(th, label).Layout(gtx)
+			}),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				e := material.Editor(th, editor, hint)
+				border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
+				return border.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					return layout.UniformInset(unit.Dp(8)).Layout(gtx, e.Layout)
+				})
+			}),
+		)
 	}
+}
 
+func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
 	widgets := []layout.Widget{
-		textField("Server URL", "URL", urlEditor),
-		textField("Username", "Username", usernameEditor),
-		textField("Password", "Password", passwordEditor),
-
+		textField(th, "Server URL", "URL", urlEditor),
+		textField(th, "Username", "Username", usernameEditor),
+		textField(th, "Password", "Password", passwordEditor),
+		textField(th, "Server options", "auth=bearer or auth=oauth&oauth_issuer=...&oauth_client_id=...", serverOptionsEditor),
 		func(gtx layout.Context) layout.Dimensions {
-			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
-				layout.Flexed(0.8, func(gtx C) D {
-					return material.H6(th, "Enable Automatic Backups").Layout(gtx)
+			if !upload.UsesOAuth(serverOptionsEditor.Text()) {
+				return D{}
+			}
+			if signInRunning {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, signInBtn, "Sign In").Layout(gtx)
+		},
+		drawSignIn(th),
+
+		material.H5(th, "TLS").Layout,
+		func(gtx layout.Context) layout.Dimensions {
+			label := material.Body2(th, "Settings for "+tlsDestName)
+			if tlsDestID == db.PrimaryDestinationID {
+				return label.Layout(gtx)
+			}
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.6, label.Layout),
+				layout.Flexed(0.4, material.Button(th, tlsPrimaryBtn, "Show Server").Layout),
+			)
+		},
+		textField(th, "CA certificate to trust (PEM, or path to a .pem file)", "/sdcard/Download/ca.pem", tlsCAEditor),
+		textField(th, "Client certificate for mutual TLS (PEM or path)", "/sdcard/Download/client.pem", tlsCertEditor),
+		textField(th, "Client key (PEM or path)", "/sdcard/Download/client.key", tlsKeyEditor),
+		material.Button(th, tlsSaveBtn, "Save TLS Settings").Layout,
+		func(gtx layout.Context) layout.Dimensions {
+			if tlsPin == "" {
+				return D{}
+			}
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.7, material.Body2(th, "Pinned server key: "+tlsPin).Layout),
+				layout.Flexed(0.3, material.Button(th, tlsClearPinBtn, "Clear").Layout),
+			)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if tlsRunning {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, tlsCheckBtn, "Check Server Certificate").Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if tlsStatus == "" {
+				return D{}
+			}
+			return material.Body1(th, tlsStatus).Layout(gtx)
+		},
+		drawTrustPrompt(th),
+
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.8, func(gtx C) D {
+					return material.H6(th, "Enable Automatic Backups").Layout(gtx)
 				}),
 				layout.Flexed(0.2, func(gtx layout.Context) layout.Dimensions {
 					return layout.Inset{Left: unit.Dp(16)}.Layout(gtx,
@@ -441,6 +1323,78 @@ func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
 			)
 		},
 
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.8, func(gtx C) D {
+					return material.H6(th, "Upload Previews on Mobile Data").Layout(gtx)
+				}),
+
+				layout.Flexed(0.2, func(gtx layout.Context) layout.Dimensions {
+					return layout.Inset{Left: unit.Dp(16)}.Layout(gtx,
+						material.CheckBox(th, previewToggle, "").Layout,
+					)
+				}),
+			)
+		},
+		textField(th, "Preview size (pixels)", "1600", previewSizeEditor),
+		textField(th, "Preview JPEG quality (1-100)", "70", previewQualityEditor),
+
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.8, func(gtx C) D {
+					return material.H6(th, "Strip GPS and Serial Numbers").Layout(gtx)
+				}),
+
+				layout.Flexed(0.2, func(gtx layout.Context) layout.Dimensions {
+					return layout.Inset{Left: unit.Dp(16)}.Layout(gtx,
+						material.CheckBox(th, stripToggle, "").Layout,
+					)
+				}),
+			)
+		},
+		textField(th, "Strip setting for directory", upload.MediaPath(), stripDirEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+				layout.Flexed(0.48, material.Button(th, stripAlwaysBtn, "Always Strip").Layout),
+				layout.Flexed(0.48, material.Button(th, stripNeverBtn, "Never Strip").Layout),
+			)
+		},
+		drawStripOverrides(th),
+		material.H5(th, "Upload Transforms").Layout,
+		drawTransforms(th),
+		material.H5(th, "Other Destinations").Layout,
+		drawDestinations(th),
+		textField(th, "Destination name", "nas", destNameEditor),
+		textField(th, "Backend", strings.Join(upload.Backends(), ", "), destBackendEditor),
+		textField(th, "Destination URL or directory", "https://..., rest:https://... or /storage/...", destURLEditor),
+		textField(th, "Destination username", "Username", destUsernameEditor),
+		textField(th, "Destination password", "Password", destPasswordEditor),
+		textField(th, "Upload at most every (hours, 0 for every run)", "0", destIntervalEditor),
+		textField(th, "Backend options", "file_field=file&success_status=200,201", destOptionsEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			label := "Add Destination"
+			if destEditID != 0 {
+				label = "Save Destination"
+			}
+			return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+				layout.Flexed(0.48, material.Button(th, destSaveBtn, label).Layout),
+				layout.Flexed(0.48, func(gtx C) D {
+					if destEditID == 0 {
+						gtx = gtx.Disabled()
+					}
+					return material.Button(th, destCancelBtn, "Cancel").Layout(gtx)
+				}),
+			)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if destErr == "" {
+				return layout.Dimensions{}
+			}
+			lbl := material.Body1(th, destErr)
+			lbl.Color = errColor
+			return lbl.Layout(gtx)
+		},
+
 		func(gtx layout.Context) layout.Dimensions {
 			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
 				layout.Flexed(0.6, func(gtx C) D {
@@ -485,6 +1439,18 @@ func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
 			)
 		},
 
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.8, func(gtx C) D {
+					return material.H6(th, "Corrupt Local Files:").Layout(gtx)
+				}),
+
+				layout.Flexed(0.2, func(gtx layout.Context) layout.Dimensions {
+					return material.H6(th, strconv.Itoa(corruptFiles)).Layout(gtx)
+				}),
+			)
+		},
+
 		func(gtx layout.Context) layout.Dimensions {
 			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
 				layout.Flexed(0.8, func(gtx C) D {
@@ -509,13 +1475,132 @@ func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
 			)
 		},
 
+		func(gtx layout.Context) layout.Dimensions {
+			if connTestRunning {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, connTestBtn, "Test Connection").Layout(gtx)
+		},
+		drawConnTest(th),
+
 		func(gtx layout.Context) layout.Dimensions {
 			if uploadInProgress || !enabledToggle.Value {
 				gtx = gtx.Disabled()
 			}
-			btn := material.Button(th, uploadBtn, "Test Upload")
+			btn := material.Button(th, uploadBtn, "Upload Now")
 			return btn.Layout(gtx)
 		},
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.6, func(gtx C) D {
+					return material.H6(th, "Server Protocol:").Layout(gtx)
+				}),
+
+				layout.Flexed(0.4, func(gtx layout.Context) layout.Dimensions {
+					str := "unknown"
+					if serverCaps != nil {
+						str = fmt.Sprintf("v%d (checked %s)", serverCaps.ProtocolVersion, humanize.Time(serverCapsFetched))
+					}
+					return material.H6(th, str).Layout(gtx)
+				}),
+			)
+		},
+
+		func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.6, func(gtx C) D {
+					return material.H6(th, "Server Features:").Layout(gtx)
+				}),
+
+				layout.Flexed(0.4, func(gtx layout.Context) layout.Dimensions {
+					str := "none"
+					if serverCaps != nil && len(serverCaps.Features) > 0 {
+						names := make([]string, len(serverCaps.Features))
+						for i, f := range serverCaps.Features {
+							names[i] = string(f)
+						}
+						str = strings.Join(names, ", ")
+					}
+					return material.H6(th, str).Layout(gtx)
+				}),
+			)
+		},
+
+		func(gtx layout.Context) layout.Dimensions {
+			if detectingCaps {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, detectCapsBtn, "Detect Server Capabilities").Layout(gtx)
+		},
+		textField(th, "Device ID (copy from the old install to reuse its backups)", "Device ID", deviceIDEditor),
+		textField(th, "Device name (host and tag of restic snapshots)", "Device name", deviceNameEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			return material.Body2(th, "Device key: "+devicePublicKey).Layout(gtx)
+		},
+		textField(th, "Enrollment code (from the server admin)", "Code", enrollCodeEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			if enrollRunning || strings.TrimSpace(enrollCodeEditor.Text()) == "" {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, enrollBtn, "Enroll Device").Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			str := enrollSummary
+			if enrollRunning {
+				str = "enrolling..."
+			}
+			if str == "" {
+				return layout.Dimensions{}
+			}
+			return material.H6(th, str).Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if importRunning || serverCaps == nil || !serverCaps.Has(upload.FeatureInventory) {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, importBtn, "Import Server Inventory").Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			str := importSummary
+			if importRunning {
+				str = "importing..."
+			}
+			if str == "" {
+				return layout.Dimensions{}
+			}
+			return material.H6(th, str).Layout(gtx)
+		},
+		material.H5(th, "Free Up Space").Layout,
+		textField(th, "Remove backed up files older than (days)", "30", cleanupDaysEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			str := "nothing to free"
+			if cleanupPreview != nil && cleanupPreview.Files > 0 {
+				str = fmt.Sprintf("%d files, up to %s reclaimable", cleanupPreview.Files, humanize.Bytes(uint64(cleanupPreview.Bytes)))
+			}
+			return material.H6(th, str).Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if cleanupRunning || cleanupPreview == nil || cleanupPreview.Files == 0 {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, freeSpaceBtn, "Verify and Move to Trash").Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			str := "trash is empty"
+			if trashSummary != nil && trashSummary.Files > 0 {
+				str = fmt.Sprintf("trash: %d files, %s (deleted after %d days)", trashSummary.Files, humanize.Bytes(uint64(trashSummary.Bytes)), int(upload.TrashRetention.Hours()/24))
+			}
+			return material.H6(th, str).Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if cleanupRunning || trashSummary == nil || trashSummary.Files == 0 {
+				gtx = gtx.Disabled()
+			}
+			return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+				layout.Flexed(0.48, material.Button(th, restoreTrashBtn, "Restore Trash").Layout),
+				layout.Flexed(0.48, material.Button(th, emptyTrashBtn, "Empty Trash Now").Layout),
+			)
+		},
 		material.Button(th, resetFailedBtn, "Reset Failed Uploads").Layout,
 		material.Button(th, resetBtn, "Reset Full DB State").Layout,
 	}
@@ -525,15 +1610,304 @@ func drawSettings(gtx layout.Context, th *material.Theme) layout.Dimensions {
 	})
 }
 
-func (ui *UI) drawFiles(gtx layout.Context, th *material.Theme) layout.Dimensions {
-	return filesList.Layout(gtx, len(files), func(gtx layout.Context, i int) layout.Dimensions {
-		file := files[i]
+// loadTransforms lists the enabled transforms in chain order followed
+// by the disabled ones.
+func loadTransforms(store *db.DB) {
+	chain, err := upload.TransformChain(store)
+	if err != nil {
+		plog.Printf("get transform chain err: %s", err)
+	}
 
-		border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
+	enabled := make(map[upload.Transform]bool)
+	transformRows = transformRows[:0]
+	for _, name := range chain {
+		enabled[name] = true
+		transformRows = append(transformRows, name)
+	}
+	for _, name := range upload.Transforms() {
+		if !enabled[name] {
+			transformRows = append(transformRows, name)
+		}
+	}
 
-		borderA := widget.Border{Color: color.NRGBA{A: 0xff, R: 0xFF}, Width: unit.Dp(0)}
-		borderB := widget.Border{Color: color.NRGBA{A: 0xff, G: 0xFF}, Width: unit.Dp(0)}
-		borderC := widget.Border{Color: color.NRGBA{A: 0xff, B: 0xFF}, Width: unit.Dp(0)}
+	transformToggles = make([]widget.Bool, len(transformRows))
+	transformUpBtns = make([]widget.Clickable, len(transformRows))
+	for i, name := range transformRows {
+		transformToggles[i].Value = enabled[name]
+	}
+}
+
+func drawTransforms(th *material.Theme) layout.Widget {
+	return func(gtx layout.Context) layout.Dimensions {
+		children := make([]layout.FlexChild, 0, len(transformRows))
+		for i, name := range transformRows {
+			i, name := i, name
+			children = append(children, layout.Rigid(func(gtx C) D {
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					layout.Flexed(0.15, func(gtx C) D {
+						return material.CheckBox(th, &transformToggles[i], "").Layout(gtx)
+					}),
+					layout.Flexed(0.6, material.Body1(th, fmt.Sprintf("%d. %s", i+1, name)).Layout),
+					layout.Flexed(0.25, func(gtx C) D {
+						if i == 0 || !transformToggles[i].Value {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(th, &transformUpBtns[i], "Up").Layout(gtx)
+					}),
+				)
+			}))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	}
+}
+
+// loadDestinations lists every destination other than the primary
+// server, which is configured by the fields at the top of Settings.
+func loadDestinations(store *db.DB) {
+	var err error
+	destinations, err = store.Destinations()
+	if err != nil {
+		plog.Printf("get destinations err: %s", err)
+	}
+
+	destRows = destRows[:0]
+	for _, d := range destinations {
+		if d.ID != db.PrimaryDestinationID {
+			destRows = append(destRows, d)
+		}
+	}
+
+	destEnabledToggles = make([]widget.Bool, len(destRows))
+	destRequiredToggles = make([]widget.Bool, len(destRows))
+	destWifiToggles = make([]widget.Bool, len(destRows))
+	destEditBtns = make([]widget.Clickable, len(destRows))
+	destRemoveBtns = make([]widget.Clickable, len(destRows))
+	destSignInBtns = make([]widget.Clickable, len(destRows))
+	destTLSBtns = make([]widget.Clickable, len(destRows))
+	for i, d := range destRows {
+		destEnabledToggles[i].Value = d.Enabled
+		destRequiredToggles[i].Value = d.Required
+		destWifiToggles[i].Value = !d.AllowMobile
+	}
+}
+
+// destFromForm builds the destination described by the add/edit
+// form, keeping the schedule state of the one being edited.
+func destFromForm() (*db.Destination, error) {
+	d := db.Destination{
+		Enabled:  true,
+		Required: true,
+	}
+	for _, existing := range destRows {
+		if existing.ID == destEditID {
+			d = existing
+		}
+	}
+
+	d.Name = strings.TrimSpace(destNameEditor.Text())
+	if d.Name == "" {
+		return nil, errors.New("destination name is required")
+	}
+	d.Backend = strings.TrimSpace(destBackendEditor.Text())
+	if d.Backend == "" {
+		d.Backend = db.BackendHTTP
+	}
+	known := false
+	for _, name := range upload.Backends() {
+		if name == d.Backend {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown backend %q, expected one of %s", d.Backend, strings.Join(upload.Backends(), ", "))
+	}
+	d.URL = strings.TrimSpace(destURLEditor.Text())
+	d.Username = destUsernameEditor.Text()
+	d.Password = destPasswordEditor.Text()
+	hours, _ := strconv.Atoi(destIntervalEditor.Text())
+	d.MinInterval = time.Duration(hours) * time.Hour
+	d.Options = strings.TrimSpace(destOptionsEditor.Text())
+	if _, err := neturl.ParseQuery(d.Options); err != nil {
+		return nil, fmt.Errorf("bad backend options: %w", err)
+	}
+	return &d, nil
+}
+
+func clearDestForm() {
+	destEditID = 0
+	destErr = ""
+	for _, e := range []*widget.Editor{destNameEditor, destBackendEditor, destURLEditor, destUsernameEditor, destPasswordEditor, destIntervalEditor, destOptionsEditor} {
+		e.SetText("")
+	}
+}
+
+func drawDestinations(th *material.Theme) layout.Widget {
+	return func(gtx layout.Context) layout.Dimensions {
+		if len(destRows) == 0 {
+			return material.Body1(th, "only the server above").Layout(gtx)
+		}
+
+		children := make([]layout.FlexChild, 0, len(destRows))
+		for i, d := range destRows {
+			i, d := i, d
+			children = append(children, layout.Rigid(func(gtx C) D {
+				return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+					layout.Rigid(material.H6(th, fmt.Sprintf("%s (%s)", d.Name, d.Backend)).Layout),
+					layout.Rigid(material.Body2(th, redactedURL(d.URL)).Layout),
+					layout.Rigid(func(gtx C) D {
+						return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+							layout.Flexed(0.33, material.CheckBox(th, &destEnabledToggles[i], "Enabled").Layout),
+							layout.Flexed(0.33, material.CheckBox(th, &destRequiredToggles[i], "Required").Layout),
+							layout.Flexed(0.33, material.CheckBox(th, &destWifiToggles[i], "Wifi Only").Layout),
+						)
+					}),
+					layout.Rigid(func(gtx C) D {
+						if !upload.UsesOAuth(d.Options) {
+							return D{}
+						}
+						if signInRunning {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(th, &destSignInBtns[i], "Sign In").Layout(gtx)
+					}),
+					layout.Rigid(func(gtx C) D {
+						if d.Local() {
+							return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+								layout.Flexed(0.48, material.Button(th, &destEditBtns[i], "Edit").Layout),
+								layout.Flexed(0.48, material.Button(th, &destRemoveBtns[i], "Remove").Layout),
+							)
+						}
+						return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+							layout.Flexed(0.32, material.Button(th, &destEditBtns[i], "Edit").Layout),
+							layout.Flexed(0.32, material.Button(th, &destTLSBtns[i], "TLS").Layout),
+							layout.Flexed(0.32, material.Button(th, &destRemoveBtns[i], "Remove").Layout),
+						)
+					}),
+				)
+			}))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	}
+}
+
+// redactedURL hides any password embedded in a destination url.
+func redactedURL(raw string) string {
+	u, err := neturl.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// destinationName returns the name of the destination with id.
+func destinationName(id int64) string {
+	for _, d := range destinations {
+		if d.ID == id {
+			return d.Name
+		}
+	}
+	return fmt.Sprintf("#%d", id)
+}
+
+func drawStripOverrides(th *material.Theme) layout.Widget {
+	return func(gtx layout.Context) layout.Dimensions {
+		if len(stripRemoveBtns) < len(stripOverrideDirs) {
+			stripRemoveBtns = make([]widget.Clickable, len(stripOverrideDirs))
+		}
+
+		children := make([]layout.FlexChild, 0, len(stripOverrideDirs))
+		for i, dir := range stripOverrideDirs {
+			i, dir := i, dir
+			children = append(children, layout.Rigid(func(gtx C) D {
+				str := dir + ": never strip"
+				if stripOverrides[dir] {
+					str = dir + ": always strip"
+				}
+				return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+					layout.Flexed(0.7, material.Body1(th, str).Layout),
+					layout.Flexed(0.3, material.Button(th, &stripRemoveBtns[i], "Remove").Layout),
+				)
+			}))
+		}
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	}
+}
+
+func (ui *UI) drawRemote(gtx layout.Context, th *material.Theme) layout.Dimensions {
+	remoteMux.Lock()
+	page := remotePage
+	fromCache := remoteFromCache
+	loadErr := remoteErr
+	onDevice := make(map[string]bool, len(remoteOnDevice))
+	for id, v := range remoteOnDevice {
+		onDevice[id] = v
+	}
+	downloading := make(map[string]bool, len(remoteDownloading))
+	for id, v := range remoteDownloading {
+		downloading[id] = v
+	}
+	remoteMux.Unlock()
+
+	var objs []upload.InventoryObject
+	if page != nil {
+		objs = page.Objects
+	}
+	if len(remoteBtns) < len(objs) {
+		remoteBtns = make([]widget.Clickable, len(objs))
+	}
+
+	header := func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+					layout.Flexed(0.32, func(gtx C) D {
+						if len(remotePrevCursors) == 0 || remoteLoading {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(th, remotePrevBtn, "Previous").Layout(gtx)
+					}),
+					layout.Flexed(0.32, func(gtx C) D {
+						if remoteLoading {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(th, remoteRefreshBtn, "Refresh").Layout(gtx)
+					}),
+					layout.Flexed(0.32, func(gtx C) D {
+						if page == nil || page.NextCursor == "" || remoteLoading {
+							gtx = gtx.Disabled()
+						}
+						return material.Button(th, remoteNextBtn, "Next").Layout(gtx)
+					}),
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				var lbl material.LabelStyle
+				switch {
+				case remoteLoading:
+					lbl = material.Body1(th, "loading...")
+				case loadErr != "":
+					lbl = material.Body1(th, loadErr)
+					lbl.Color = errColor
+				case fromCache:
+					lbl = material.Body1(th, "offline, showing cached listing")
+				case page != nil && len(objs) == 0:
+					lbl = material.Body1(th, "no files on the server")
+				default:
+					return D{}
+				}
+				return layout.Inset{Top: unit.Dp(8)}.Layout(gtx, lbl.Layout)
+			}),
+		)
+	}
+
+	return remoteList.Layout(gtx, len(objs)+1, func(gtx layout.Context, i int) layout.Dimensions {
+		if i == 0 {
+			return layout.UniformInset(unit.Dp(16)).Layout(gtx, header)
+		}
+		i--
+		obj := objs[i]
+
+		border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
 
 		return border.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 			sz := gtx.Dp(unit.Dp(300))
@@ -541,12 +1915,9 @@ func (ui *UI) drawFiles(gtx layout.Context, th *material.Theme) layout.Dimension
 			return layout.Flex{
 				Axis: layout.Vertical,
 			}.Layout(gtx,
-				layout.Flexed(0.1, func(gtx C) D {
-					return borderB.Layout(gtx, material.H6(th, file.Name).Layout)
-				}),
+				layout.Flexed(0.1, material.H6(th, obj.Name).Layout),
 				layout.Flexed(0.5, func(gtx C) D {
-
-					img, err := ui.db.Thumbnail(file)
+					img, err := ui.db.RemoteThumbnail(obj.ID, upload.ThumbnailFetcher(ui.db, obj))
 					if err != nil {
 						img = image.NewRGBA(image.Rectangle{Max: image.Point{X: 256, Y: 256}})
 					}
@@ -555,32 +1926,235 @@ func (ui *UI) drawFiles(gtx layout.Context, th *material.Theme) layout.Dimension
 						Src: paint.NewImageOp(img),
 						Fit: widget.Contain,
 					}
-					return borderA.Layout(gtx, wimg.Layout)
-				}),
-				layout.Flexed(0.1, func(gtx C) D {
-					return borderC.Layout(gtx, material.H6(th, file.Created.In(time.Local).Format("01/02 15:04")).Layout)
+					return wimg.Layout(gtx)
 				}),
 				layout.Flexed(0.1, func(gtx C) D {
-					return borderC.Layout(gtx, material.H6(th, file.State.String()).Layout)
+					str := fmt.Sprintf("%s, %s", humanize.Bytes(uint64(obj.Bytes)), obj.Mtime.In(time.Local).Format("2006-01-02 15:04"))
+					return material.Body1(th, str).Layout(gtx)
 				}),
-				layout.Flexed(0.1, func(gtx C) D {
-					ts := file.UploadStarted
-					if !file.UploadEnd.IsZero() {
-						ts = file.UploadEnd
+				layout.Flexed(0.15, func(gtx C) D {
+					label := "Download"
+					switch {
+					case downloading[obj.ID]:
+						label = "Downloading..."
+						gtx = gtx.Disabled()
+					case onDevice[obj.ID]:
+						label = "On Device"
+						gtx = gtx.Disabled()
 					}
-					return borderC.Layout(gtx, material.H6(th, ts.In(time.Local).Format("01/02 15:04")).Layout)
+					return material.Button(th, &remoteBtns[i], label).Layout(gtx)
 				}),
 			)
 		})
 	})
 }
 
-func drawDebug(gtx layout.Context, th *material.Theme) layout.Dimensions {
+func drawRestore(gtx layout.Context, th *material.Theme) layout.Dimensions {
+	serverRestoreMux.Lock()
+	progress := serverRestoreProgress
+	restoreErr := serverRestoreErr
+	serverRestoreMux.Unlock()
+
+	widgets := []layout.Widget{
+		material.H5(th, "Restore from Server").Layout,
+		material.Body1(th, "Download this device's backed up files. Files that already exist locally are skipped.").Layout,
+		textField(th, "Destination folder", upload.MediaPath(), serverRestoreDirEditor),
+		textField(th, "From date (blank for everything)", "YYYY-MM-DD", serverRestoreFromEditor),
+		textField(th, "To date (blank for everything)", "YYYY-MM-DD", serverRestoreToEditor),
+		func(gtx layout.Context) layout.Dimensions {
+			if serverRestoreRunning || serverCaps == nil || !serverCaps.Has(upload.FeatureInventory) {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, serverRestoreBtn, "Restore").Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if serverCaps == nil || !serverCaps.Has(upload.FeatureInventory) {
+				return material.H6(th, "server does not support restore").Layout(gtx)
+			}
+			if progress == nil {
+				return layout.Dimensions{}
+			}
+			str := fmt.Sprintf("restored %d of %d files (%s of %s)", progress.Done, progress.Total,
+				humanize.Bytes(uint64(progress.Bytes)), humanize.Bytes(uint64(progress.TotalBytes)))
+			if progress.Skipped > 0 || progress.Failed > 0 {
+				str += fmt.Sprintf(", %d already present, %d failed", progress.Skipped, progress.Failed)
+			}
+			return material.H6(th, str).Layout(gtx)
+		},
+		func(gtx layout.Context) layout.Dimensions {
+			if restoreErr == "" {
+				return layout.Dimensions{}
+			}
+			l := material.Body1(th, restoreErr)
+			l.Color = errColor
+			return l.Layout(gtx)
+		},
+	}
+
+	return restoreList.Layout(gtx, len(widgets), func(gtx layout.Context, i int) layout.Dimensions {
+		return layout.UniformInset(unit.Dp(16)).Layout(gtx, widgets[i])
+	})
+}
+
+// parseRestoreRange turns the restore tab's date fields into an
+// [from, to) range. The to date is inclusive of that whole day.
+func parseRestoreRange(fromStr, toStr string) (from, to time.Time, err error) {
+	const dateLayout = "2006-01-02"
+	if fromStr = strings.TrimSpace(fromStr); fromStr != "" {
+		from, err = time.ParseInLocation(dateLayout, fromStr, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("bad from date %q", fromStr)
+		}
+	}
+	if toStr = strings.TrimSpace(toStr); toStr != "" {
+		to, err = time.ParseInLocation(dateLayout, toStr, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("bad to date %q", toStr)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+func (ui *UI) drawFiles(gtx layout.Context, th *material.Theme) layout.Dimensions {
+	if selectedFile != nil {
+		return drawFileHistory(gtx, th, *selectedFile)
+	}
+
+	if len(fileBtns) < len(files) {
+		fileBtns = make([]widget.Clickable, len(files))
+	}
+
+	return filesList.Layout(gtx, len(files), func(gtx layout.Context, i int) layout.Dimensions {
+		file := files[i]
+		failed, hasErr := fileErrors[file.Name]
+
+		border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
+
+		borderA := widget.Border{Color: color.NRGBA{A: 0xff, R: 0xFF}, Width: unit.Dp(0)}
+		borderB := widget.Border{Color: color.NRGBA{A: 0xff, G: 0xFF}, Width: unit.Dp(0)}
+		borderC := widget.Border{Color: color.NRGBA{A: 0xff, B: 0xFF}, Width: unit.Dp(0)}
+
+		return material.Clickable(gtx, &fileBtns[i], func(gtx C) D {
+			return border.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				sz := gtx.Dp(unit.Dp(300))
+				gtx.Constraints = layout.Exact(gtx.Constraints.Constrain(image.Point{X: sz, Y: sz}))
+				return layout.Flex{
+					Axis: layout.Vertical,
+				}.Layout(gtx,
+					layout.Flexed(0.1, func(gtx C) D {
+						return borderB.Layout(gtx, material.H6(th, file.Name).Layout)
+					}),
+					layout.Flexed(0.5, func(gtx C) D {
+
+						img, err := ui.db.Thumbnail(file)
+						if err != nil {
+							img = image.NewRGBA(image.Rectangle{Max: image.Point{X: 256, Y: 256}})
+						}
+
+						wimg := widget.Image{
+							Src: paint.NewImageOp(img),
+							Fit: widget.Contain,
+						}
+						return borderA.Layout(gtx, wimg.Layout)
+					}),
+					layout.Flexed(0.1, func(gtx C) D {
+						return borderC.Layout(gtx, material.H6(th, file.Created.In(time.Local).Format("01/02 15:04")).Layout)
+					}),
+					layout.Flexed(0.1, func(gtx C) D {
+						lbl := material.H6(th, file.State.String())
+						if file.State == db.UploadCorrupt {
+							lbl.Color = errColor
+						}
+						return borderC.Layout(gtx, lbl.Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						if len(destinations) < 2 {
+							return D{}
+						}
+						return drawDestinationBadges(gtx, th, file)
+					}),
+					layout.Flexed(0.1, func(gtx C) D {
+						ts := file.UploadStarted
+						if !file.UploadEnd.IsZero() {
+							ts = file.UploadEnd
+						}
+						return borderC.Layout(gtx, material.H6(th, ts.In(time.Local).Format("01/02 15:04")).Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						if !hasErr {
+							return D{}
+						}
+						lbl := material.Body2(th, failedAttemptSummary(failed))
+						lbl.Color = errColor
+						lbl.MaxLines = 2
+						return lbl.Layout(gtx)
+					}),
+				)
+			})
+		})
+	})
+}
+
+// drawDestinationBadges shows the file's state at each enabled
+// destination. Required destinations are marked with a *.
+func drawDestinationBadges(gtx layout.Context, th *material.Theme, file db.File) layout.Dimensions {
+	okColor := color.NRGBA{G: 0x80, A: 0xff}
+
+	var children []layout.FlexChild
+	for _, d := range destinations {
+		if !d.Enabled {
+			continue
+		}
+		state := db.UploadPending
+		for _, fd := range fileDests[file.Name] {
+			if fd.DestinationID == d.ID {
+				state = fd.State
+			}
+		}
+		name := d.Name
+		if d.Required {
+			name += "*"
+		}
+		lbl := material.Body2(th, fmt.Sprintf("%s: %s", name, badgeText(state)))
+		switch state {
+		case db.UploadSuccess, db.UploadSkipped:
+			lbl.Color = okColor
+		case db.UploadFailed, db.UploadRejected:
+			lbl.Color = errColor
+		}
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return layout.Inset{Right: unit.Dp(8)}.Layout(gtx, lbl.Layout)
+		}))
+	}
+	return layout.Flex{}.Layout(gtx, children...)
+}
+
+func badgeText(state db.UploadState) string {
+	switch state {
+	case db.UploadSuccess, db.UploadSkipped:
+		return "ok"
+	case db.UploadInProgress:
+		return "sending"
+	case db.UploadFailed:
+		return "failed"
+	case db.UploadRejected:
+		return "rejected"
+	case db.UploadPreviewed:
+		return "preview"
+	default:
+		return "pending"
+	}
+}
+
+func (ui *UI) drawDebug(gtx layout.Context, th *material.Theme) layout.Dimensions {
 	border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(2)}
 
 	widgets := []layout.Widget{
 		material.H5(th, "Version:").Layout,
 		material.H6(th, version.Version).Layout,
+		material.H5(th, "DB Schema Version:").Layout,
+		material.H6(th, strconv.Itoa(db.SchemaVersion())).Layout,
 		material.H5(th, "Event Log").Layout,
 		func(gtx C) D {
 			return border.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
@@ -591,7 +2165,310 @@ func drawDebug(gtx layout.Context, th *material.Theme) layout.Dimensions {
 		},
 	}
 
+	widgets = append(widgets, drawAudits(th)...)
+
+	if selectedRun != nil {
+		widgets = append(widgets, drawRunFiles(th, *selectedRun)...)
+	} else {
+		widgets = append(widgets, drawRuns(th)...)
+	}
+
 	return debugList.Layout(gtx, len(widgets), func(gtx layout.Context, i int) layout.Dimensions {
 		return layout.UniformInset(unit.Dp(16)).Layout(gtx, widgets[i])
 	})
 }
+
+func drawRuns(th *material.Theme) []layout.Widget {
+	if len(runBtns) < len(runs) {
+		runBtns = make([]widget.Clickable, len(runs))
+	}
+
+	widgets := []layout.Widget{
+		material.H5(th, "Upload Runs").Layout,
+	}
+
+	if len(runs) == 0 {
+		widgets = append(widgets, material.Body1(th, "no runs yet").Layout)
+	}
+
+	for i, run := range runs {
+		btn := &runBtns[i]
+		widgets = append(widgets, func(gtx C) D {
+			return material.Clickable(gtx, btn, func(gtx C) D {
+				return drawRunSummary(gtx, th, run)
+			})
+		})
+	}
+
+	return widgets
+}
+
+func drawRunSummary(gtx layout.Context, th *material.Theme, run db.Run) layout.Dimensions {
+	border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(1)}
+
+	result := "ok"
+	if run.Err != "" {
+		result = run.Err
+	} else if run.Ended.IsZero() {
+		result = "running"
+	}
+
+	var dur string
+	if !run.Ended.IsZero() {
+		dur = run.Ended.Sub(run.Started).Round(time.Second).String()
+	}
+
+	return border.Layout(gtx, func(gtx C) D {
+		return layout.UniformInset(unit.Dp(8)).Layout(gtx, func(gtx C) D {
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.H6(th, fmt.Sprintf("#%d %s %s", run.ID, run.Started.In(time.Local).Format("01/02 15:04:05"), run.Trigger)).Layout),
+				layout.Rigid(material.Body1(th, fmt.Sprintf("result: %s  network: %s  duration: %s", result, run.NetState, dur)).Layout),
+				layout.Rigid(material.Body1(th, fmt.Sprintf("attempted: %d  ok: %d  skipped: %d  failed: %d  sent: %s",
+					run.Attempted, run.Succeeded, run.Skipped, run.Failed, humanize.Bytes(uint64(run.BytesSent)))).Layout),
+			)
+		})
+	})
+}
+
+func drawRunFiles(th *material.Theme, run db.Run) []layout.Widget {
+	widgets := []layout.Widget{
+		material.Button(th, runBackBtn, "Back to Runs").Layout,
+		func(gtx C) D {
+			return drawRunSummary(gtx, th, run)
+		},
+	}
+
+	if len(runFiles) == 0 {
+		widgets = append(widgets, material.Body1(th, "no files handled in this run").Layout)
+	}
+
+	for _, f := range runFiles {
+		f := f
+		widgets = append(widgets, func(gtx C) D {
+			return layout.Flex{Alignment: layout.Middle}.Layout(gtx,
+				layout.Flexed(0.6, material.Body1(th, f.Name).Layout),
+				layout.Flexed(0.25, material.Body1(th, f.State.String()).Layout),
+				layout.Flexed(0.15, material.Body1(th, humanize.Bytes(uint64(f.Bytes))).Layout),
+			)
+		})
+	}
+
+	return widgets
+}
+
+func failedAttemptSummary(a db.Attempt) string {
+	msg := a.Err
+	if a.ServerError != "" {
+		msg = a.ServerError
+	}
+	return fmt.Sprintf("%s failed: %s", a.Phase, msg)
+}
+
+func drawFileHistory(gtx layout.Context, th *material.Theme, file db.File) layout.Dimensions {
+	widgets := []layout.Widget{
+		material.Button(th, fileBackBtn, "Back to Files").Layout,
+		material.H5(th, file.Name).Layout,
+		material.Body1(th, fmt.Sprintf("state: %s  size: %s", file.State, humanize.Bytes(uint64(file.Size)))).Layout,
+	}
+
+	if file.State == db.UploadCorrupt {
+		widgets = append(widgets,
+			func(gtx C) D {
+				lbl := material.Body1(th, "This file changed on the device without its modification time changing, which usually means storage corruption. It will not be uploaded.")
+				lbl.Color = errColor
+				return lbl.Layout(gtx)
+			},
+			func(gtx C) D {
+				if restoreRunning {
+					gtx = gtx.Disabled()
+				}
+				return material.Button(th, restoreBtn, "Restore from Server").Layout(gtx)
+			},
+		)
+	}
+
+	if len(fileAttempts) == 0 {
+		widgets = append(widgets, material.Body1(th, "no upload attempts recorded").Layout)
+	}
+
+	for _, a := range fileAttempts {
+		a := a
+		widgets = append(widgets, func(gtx C) D {
+			border := widget.Border{Color: color.NRGBA{A: 0xff}, CornerRadius: unit.Dp(8), Width: unit.Dp(1)}
+			return border.Layout(gtx, func(gtx C) D {
+				return layout.UniformInset(unit.Dp(8)).Layout(gtx, func(gtx C) D {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(material.H6(th, fmt.Sprintf("%s  run #%d  %s", a.Started.In(time.Local).Format("01/02 15:04:05"), a.RunID, destinationName(a.DestinationID))).Layout),
+						layout.Rigid(material.Body1(th, fmt.Sprintf("phase: %s  http: %d  sent: %s  took: %s",
+							a.Phase, a.HTTPStatus, humanize.Bytes(uint64(a.BytesSent)), a.Duration().Round(time.Millisecond))).Layout),
+						layout.Rigid(func(gtx C) D {
+							if a.ServerError == "" {
+								return D{}
+							}
+							return material.Body1(th, "server: "+a.ServerError).Layout(gtx)
+						}),
+						layout.Rigid(func(gtx C) D {
+							if a.Err == "" {
+								return material.Body1(th, "ok").Layout(gtx)
+							}
+							lbl := material.Body1(th, "error: "+a.Err)
+							lbl.Color = errColor
+							return lbl.Layout(gtx)
+						}),
+					)
+				})
+			})
+		})
+	}
+
+	return fileHistoryList.Layout(gtx, len(widgets), func(gtx layout.Context, i int) layout.Dimensions {
+		return layout.UniformInset(unit.Dp(16)).Layout(gtx, widgets[i])
+	})
+}
+
+// loadTLSSettings shows the TLS settings of destination destID in the
+// TLS section of Settings.
+func loadTLSSettings(store *db.DB, destID int64, name string) {
+	tlsDestID = destID
+	tlsDestName = name
+	tlsCandidate = nil
+	tlsStatus = ""
+
+	dest, err := store.Destination(destID)
+	if err != nil {
+		plog.Printf("get %s tls settings err: %s", name, err)
+		return
+	}
+	tlsCAEditor.SetText(dest.TLS.CA)
+	tlsCertEditor.SetText(dest.TLS.ClientCert)
+	tlsKeyEditor.SetText(dest.TLS.ClientKey)
+	tlsPin = dest.TLS.Pin
+}
+
+// drawTrustPrompt asks whether to pin the key of an untrusted server
+// certificate, showing its fingerprint to compare with the server's.
+func drawTrustPrompt(th *material.Theme) layout.Widget {
+	return func(gtx C) D {
+		cert := tlsCandidate
+		if cert == nil {
+			return D{}
+		}
+		txt := fmt.Sprintf("Subject: %s\nIssuer: %s\nExpires: %s\nKey: %s\n\nOnly trust this key if it matches the fingerprint of your server's key.",
+			cert.Subject, cert.Issuer, cert.NotAfter.Format("2006-01-02"), cert.Fingerprint)
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(material.Body1(th, txt).Layout),
+			layout.Rigid(func(gtx C) D {
+				return layout.Flex{Spacing: layout.SpaceBetween}.Layout(gtx,
+					layout.Flexed(0.48, material.Button(th, tlsTrustBtn, "Trust This Key").Layout),
+					layout.Flexed(0.48, material.Button(th, tlsRejectBtn, "Don't Trust").Layout),
+				)
+			}),
+		)
+	}
+}
+
+func setSignInStatus(status string) {
+	signInMux.Lock()
+	signInStatus = status
+	signInMux.Unlock()
+}
+
+// drawSignIn shows the progress of an OAuth sign in, including the
+// code to enter on another device.
+func drawSignIn(th *material.Theme) layout.Widget {
+	return func(gtx C) D {
+		signInMux.Lock()
+		status := signInStatus
+		signInMux.Unlock()
+
+		if status == "" {
+			return D{}
+		}
+		return material.Body1(th, status).Layout(gtx)
+	}
+}
+
+func drawConnTest(th *material.Theme) layout.Widget {
+	return func(gtx C) D {
+		connTestMux.Lock()
+		steps := connTestSteps
+		connTestMux.Unlock()
+
+		if len(steps) == 0 {
+			return D{}
+		}
+
+		children := make([]layout.FlexChild, 0, len(steps))
+		for _, step := range steps {
+			step := step
+			children = append(children, layout.Rigid(func(gtx C) D {
+				var mark string
+				switch step.Status {
+				case upload.CheckPending:
+					mark = "[ ]"
+				case upload.CheckOK:
+					mark = "[ok]"
+				case upload.CheckFailed:
+					mark = "[x]"
+				case upload.CheckSkipped:
+					mark = "[-]"
+				}
+				txt := fmt.Sprintf("%s %s", mark, step.Name)
+				if step.Detail != "" {
+					txt += ": " + step.Detail
+				}
+				lbl := material.Body1(th, txt)
+				if step.Status == upload.CheckFailed {
+					lbl.Color = errColor
+				}
+				return lbl.Layout(gtx)
+			}))
+		}
+
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	}
+}
+
+func drawAudits(th *material.Theme) []layout.Widget {
+	widgets := []layout.Widget{
+		material.H5(th, "Server Audit").Layout,
+		func(gtx C) D {
+			if auditRunning {
+				gtx = gtx.Disabled()
+			}
+			return material.Button(th, auditBtn, "Run Audit Now").Layout(gtx)
+		},
+	}
+
+	if len(audits) == 0 {
+		widgets = append(widgets, material.Body1(th, "no audits yet").Layout)
+	}
+
+	for _, a := range audits {
+		a := a
+		widgets = append(widgets, func(gtx C) D {
+			result := "ok"
+			if a.Err != "" {
+				result = a.Err
+			} else if a.Ended.IsZero() {
+				result = "running"
+			}
+			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+				layout.Rigid(material.H6(th, fmt.Sprintf("#%d %s: %s", a.ID, a.Started.In(time.Local).Format("01/02 15:04"), result)).Layout),
+				layout.Rigid(material.Body1(th, fmt.Sprintf("checked: %d (%s)  ok: %d  missing: %d  mismatched: %d",
+					a.Checked, humanize.Bytes(uint64(a.BytesChecked)), a.OK, a.Missing, a.Mismatched)).Layout),
+			)
+		})
+	}
+
+	for _, f := range auditProblems {
+		f := f
+		widgets = append(widgets, func(gtx C) D {
+			lbl := material.Body1(th, fmt.Sprintf("%s: %s (requeued)", f.Name, f.Problem))
+			lbl.Color = errColor
+			return lbl.Layout(gtx)
+		})
+	}
+
+	return widgets
+}
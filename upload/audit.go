@@ -0,0 +1,266 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/jgo/wifi"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+var (
+	// auditInterval is the minimum time between background audits.
+	auditInterval = 7 * 24 * time.Hour
+
+	// auditMaxFiles and auditMaxBytes bound a single audit pass so it
+	// doesn't make the server re-read the whole library at once.
+	auditMaxFiles       = 500
+	auditMaxBytes int64 = 4 << 30
+
+	// auditBatchSize is the number of ids sent per batch request.
+	auditBatchSize = 100
+
+	auditPath   = "audit"
+	objectsPath = "objects"
+)
+
+type AuditRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type AuditResponse struct {
+	Objects []AuditObject `json:"objects"`
+}
+
+type AuditObject struct {
+	ID     string `json:"id"`
+	Exists bool   `json:"exists"`
+	Bytes  int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// maybeAudit runs an audit at the end of an upload run when one is
+// due and we're on wifi.
+func (u *uploader) maybeAudit() {
+	caps, _ := CachedCapabilities(u.store)
+	if !caps.Has(FeatureAudit) {
+		return
+	}
+
+	last, err := u.store.LastAuditTime()
+	if err != nil || time.Since(last) < auditInterval {
+		return
+	}
+
+	connState, err := wifi.ConnectionState()
+	if err != nil || connState != wifi.Wifi {
+		return
+	}
+
+	_, err = Audit(u.store)
+	if err != nil {
+		plog.Printf("audit err: %s", err)
+	}
+}
+
+// Audit asks the server whether files recorded as uploaded still exist
+// with the expected size and hash. Files that are missing or differ are
+// put back to pending so the next upload run sends them again. Only
+// the primary destination speaks the audit protocol, so only its
+// copies are checked.
+func Audit(store *db.DB) (*db.Audit, error) {
+	caps, _ := CachedCapabilities(store)
+	if !caps.Has(FeatureAudit) {
+		return nil, errors.New("server does not support audit")
+	}
+
+	audit, err := store.StartAudit()
+	if err != nil {
+		return nil, err
+	}
+	plog.Printf("audit %d start", audit.ID)
+
+	err = runAudit(store, caps, audit)
+	if err != nil {
+		audit.Err = err.Error()
+	}
+
+	endErr := store.EndAudit(audit)
+	if endErr != nil {
+		plog.Printf("end audit err: %s", endErr)
+	}
+
+	plog.Printf("audit %d end checked=%d ok=%d missing=%d mismatched=%d", audit.ID, audit.Checked, audit.OK, audit.Missing, audit.Mismatched)
+
+	return audit, err
+}
+
+func runAudit(store *db.DB, caps *Capabilities, audit *db.Audit) error {
+	candidates, err := store.FilesToAudit(db.PrimaryDestinationID, auditMaxFiles)
+	if err != nil {
+		return err
+	}
+
+	var files []db.File
+	var budget int64
+	for _, f := range candidates {
+		if budget+f.Size > auditMaxBytes && len(files) > 0 {
+			break
+		}
+		budget += f.Size
+		files = append(files, f)
+	}
+
+	check := func(f db.File, obj AuditObject) {
+		audit.Checked++
+		audit.BytesChecked += f.Size
+
+		var problem string
+		if !obj.Exists {
+			problem = "missing"
+			audit.Missing++
+		} else if obj.Bytes != f.ObjectSize() {
+			problem = fmt.Sprintf("size %d, expected %d", obj.Bytes, f.ObjectSize())
+			audit.Mismatched++
+		} else if obj.SHA256 != "" && !strings.EqualFold(obj.SHA256, f.ObjectID()) {
+			problem = fmt.Sprintf("sha256 %s, expected %s", obj.SHA256, f.ObjectID())
+			audit.Mismatched++
+		} else {
+			audit.OK++
+		}
+
+		if problem != "" {
+			plog.Printf("audit %s: %s, requeue", f.Name, problem)
+			store.AddAuditFile(audit.ID, f.Name, problem)
+			store.RequeueFile(f.Name, db.PrimaryDestinationID)
+		}
+		store.MarkAudited(f.Name, time.Now())
+	}
+
+	if caps.Has(FeatureBatch) {
+		for start := 0; start < len(files); start += auditBatchSize {
+			end := start + auditBatchSize
+			if end > len(files) {
+				end = len(files)
+			}
+			batch := files[start:end]
+
+			objs, err := auditBatch(store, batch)
+			if err != nil {
+				return err
+			}
+			for _, f := range batch {
+				obj, ok := objs[f.ObjectID()]
+				if !ok {
+					obj = AuditObject{ID: f.ObjectID()}
+				}
+				check(f, obj)
+			}
+		}
+		return nil
+	}
+
+	for _, f := range files {
+		obj, err := auditHead(store, f.ObjectID())
+		if err != nil {
+			return err
+		}
+		check(f, *obj)
+	}
+	return nil
+}
+
+func auditBatch(store *db.DB, files []db.File) (map[string]AuditObject, error) {
+	serverURL, err := store.URL()
+	if err != nil {
+		return nil, err
+	}
+	auditURL, err := url.JoinPath(serverURL, auditPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var areq AuditRequest
+	for _, f := range files {
+		areq.IDs = append(areq.IDs, f.ObjectID())
+	}
+	body, err := json.Marshal(areq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", auditURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("content-type", "application/json")
+	resp, err := doRequest(store, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, newStatusError(resp)
+	}
+
+	var aresp AuditResponse
+	err = json.NewDecoder(resp.Body).Decode(&aresp)
+	if err != nil {
+		return nil, fmt.Errorf("bad json response: %w", err)
+	}
+
+	objs := make(map[string]AuditObject)
+	for _, obj := range aresp.Objects {
+		objs[obj.ID] = obj
+	}
+	return objs, nil
+}
+
+// auditHead checks a single object with HEAD <url>/objects/<id>. The
+// server reports the stored size in Content-Length and may send the
+// stored hash in x-content-sha256.
+func auditHead(store *db.DB, id string) (*AuditObject, error) {
+	serverURL, err := store.URL()
+	if err != nil {
+		return nil, err
+	}
+	objURL, err := url.JoinPath(serverURL, objectsPath, id)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("HEAD", objURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(store, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	obj := AuditObject{
+		ID: id,
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		obj.Exists = true
+		obj.Bytes, _ = strconv.ParseInt(resp.Header.Get("content-length"), 10, 64)
+		obj.SHA256 = resp.Header.Get("x-content-sha256")
+	case http.StatusNotFound, http.StatusGone:
+	default:
+		return nil, newStatusError(resp)
+	}
+
+	return &obj, nil
+}
@@ -0,0 +1,486 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// A destination's auth option picks how its requests are
+// authenticated:
+//
+//	auth=basic   username and password (default)
+//	auth=bearer  the password is sent as a bearer token
+//	auth=device  no credentials, the server relies on the request
+//	             signature from the enrolled device key
+//	auth=oauth   tokens from an OAuth 2.0 device authorization sign
+//	             in. oauth_issuer points at the server's discovery
+//	             document, or oauth_device_url and oauth_token_url
+//	             name the endpoints. oauth_client_id is required and
+//	             oauth_scope optional.
+var (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthDevice = "device"
+	AuthOAuth  = "oauth"
+)
+
+// slowDownStep is added to the poll interval each time the token
+// endpoint answers slow_down.
+var slowDownStep = 5 * time.Second
+
+// ErrSignInRequired is returned for an OAuth destination without a
+// usable token. Uploads to it wait until the user signs in again.
+var ErrSignInRequired = errors.New("not signed in, use Sign In in settings")
+
+type authConfig struct {
+	mode      string
+	issuer    string
+	deviceURL string
+	tokenURL  string
+	clientID  string
+	scope     string
+}
+
+func isAuthOption(key string) bool {
+	switch key {
+	case "auth", "oauth_issuer", "oauth_device_url", "oauth_token_url", "oauth_client_id", "oauth_scope":
+		return true
+	}
+	return false
+}
+
+func parseAuth(options string) (*authConfig, error) {
+	opts, err := url.ParseQuery(options)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &authConfig{
+		mode:      opts.Get("auth"),
+		issuer:    opts.Get("oauth_issuer"),
+		deviceURL: opts.Get("oauth_device_url"),
+		tokenURL:  opts.Get("oauth_token_url"),
+		clientID:  opts.Get("oauth_client_id"),
+		scope:     opts.Get("oauth_scope"),
+	}
+	switch cfg.mode {
+	case "":
+		cfg.mode = AuthBasic
+	case AuthBasic, AuthBearer, AuthDevice:
+	case AuthOAuth:
+		if cfg.clientID == "" {
+			return nil, errors.New("auth=oauth needs oauth_client_id")
+		}
+		if cfg.issuer == "" && (cfg.deviceURL == "" || cfg.tokenURL == "") {
+			return nil, errors.New("auth=oauth needs oauth_issuer, or oauth_device_url and oauth_token_url")
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth %q", cfg.mode)
+	}
+	return cfg, nil
+}
+
+// UsesOAuth reports whether a destination with options signs in with
+// OAuth.
+func UsesOAuth(options string) bool {
+	cfg, err := parseAuth(options)
+	return err == nil && cfg.mode == AuthOAuth
+}
+
+// authorize adds server's credentials to req, refreshing an OAuth
+// access token that is about to expire.
+func authorize(store *db.DB, server *db.Destination, req *http.Request) error {
+	cfg, err := parseAuth(server.Options)
+	if err != nil {
+		return fmt.Errorf("destination %s: %w", server.Name, err)
+	}
+
+	switch cfg.mode {
+	case AuthBearer:
+		req.Header.Set("authorization", "Bearer "+server.Password)
+	case AuthOAuth:
+		if server.AccessToken == "" {
+			return &UnavailableError{Err: ErrSignInRequired}
+		}
+		expiring := !server.TokenExpiry.IsZero() && time.Now().Add(time.Minute).After(server.TokenExpiry)
+		if expiring && server.RefreshToken != "" {
+			err := renewAccessToken(store, server, cfg)
+			if err != nil {
+				return err
+			}
+		}
+		req.Header.Set("authorization", "Bearer "+server.AccessToken)
+	case AuthDevice:
+	default:
+		if server.Username != "" || server.Password != "" {
+			req.SetBasicAuth(server.Username, server.Password)
+		}
+	}
+	return nil
+}
+
+// doRequest sends req to the primary server with its credentials.
+func doRequest(store *db.DB, req *http.Request) (*http.Response, error) {
+	server, err := store.Destination(db.PrimaryDestinationID)
+	if err != nil {
+		return nil, err
+	}
+	return doServerRequest(store, server, req)
+}
+
+// doServerRequest prepares and sends req to server. If the server
+// rejects an OAuth access token, the token is refreshed and the
+// request signed and sent once more.
+func doServerRequest(store *db.DB, server *db.Destination, req *http.Request) (*http.Response, error) {
+	err := prepareServerRequest(store, server, req)
+	if err != nil {
+		return nil, err
+	}
+	client, err := httpClient(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var rebuild func() (*http.Request, error)
+	if req.Body == nil || req.GetBody != nil {
+		rebuild = func() (*http.Request, error) {
+			retry := req.Clone(req.Context())
+			if req.GetBody != nil {
+				retry.Body, err = req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+			}
+			retry.Header.Set("authorization", "Bearer "+server.AccessToken)
+			return retry, signRequest(store, retry)
+		}
+	}
+	return sendWithRefresh(store, server, client, req, rebuild)
+}
+
+// sendWithRefresh sends req with client. If server rejects its OAuth
+// access token, the token is refreshed and the request that rebuild
+// makes with the new token is sent once more. A nil rebuild means
+// the request can't be sent again.
+func sendWithRefresh(store *db.DB, server *db.Destination, client *http.Client, req *http.Request, rebuild func() (*http.Request, error)) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || rebuild == nil {
+		return resp, err
+	}
+	cfg, cfgErr := parseAuth(server.Options)
+	if cfgErr != nil || cfg.mode != AuthOAuth {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	plog.Printf("destination %s rejected access token, refreshing", server.Name)
+	err = renewAccessToken(store, server, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := rebuild()
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(retry)
+}
+
+// renewAccessToken gets server a new access token. Another request
+// may have refreshed it already, in which case that token is used.
+func renewAccessToken(store *db.DB, server *db.Destination, cfg *authConfig) error {
+	current, err := store.Destination(server.ID)
+	if err != nil {
+		return err
+	}
+	if current.AccessToken != "" && current.AccessToken != server.AccessToken {
+		server.AccessToken = current.AccessToken
+		server.RefreshToken = current.RefreshToken
+		server.TokenExpiry = current.TokenExpiry
+		return nil
+	}
+	if current.RefreshToken == "" {
+		return &UnavailableError{Err: ErrSignInRequired}
+	}
+
+	client, err := httpClient(server)
+	if err != nil {
+		return err
+	}
+	_, tokenURL, err := oauthEndpoints(client, cfg)
+	if err != nil {
+		return err
+	}
+	tok, err := postTokenRequest(client, tokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {current.RefreshToken},
+		"client_id":     {cfg.clientID},
+	})
+	if err != nil {
+		return err
+	}
+	if tok.Error == "invalid_grant" {
+		// the refresh token was revoked or has expired
+		err = store.SetDestinationTokens(server.ID, "", "", time.Time{})
+		if err != nil {
+			return err
+		}
+		server.AccessToken = ""
+		server.RefreshToken = ""
+		return &UnavailableError{Err: ErrSignInRequired}
+	}
+	if tok.Error != "" {
+		return tok.err()
+	}
+
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = current.RefreshToken
+	}
+	return saveTokens(store, server, tok)
+}
+
+func saveTokens(store *db.DB, server *db.Destination, tok *tokenResponse) error {
+	var expiry time.Time
+	if tok.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	err := store.SetDestinationTokens(server.ID, tok.AccessToken, tok.RefreshToken, expiry)
+	if err != nil {
+		return err
+	}
+	server.AccessToken = tok.AccessToken
+	server.RefreshToken = tok.RefreshToken
+	server.TokenExpiry = expiry
+	return nil
+}
+
+// oauthEndpoints returns the device authorization and token urls,
+// looking them up in the issuer's metadata if they weren't given.
+func oauthEndpoints(client *http.Client, cfg *authConfig) (string, string, error) {
+	if cfg.deviceURL != "" && cfg.tokenURL != "" {
+		return cfg.deviceURL, cfg.tokenURL, nil
+	}
+
+	issuer := strings.TrimSuffix(cfg.issuer, "/")
+	for _, wellKnown := range []string{"/.well-known/openid-configuration", "/.well-known/oauth-authorization-server"} {
+		resp, err := client.Get(issuer + wellKnown)
+		if err != nil {
+			return "", "", err
+		}
+		var meta struct {
+			DeviceEndpoint string `json:"device_authorization_endpoint"`
+			TokenEndpoint  string `json:"token_endpoint"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&meta)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", "", fmt.Errorf("oauth discovery: %s", resp.Status)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("oauth discovery: bad json response: %w", err)
+		}
+
+		deviceURL, tokenURL := cfg.deviceURL, cfg.tokenURL
+		if deviceURL == "" {
+			deviceURL = meta.DeviceEndpoint
+		}
+		if tokenURL == "" {
+			tokenURL = meta.TokenEndpoint
+		}
+		if deviceURL == "" || tokenURL == "" {
+			return "", "", errors.New("oauth server doesn't support device authorization")
+		}
+		return deviceURL, tokenURL, nil
+	}
+	return "", "", fmt.Errorf("no oauth metadata found at %s", issuer)
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (t *tokenResponse) err() error {
+	if t.ErrorDescription != "" {
+		return fmt.Errorf("oauth error %s: %s", t.Error, t.ErrorDescription)
+	}
+	return fmt.Errorf("oauth error %s", t.Error)
+}
+
+// postTokenRequest posts form to the token endpoint. OAuth errors are
+// returned in the response's Error field rather than as err.
+func postTokenRequest(client *http.Client, tokenURL string, form url.Values) (*tokenResponse, error) {
+	resp, err := client.PostForm(tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok tokenResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &tok)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("token request: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("token request: bad json response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && tok.Error == "" {
+		return nil, fmt.Errorf("token request: %s", resp.Status)
+	}
+	if tok.Error == "" && tok.AccessToken == "" {
+		return nil, errors.New("token request: no access token in response")
+	}
+	return &tok, nil
+}
+
+// DeviceAuth is a sign in waiting for the user to enter UserCode at
+// VerificationURI on another device.
+type DeviceAuth struct {
+	UserCode        string
+	VerificationURI string
+	// VerificationURIComplete has the code filled in, when the server
+	// provides one.
+	VerificationURIComplete string
+	Expires                 time.Time
+
+	destID     int64
+	client     *http.Client
+	clientID   string
+	tokenURL   string
+	deviceCode string
+	interval   time.Duration
+}
+
+// StartSignIn begins an OAuth device authorization sign in for a
+// destination.
+func StartSignIn(store *db.DB, destID int64) (*DeviceAuth, error) {
+	dest, err := store.Destination(destID)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseAuth(dest.Options)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.mode != AuthOAuth {
+		return nil, fmt.Errorf("destination %s doesn't use auth=oauth", dest.Name)
+	}
+	client, err := httpClient(dest)
+	if err != nil {
+		return nil, err
+	}
+	deviceURL, tokenURL, err := oauthEndpoints(client, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{"client_id": {cfg.clientID}}
+	if cfg.scope != "" {
+		form.Set("scope", cfg.scope)
+	}
+	resp, err := client.PostForm(deviceURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int64  `json:"expires_in"`
+		Interval                int64  `json:"interval"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&auth)
+	if err != nil {
+		return nil, fmt.Errorf("bad json response: %w", err)
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, errors.New("device authorization response is missing fields")
+	}
+	if auth.Interval <= 0 {
+		auth.Interval = 5
+	}
+
+	return &DeviceAuth{
+		UserCode:                auth.UserCode,
+		VerificationURI:         auth.VerificationURI,
+		VerificationURIComplete: auth.VerificationURIComplete,
+		Expires:                 time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second),
+		destID:                  destID,
+		client:                  client,
+		clientID:                cfg.clientID,
+		tokenURL:                tokenURL,
+		deviceCode:              auth.DeviceCode,
+		interval:                time.Duration(auth.Interval) * time.Second,
+	}, nil
+}
+
+// Wait polls the token endpoint until the user approves or denies the
+// sign in, the code expires or ctx is done. The tokens are stored
+// once approved.
+func (a *DeviceAuth) Wait(ctx context.Context, store *db.DB) error {
+	for {
+		if time.Now().After(a.Expires) {
+			return errors.New("sign in code expired")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.interval):
+		}
+
+		tok, err := postTokenRequest(a.client, a.tokenURL, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {a.deviceCode},
+			"client_id":   {a.clientID},
+		})
+		if err != nil {
+			return err
+		}
+		switch tok.Error {
+		case "":
+			dest, err := store.Destination(a.destID)
+			if err != nil {
+				return err
+			}
+			return saveTokens(store, dest, tok)
+		case "authorization_pending":
+		case "slow_down":
+			a.interval += slowDownStep
+		case "access_denied":
+			return errors.New("sign in was denied")
+		case "expired_token":
+			return errors.New("sign in code expired")
+		default:
+			return tok.err()
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+func openTestStore(t *testing.T) *db.DB {
+	t.Helper()
+	store, err := db.OpenPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// fakeOAuth is an OAuth server with device authorization, discovered
+// through /.well-known/openid-configuration, in front of an upload
+// api at /upload that takes its access tokens.
+type fakeOAuth struct {
+	t   *testing.T
+	url string
+
+	// deviceAnswers are the token endpoint's answers to device code
+	// polls, in order. An empty string issues tokens.
+	deviceAnswers []string
+	// refreshError, if set, is the token endpoint's answer to a
+	// refresh.
+	refreshError string
+	// accessToken is what /upload accepts.
+	accessToken string
+	// verify, if set, checks each /upload request.
+	verify func(r *http.Request, body []byte)
+
+	discoveries int
+	polls       int
+	refreshes   int
+	uploads     []fakeOAuthUpload
+}
+
+type fakeOAuthUpload struct {
+	authorization string
+	body          string
+}
+
+func (s *fakeOAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		s.discoveries++
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                        s.url,
+			"device_authorization_endpoint": s.url + "/device",
+			"token_endpoint":                s.url + "/token",
+		})
+
+	case "/device":
+		if r.FormValue("client_id") != "test-client" {
+			s.t.Errorf("device authorization client_id = %q", r.FormValue("client_id"))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code":      "device-code-1",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": s.url + "/activate",
+			"expires_in":       600,
+			"interval":         1,
+		})
+
+	case "/token":
+		switch r.FormValue("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if r.FormValue("device_code") != "device-code-1" {
+				s.t.Errorf("token poll device_code = %q", r.FormValue("device_code"))
+			}
+			answer := ""
+			if s.polls < len(s.deviceAnswers) {
+				answer = s.deviceAnswers[s.polls]
+			}
+			s.polls++
+			if answer != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": answer})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access-1",
+				"refresh_token": "refresh-1",
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+			})
+
+		case "refresh_token":
+			s.refreshes++
+			if s.refreshError != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": s.refreshError})
+				return
+			}
+			if r.FormValue("refresh_token") != "refresh-1" {
+				s.t.Errorf("refresh_token = %q, want refresh-1", r.FormValue("refresh_token"))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access-2",
+				"refresh_token": "refresh-2",
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+			})
+
+		default:
+			s.t.Errorf("unexpected grant_type %q", r.FormValue("grant_type"))
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+	case "/upload":
+		body, _ := io.ReadAll(r.Body)
+		if s.verify != nil {
+			s.verify(r, body)
+		}
+		auth := r.Header.Get("authorization")
+		s.uploads = append(s.uploads, fakeOAuthUpload{authorization: auth, body: string(body)})
+		if auth != "Bearer "+s.accessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newOAuthDestination starts s and adds a destination that signs in
+// with it.
+func newOAuthDestination(t *testing.T, store *db.DB, s *fakeOAuth) *db.Destination {
+	t.Helper()
+	s.t = t
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	s.url = srv.URL
+
+	dest := &db.Destination{
+		Name:    "oauth",
+		URL:     srv.URL + "/upload",
+		Enabled: true,
+		Options: url.Values{
+			"auth":            {AuthOAuth},
+			"oauth_issuer":    {srv.URL},
+			"oauth_client_id": {"test-client"},
+		}.Encode(),
+	}
+	err := store.SaveDestination(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+func TestOAuthDeviceSignIn(t *testing.T) {
+	step := slowDownStep
+	slowDownStep = 10 * time.Millisecond
+	t.Cleanup(func() { slowDownStep = step })
+
+	store := openTestStore(t)
+	s := &fakeOAuth{deviceAnswers: []string{"authorization_pending", "slow_down"}}
+	dest := newOAuthDestination(t, store, s)
+
+	auth, err := StartSignIn(store, dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.discoveries != 1 {
+		t.Errorf("discovery requests = %d, want 1", s.discoveries)
+	}
+	if auth.UserCode != "ABCD-EFGH" || auth.VerificationURI != s.url+"/activate" {
+		t.Errorf("sign in shows code %q at %q", auth.UserCode, auth.VerificationURI)
+	}
+
+	auth.interval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = auth.Wait(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.polls != 3 {
+		t.Errorf("token polls = %d, want 3", s.polls)
+	}
+	if auth.interval != time.Millisecond+slowDownStep {
+		t.Errorf("poll interval = %s, want it raised by slow_down to %s", auth.interval, time.Millisecond+slowDownStep)
+	}
+
+	got, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access-1" || got.RefreshToken != "refresh-1" {
+		t.Errorf("stored tokens %q %q, want access-1 refresh-1", got.AccessToken, got.RefreshToken)
+	}
+	if got.TokenExpiry.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("token expiry %s, want about an hour from now", got.TokenExpiry)
+	}
+}
+
+func TestOAuthRefreshOn401(t *testing.T) {
+	store := openTestStore(t)
+	s := &fakeOAuth{accessToken: "access-2"}
+	dest := newOAuthDestination(t, store, s)
+	err := store.SetDestinationTokens(dest.ID, "access-1", "refresh-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader([]byte(`{"id":"abc"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doServerRequest(store, server, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 after the refresh", resp.StatusCode)
+	}
+	if s.refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", s.refreshes)
+	}
+	want := []fakeOAuthUpload{
+		{authorization: "Bearer access-1", body: `{"id":"abc"}`},
+		{authorization: "Bearer access-2", body: `{"id":"abc"}`},
+	}
+	if len(s.uploads) != len(want) {
+		t.Fatalf("upload requests = %+v, want %+v", s.uploads, want)
+	}
+	for i := range want {
+		if s.uploads[i] != want[i] {
+			t.Errorf("upload request %d = %+v, want %+v", i, s.uploads[i], want[i])
+		}
+	}
+
+	got, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "access-2" || got.RefreshToken != "refresh-2" {
+		t.Errorf("stored tokens %q %q, want access-2 refresh-2", got.AccessToken, got.RefreshToken)
+	}
+}
+
+func TestFormRefreshOn401(t *testing.T) {
+	store := openTestStore(t)
+	s := &fakeOAuth{accessToken: "access-2"}
+	dest := newOAuthDestination(t, store, s)
+	err := store.SetDestinationTokens(dest.ID, "access-1", "refresh-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newFormBackend(store, *server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("form file body")
+	opens := 0
+	open := func() (io.ReadCloser, error) {
+		opens++
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	meta := FileMetadata{ID: "abc", Name: "IMG_0001.jpg", Mtime: time.Now(), Bytes: int64(len(body))}
+	var attempt db.Attempt
+	_, err = b.Upload(meta, open, nil, &attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", s.refreshes)
+	}
+	if opens != 2 {
+		t.Errorf("file opened %d times, want once per request", opens)
+	}
+	if len(s.uploads) != 2 {
+		t.Fatalf("upload requests = %d, want 2", len(s.uploads))
+	}
+	for i, want := range []string{"Bearer access-1", "Bearer access-2"} {
+		up := s.uploads[i]
+		if up.authorization != want {
+			t.Errorf("upload request %d authorization = %q, want %q", i, up.authorization, want)
+		}
+		if !bytes.Contains([]byte(up.body), body) {
+			t.Errorf("upload request %d body doesn't have the file: %q", i, up.body)
+		}
+	}
+	if attempt.HTTPStatus != http.StatusOK {
+		t.Errorf("attempt status = %d, want 200", attempt.HTTPStatus)
+	}
+}
+
+func TestOAuthInvalidGrant(t *testing.T) {
+	store := openTestStore(t)
+	s := &fakeOAuth{refreshError: "invalid_grant"}
+	dest := newOAuthDestination(t, store, s)
+	err := store.SetDestinationTokens(dest.ID, "access-1", "refresh-1", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader([]byte(`{"id":"abc"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doServerRequest(store, server, req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrSignInRequired) {
+		t.Fatalf("err = %v, want ErrSignInRequired", err)
+	}
+	if s.refreshes != 1 {
+		t.Errorf("refreshes = %d, want 1", s.refreshes)
+	}
+	if len(s.uploads) != 0 {
+		t.Errorf("request sent %d times with a revoked token", len(s.uploads))
+	}
+
+	got, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "" || got.RefreshToken != "" {
+		t.Errorf("tokens %q %q kept after invalid_grant", got.AccessToken, got.RefreshToken)
+	}
+}
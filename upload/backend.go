@@ -0,0 +1,178 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// Backend sends files to one destination.
+type Backend interface {
+	// Upload sends the file described by meta. open returns a new
+	// reader over the bytes to send each time it is called, and md5sum
+	// is their md5. Upload updates attempt's phase, bytes sent and
+	// server error as it goes, and reports skipped if the destination
+	// already had the file.
+	Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (skipped bool, err error)
+}
+
+// Finisher is implemented by backends with work to do once a run is
+// over, such as writing a snapshot of what was sent.
+type Finisher interface {
+	Finish() error
+}
+
+// backends maps a destination's Backend to its constructor.
+var backends = map[string]func(store *db.DB, dest db.Destination) (Backend, error){
+	db.BackendHTTP:   newHTTPBackend,
+	db.BackendLocal:  newLocalBackend,
+	db.BackendImmich: newImmichBackend,
+	db.BackendRestic: newResticBackend,
+	db.BackendForm:   newFormBackend,
+}
+
+// Backends returns the names of the supported backend types.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnavailableError means a destination can't be reached right now,
+// such as a removable drive that isn't mounted. Nothing more is sent
+// to it this run, and files stay pending instead of failing.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return "destination unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func newBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	newFn := backends[dest.Backend]
+	if newFn == nil {
+		return nil, fmt.Errorf("unknown backend %q", dest.Backend)
+	}
+	return newFn(store, dest)
+}
+
+// httpBackend speaks the media-backup protocol: negotiate an upload
+// url, send the body there, then verify what the server stored.
+type httpBackend struct {
+	store *db.DB
+	dest  db.Destination
+	caps  *Capabilities
+}
+
+func newHTTPBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	var caps *Capabilities
+	if dest.ID == db.PrimaryDestinationID {
+		caps = serverCapabilities(store)
+	} else {
+		var err error
+		caps, err = fetchCapabilities(store, &dest)
+		if err != nil {
+			plog.Printf("fetch capabilities err for destination=%s err=%s", dest.Name, err)
+			caps = &Capabilities{ProtocolVersion: 1}
+		}
+	}
+	plog.Printf("destination %s protocol=%d features=%v", dest.Name, caps.ProtocolVersion, caps.Features)
+
+	return &httpBackend{
+		store: store,
+		dest:  dest,
+		caps:  caps,
+	}, nil
+}
+
+func (b *httpBackend) Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (bool, error) {
+	attempt.Phase = db.PhaseNegotiate
+
+	mismatches, err := b.store.RecentMismatches(attempt.Name, b.dest.ID)
+	if err != nil {
+		return false, err
+	}
+	meta.Overwrite = mismatches > 0
+
+	dest, err := requestUploadURL(b.store, &b.dest, meta)
+	if err != nil {
+		return false, err
+	}
+	attempt.HTTPStatus = dest.StatusCode
+	attempt.ServerError = dest.Error
+
+	if dest.Status == StatusSkipUpload {
+		if meta.Overwrite {
+			// the copy the server kept is the one that failed
+			// verification, so it has to pass this time
+			attempt.Phase = db.PhaseConfirm
+			if !b.caps.Has(FeatureChecksumEcho) {
+				return false, &MismatchError{Field: "object", Want: meta.ID, Got: "skipped instead of overwritten"}
+			}
+			status, err := confirmUpload(b.store, &b.dest, meta)
+			if status != 0 {
+				attempt.HTTPStatus = status
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	verify := dest.Verify
+	if verify == VerifyNone && b.caps.Has(FeatureChecksumEcho) {
+		verify = VerifyConfirm
+	}
+
+	var contentMD5 []byte
+	if verify == VerifyETag {
+		contentMD5 = md5sum
+	}
+
+	attempt.Phase = db.PhaseTransfer
+	r, err := open()
+	if err != nil {
+		return false, err
+	}
+	cr := &countingReader{r: r}
+	resp, err := uploadFile(&b.dest, cr, meta.Bytes, dest, contentMD5)
+	r.Close()
+	attempt.BytesSent = cr.n
+	if err != nil {
+		return false, err
+	}
+	attempt.HTTPStatus = resp.StatusCode
+
+	if verify != VerifyNone {
+		attempt.Phase = db.PhaseConfirm
+		switch verify {
+		case VerifyConfirm:
+			var status int
+			status, err = confirmUpload(b.store, &b.dest, meta)
+			if status != 0 {
+				attempt.HTTPStatus = status
+			}
+		case VerifyETag:
+			err = verifyETag(resp.Header, md5sum)
+		default:
+			err = fmt.Errorf("unknown verify method %q", verify)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
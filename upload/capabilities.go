@@ -0,0 +1,149 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// ProtocolVersion is the highest protocol version this client speaks.
+// It is sent on every request in the x-media-backup-protocol header.
+const ProtocolVersion = 1
+
+// capabilitiesPath is fetched relative to the configured server URL.
+var capabilitiesPath = ".well-known/media-backup"
+
+// capabilitiesTTL is how long a cached capabilities document is
+// trusted before Upload fetches it again.
+var capabilitiesTTL = 24 * time.Hour
+
+type Feature string
+
+var (
+	FeatureBatch        Feature = "batch"         // audit many objects in one request
+	FeatureChecksumEcho Feature = "checksum_echo" // confirm endpoint echoes size and sha256
+	FeatureAudit        Feature = "audit"         // objects can be checked with HEAD, or in bulk with batch
+	FeatureInventory    Feature = "inventory"     // list this device's objects, and download them
+)
+
+// Capabilities is the document served at capabilitiesPath. Servers
+// that don't serve it are treated as protocol version 1 with no
+// optional features.
+type Capabilities struct {
+	ProtocolVersion int       `json:"protocol_version"`
+	Features        []Feature `json:"features"`
+}
+
+func (c *Capabilities) Has(f Feature) bool {
+	if c == nil {
+		return false
+	}
+	for _, have := range c.Features {
+		if have == f {
+			return true
+		}
+	}
+	return false
+}
+
+// CachedCapabilities returns the capabilities stored in the db for
+// the currently configured server URL, or nil if there are none.
+func CachedCapabilities(store *db.DB) (*Capabilities, time.Time) {
+	serverURL, _ := store.URL()
+	cachedURL, raw, fetched, err := store.ServerCapabilities()
+	if err != nil || cachedURL != serverURL {
+		return nil, time.Time{}
+	}
+
+	var caps Capabilities
+	err = json.Unmarshal(raw, &caps)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	return &caps, fetched
+}
+
+// serverCapabilities returns the cached capabilities, refreshing them
+// if they are missing or stale. Errors are logged and treated as a
+// server with no optional features.
+func serverCapabilities(store *db.DB) *Capabilities {
+	caps, fetched := CachedCapabilities(store)
+	if caps != nil && time.Since(fetched) < capabilitiesTTL {
+		return caps
+	}
+
+	caps, err := RefreshCapabilities(store)
+	if err != nil {
+		plog.Printf("fetch server capabilities err: %s", err)
+		return &Capabilities{ProtocolVersion: 1}
+	}
+	return caps
+}
+
+// RefreshCapabilities fetches the capabilities document from the
+// primary server and caches it in the db.
+func RefreshCapabilities(store *db.DB) (*Capabilities, error) {
+	server, err := store.Destination(db.PrimaryDestinationID)
+	if err != nil {
+		return nil, err
+	}
+
+	caps, err := fetchCapabilities(store, server)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(caps)
+	if err != nil {
+		return nil, err
+	}
+	err = store.SetServerCapabilities(server.URL, raw, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	plog.Printf("server capabilities: version=%d features=%v", caps.ProtocolVersion, caps.Features)
+
+	return caps, nil
+}
+
+// fetchCapabilities fetches the capabilities document from server
+// without caching it.
+func fetchCapabilities(store *db.DB, server *db.Destination) (*Capabilities, error) {
+	capsURL, err := url.JoinPath(server.URL, capabilitiesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", capsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doServerRequest(store, server, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	caps := Capabilities{
+		ProtocolVersion: 1,
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		err = json.NewDecoder(resp.Body).Decode(&caps)
+		if err != nil {
+			return nil, err
+		}
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// legacy server without a capabilities endpoint
+	default:
+		return nil, newStatusError(resp)
+	}
+
+	return &caps, nil
+}
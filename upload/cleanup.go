@@ -0,0 +1,214 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+var (
+	// trashPath is on the same filesystem as mediaPath so moving a
+	// file into it is a rename. The .nomedia file hides it from
+	// gallery apps.
+	trashPath = filepath.Join(filepath.Dir(mediaPath), ".media-backup-trash")
+
+	// TrashRetention is how long trashed files are kept before
+	// PurgeTrash deletes them.
+	TrashRetention = 7 * 24 * time.Hour
+)
+
+// CleanupPreview summarizes what FreeUpSpace would remove.
+type CleanupPreview struct {
+	Files int
+	Bytes int64
+}
+
+// PreviewCleanup reports how many files and bytes are backed up and
+// older than olderThan. Files still go through server verification
+// before they are removed, so the real result may be smaller.
+func PreviewCleanup(store *db.DB, olderThan time.Duration) (*CleanupPreview, error) {
+	files, err := store.CleanupCandidates(time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+
+	var p CleanupPreview
+	for _, f := range files {
+		p.Files++
+		p.Bytes += f.Size
+	}
+	return &p, nil
+}
+
+// FreeUpSpace moves backed up files older than olderThan into the
+// trash. Each file must be recorded as stored at every destination
+// that counts toward its state, is re-hashed locally and re-verified
+// with the server, and is left alone if any check fails.
+func FreeUpSpace(store *db.DB, olderThan time.Duration) (*CleanupPreview, error) {
+	caps := serverCapabilities(store)
+	if !caps.Has(FeatureChecksumEcho) && !caps.Has(FeatureAudit) {
+		return nil, errors.New("server cannot verify stored files, not removing anything")
+	}
+
+	files, err := store.CleanupCandidates(time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(trashPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	nomedia, err := os.Create(filepath.Join(trashPath, ".nomedia"))
+	if err == nil {
+		nomedia.Close()
+	}
+
+	var moved CleanupPreview
+	for _, f := range files {
+		ok, err := store.UploadedEverywhere(f.Name)
+		if err != nil {
+			plog.Printf("free up space: destination state err for=%s err=%s", f.Name, err)
+			continue
+		}
+		if !ok {
+			plog.Printf("free up space: %s not stored at every destination yet, keeping it", f.Name)
+			continue
+		}
+
+		sum, err := hashFile(f.Path)
+		if err != nil {
+			plog.Printf("free up space: hash err for=%s err=%s", f.Name, err)
+			continue
+		}
+		if sum != f.SHA256 {
+			plog.Printf("free up space: %s changed since upload, keeping it", f.Name)
+			continue
+		}
+
+		err = verifyRemote(store, caps, f)
+		if err != nil {
+			plog.Printf("free up space: server verify failed for=%s err=%s", f.Name, err)
+			continue
+		}
+
+		dst := filepath.Join(trashPath, f.Name)
+		err = os.Rename(f.Path, dst)
+		if err != nil {
+			plog.Printf("free up space: move to trash err for=%s err=%s", f.Name, err)
+			continue
+		}
+
+		err = store.TrashFile(f.Name, dst)
+		if err != nil {
+			plog.Printf("free up space: record trash err for=%s err=%s", f.Name, err)
+			continue
+		}
+
+		moved.Files++
+		moved.Bytes += f.Size
+	}
+
+	plog.Printf("free up space: moved %d files (%d bytes) to trash", moved.Files, moved.Bytes)
+	return &moved, nil
+}
+
+// verifyRemote checks that the server still has f with the right size
+// and hash.
+func verifyRemote(store *db.DB, caps *Capabilities, f db.File) error {
+	if caps.Has(FeatureChecksumEcho) {
+		server, err := store.Destination(db.PrimaryDestinationID)
+		if err != nil {
+			return err
+		}
+		_, err = confirmUpload(store, server, FileMetadata{
+			ID:    f.ObjectID(),
+			Name:  f.Name,
+			Bytes: f.Size,
+		})
+		return err
+	}
+
+	id := f.ObjectID()
+	obj, err := auditHead(store, id)
+	if err != nil {
+		return err
+	}
+	if !obj.Exists {
+		return &MismatchError{Field: "object", Want: id, Got: "not found"}
+	}
+	if obj.Bytes != f.Size {
+		return &MismatchError{Field: "size", Want: fmt.Sprint(f.Size), Got: fmt.Sprint(obj.Bytes)}
+	}
+	if obj.SHA256 != "" && !strings.EqualFold(obj.SHA256, id) {
+		return &MismatchError{Field: "sha256", Want: id, Got: obj.SHA256}
+	}
+	return nil
+}
+
+// TrashSummary reports what is currently in the trash.
+func TrashSummary(store *db.DB) (*CleanupPreview, error) {
+	files, err := store.TrashedFiles(time.Now().Add(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	var p CleanupPreview
+	for _, f := range files {
+		p.Files++
+		p.Bytes += f.Size
+	}
+	return &p, nil
+}
+
+// PurgeTrash deletes files that have been in the trash longer than
+// olderThan. Pass 0 to empty the trash.
+func PurgeTrash(store *db.DB, olderThan time.Duration) error {
+	files, err := store.TrashedFiles(time.Now().Add(-olderThan))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err := os.Remove(f.TrashPath)
+		if err != nil && !os.IsNotExist(err) {
+			plog.Printf("purge trash err for=%s err=%s", f.Name, err)
+			continue
+		}
+		err = store.CleanFile(f.Name)
+		if err != nil {
+			plog.Printf("purge trash record err for=%s err=%s", f.Name, err)
+		}
+	}
+
+	if len(files) > 0 {
+		plog.Printf("purged %d files from trash", len(files))
+	}
+	return nil
+}
+
+// RestoreTrash moves every trashed file back to its original location.
+func RestoreTrash(store *db.DB) error {
+	files, err := store.TrashedFiles(time.Now().Add(time.Minute))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err := os.Rename(f.TrashPath, f.Path)
+		if err != nil {
+			plog.Printf("restore trash err for=%s err=%s", f.Name, err)
+			continue
+		}
+		err = store.UntrashFile(f.Name)
+		if err != nil {
+			plog.Printf("restore trash record err for=%s err=%s", f.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// fakeConfirmServer is a primary server that echoes checksums for
+// every object in objects.
+type fakeConfirmServer struct {
+	t       *testing.T
+	objects map[string]int64
+}
+
+func (s *fakeConfirmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/" + capabilitiesPath:
+		json.NewEncoder(w).Encode(Capabilities{
+			ProtocolVersion: ProtocolVersion,
+			Features:        []Feature{FeatureChecksumEcho},
+		})
+
+	case "/" + confirmPath:
+		var req ConfirmRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			s.t.Errorf("bad confirm request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		size, ok := s.objects[req.ID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(ConfirmResponse{ID: req.ID, Bytes: size, SHA256: req.ID})
+
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestFreeUpSpaceWaitsForEveryDestination(t *testing.T) {
+	oldTrash := trashPath
+	trashPath = filepath.Join(t.TempDir(), "trash")
+	t.Cleanup(func() { trashPath = oldTrash })
+
+	store := openTestStore(t)
+
+	body := []byte("backed up photo")
+	sum := sha256.Sum256(body)
+	id := hex.EncodeToString(sum[:])
+
+	s := &fakeConfirmServer{t: t, objects: map[string]int64{id: int64(len(body))}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	err := store.SetURL(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := &db.Destination{
+		Name:     "second",
+		Backend:  db.BackendLocal,
+		URL:      t.TempDir(),
+		Enabled:  true,
+		Required: true,
+	}
+	err = store.SaveDestination(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	err = os.WriteFile(path, body, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.CreatePending("IMG_0001.jpg", path, time.Now().Add(-48*time.Hour), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetFileSHA256("IMG_0001.jpg", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.EndUpload("IMG_0001.jpg", db.UploadSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetFileDestinationState("IMG_0001.jpg", second.ID, db.UploadPending, time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cached overall state can be out of date, the per
+	// destination records are what count
+	err = store.SetFileState("IMG_0001.jpg", db.UploadSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := FreeUpSpace(store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Files != 0 {
+		t.Errorf("moved %d files while the second destination is pending", moved.Files)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file removed while the second destination is pending: %s", err)
+	}
+
+	err = store.SetFileDestinationState("IMG_0001.jpg", second.ID, db.UploadSuccess, time.Time{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err = FreeUpSpace(store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Files != 1 {
+		t.Errorf("moved %d files once every destination has it, want 1", moved.Files)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still in place after free up space: %v", err)
+	}
+	f, err := store.GetFile("IMG_0001.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.State != db.UploadTrashed {
+		t.Errorf("file state = %s, want %s", f.State, db.UploadTrashed)
+	}
+}
@@ -0,0 +1,302 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+type CheckStatus int
+
+const (
+	CheckPending CheckStatus = iota
+	CheckOK
+	CheckFailed
+	CheckSkipped
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPending:
+		return "pending"
+	case CheckOK:
+		return "ok"
+	case CheckFailed:
+		return "failed"
+	case CheckSkipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("CheckStatus<%d>", s)
+	}
+}
+
+// CheckStep is one line of the connection test checklist.
+type CheckStep struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+var connTestTimeout = 15 * time.Second
+
+// TestConnection checks each step needed for an upload to work,
+// stopping at the first failure. It sends a small generated file
+// with TestUpload set, and then asks the server to discard it.
+// progress is called with a copy of the checklist every time a step
+// changes.
+func TestConnection(store *db.DB, progress func([]CheckStep)) []CheckStep {
+	steps := []CheckStep{
+		{Name: "Validate URL"},
+		{Name: "Resolve DNS"},
+		{Name: "TLS handshake"},
+		{Name: "Authenticate"},
+		{Name: "Negotiate test upload"},
+		{Name: "Upload test file"},
+		{Name: "Discard test file"},
+	}
+
+	report := func() {
+		if progress != nil {
+			progress(append([]CheckStep(nil), steps...))
+		}
+	}
+
+	set := func(i int, status CheckStatus, detail string) {
+		steps[i].Status = status
+		steps[i].Detail = detail
+		plog.Printf("connection test: %s %s %s", steps[i].Name, status, detail)
+		report()
+	}
+
+	// failRest marks step i failed and everything after it skipped.
+	failRest := func(i int, detail string) []CheckStep {
+		for j := i + 1; j < len(steps); j++ {
+			steps[j].Status = CheckSkipped
+		}
+		set(i, CheckFailed, detail)
+		return steps
+	}
+
+	report()
+
+	rawURL, err := store.URL()
+	if err != nil || rawURL == "" {
+		return failRest(0, "no server url configured")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return failRest(0, fmt.Sprintf("bad url: %s", err))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return failRest(0, fmt.Sprintf("bad url: scheme must be http or https, not %q", u.Scheme))
+	}
+	if u.Hostname() == "" {
+		return failRest(0, "bad url: missing host")
+	}
+	set(0, CheckOK, u.Redacted())
+
+	ctx, cancel := context.WithTimeout(context.Background(), connTestTimeout)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	cancel()
+	if err != nil {
+		return failRest(1, fmt.Sprintf("dns lookup failed: %s", err))
+	}
+	set(1, CheckOK, strings.Join(addrs, ", "))
+
+	if u.Scheme == "https" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		server, err := store.Destination(db.PrimaryDestinationID)
+		if err != nil {
+			return failRest(2, describeErr(err))
+		}
+		cfg, err := tlsConfig(server.TLS, u.Hostname())
+		if err != nil {
+			return failRest(2, fmt.Sprintf("tls settings: %s", err))
+		}
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: connTestTimeout},
+			Config:    cfg,
+		}
+		conn, err := dialer.Dial("tcp", net.JoinHostPort(u.Hostname(), port))
+		if err != nil {
+			return failRest(2, fmt.Sprintf("tls handshake failed: %s", describeErr(err)))
+		}
+		state := conn.(*tls.Conn).ConnectionState()
+		conn.Close()
+		detail := tls.VersionName(state.Version)
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			detail += fmt.Sprintf(", cert %s expires %s", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+		}
+		set(2, CheckOK, detail)
+	} else {
+		set(2, CheckSkipped, "plain http, credentials are sent unencrypted")
+	}
+
+	// Legacy servers have no capabilities document and others may
+	// serve it without authentication, so credentials are checked
+	// with the test upload's negotiation instead.
+	protocol := "protocol unknown"
+	caps, err := RefreshCapabilities(store)
+	if err != nil {
+		if authFailed(err) {
+			return failRest(3, describeErr(err))
+		}
+		plog.Printf("connection test: capabilities err: %s", err)
+	} else {
+		protocol = fmt.Sprintf("protocol v%d", caps.ProtocolVersion)
+	}
+
+	payload := make([]byte, 1024)
+	copy(payload, fmt.Sprintf("android-media-backup connection test %s\n", time.Now().Format(time.RFC3339)))
+	rand.Read(payload[64:])
+	sum := sha256.Sum256(payload)
+
+	meta := FileMetadata{
+		ID:          hex.EncodeToString(sum[:]),
+		Name:        fmt.Sprintf("connection-test-%d.bin", time.Now().Unix()),
+		Mtime:       time.Now(),
+		Bytes:       int64(len(payload)),
+		ContentType: "application/octet-stream",
+		TestUpload:  true,
+	}
+
+	server, err := store.Destination(db.PrimaryDestinationID)
+	if err != nil {
+		return failRest(3, describeErr(err))
+	}
+	dest, err := requestUploadURL(store, server, meta)
+	var statusErr *StatusError
+	if err != nil && (!errors.As(err, &statusErr) || authFailed(err)) {
+		return failRest(3, describeErr(err))
+	}
+	set(3, CheckOK, "credentials accepted, "+protocol)
+	if err != nil {
+		return failRest(4, describeErr(err))
+	}
+	if dest.Status == StatusSkipUpload {
+		set(4, CheckOK, "server already has this file")
+		set(5, CheckSkipped, "server skipped the upload")
+	} else {
+		set(4, CheckOK, fmt.Sprintf("%s %s", dest.Method, redactURL(dest.URL)))
+
+		_, err = uploadFile(server, bytes.NewReader(payload), int64(len(payload)), dest, nil)
+		if err != nil {
+			return failRest(5, fmt.Sprintf("%s rejected: %s", dest.Method, describeErr(err)))
+		}
+		set(5, CheckOK, fmt.Sprintf("%d bytes", len(payload)))
+	}
+
+	supported, err := discardTestUpload(store, meta.ID)
+	if err != nil {
+		set(6, CheckFailed, describeErr(err))
+	} else if !supported {
+		set(6, CheckSkipped, "server does not support discard")
+	} else {
+		set(6, CheckOK, "")
+	}
+
+	return steps
+}
+
+// discardTestUpload asks the server to delete a file that was sent
+// with TestUpload set. It reports false if the server doesn't
+// implement discard, including a 404 from a server with no such
+// route.
+func discardTestUpload(store *db.DB, id string) (bool, error) {
+	serverURL, err := store.URL()
+	if err != nil {
+		return false, err
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return false, err
+	}
+	q := u.Query()
+	q.Set("id", id)
+	q.Set("test_upload", "true")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := doRequest(store, req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return false, nil
+	default:
+		return false, newStatusError(resp)
+	}
+}
+
+// authFailed reports whether err means the server didn't accept our
+// credentials.
+func authFailed(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
+	}
+	return errors.Is(err, ErrSignInRequired)
+}
+
+// describeErr turns common failures into something a user can act on.
+func describeErr(err error) string {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized:
+			return "401 unauthorized: check username and password"
+		case http.StatusForbidden:
+			return "403 forbidden: this user may not upload"
+		}
+		return statusErr.Error()
+	}
+
+	var certErr *CertificateError
+	if errors.As(err, &certErr) {
+		return fmt.Sprintf("%s. If %s is your server's key, trust it under TLS in settings, or import the CA that signed it", certErr, certErr.Fingerprint)
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return fmt.Sprintf("dns lookup failed: %s", dnsErr)
+	}
+
+	return err.Error()
+}
+
+// redactURL strips the query string, which for presigned urls
+// contains credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	return u.Redacted()
+}
@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// enrollPath is posted to, relative to the server URL, to register
+// this device's public key.
+var enrollPath = "enroll"
+
+// Every request to a media-backup server is signed with the device
+// key. The signature covers
+//
+//	METHOD\nPATH\nTIMESTAMP\nSHA256
+//
+// where PATH includes any query string, TIMESTAMP is the unix time in
+// seconds sent in x-media-backup-timestamp and SHA256 is the hex hash
+// of the body. The base64 signature is sent in
+// x-media-backup-signature. A server that has enrolled the device can
+// check it against the key registered for x-media-backup-device, and
+// revoking that key locks the device out.
+const (
+	timestampHeader = "x-media-backup-timestamp"
+	signatureHeader = "x-media-backup-signature"
+)
+
+// signTime is the clock signatures are stamped with.
+var signTime = time.Now
+
+// signRequest adds the timestamp and signature headers to req. A body
+// that can't be read twice is buffered so it can still be sent.
+func signRequest(store *db.DB, req *http.Request) error {
+	key, err := store.DeviceKey()
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			body, err := io.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return err
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	ts := strconv.FormatInt(signTime().Unix(), 10)
+	msg := req.Method + "\n" + req.URL.RequestURI() + "\n" + ts + "\n" + hex.EncodeToString(h.Sum(nil))
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(msg))))
+	return nil
+}
+
+// DevicePublicKey returns this device's public key, base64 encoded as
+// it is sent when enrolling.
+func DevicePublicKey(store *db.DB) (string, error) {
+	key, err := store.DeviceKey()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+type enrollRequest struct {
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	PublicKey  string `json:"public_key"`
+	Code       string `json:"code"`
+}
+
+// Enroll registers this device's public key with the server at
+// destination destID. code is a one-time code from the server's
+// admin that approves the device. The request is itself signed, which
+// proves the device holds the key.
+func Enroll(store *db.DB, destID int64, code string) error {
+	server, err := store.Destination(destID)
+	if err != nil {
+		return err
+	}
+	enrollURL, err := url.JoinPath(server.URL, enrollPath)
+	if err != nil {
+		return err
+	}
+
+	deviceID, err := store.DeviceID()
+	if err != nil {
+		return err
+	}
+	deviceName, err := store.DeviceName()
+	if err != nil {
+		return err
+	}
+	pub, err := DevicePublicKey(store)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(enrollRequest{
+		DeviceID:   deviceID,
+		DeviceName: deviceName,
+		PublicKey:  pub,
+		Code:       code,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", enrollURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := doServerRequest(store, server, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return newStatusError(resp)
+	}
+	return nil
+}
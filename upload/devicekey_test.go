@@ -0,0 +1,204 @@
+package upload
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// devicePublicKey returns the key requests from store should be
+// signed with.
+func devicePublicKey(t *testing.T, store *db.DB) ed25519.PublicKey {
+	t.Helper()
+	pub, err := DevicePublicKey(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.PublicKey(raw)
+}
+
+// checkSignature rebuilds the signed message from what the server
+// received and checks it against pub.
+func checkSignature(t *testing.T, pub ed25519.PublicKey, r *http.Request, body []byte) {
+	t.Helper()
+	sum := sha256.Sum256(body)
+	msg := r.Method + "\n" + r.RequestURI + "\n" + r.Header.Get(timestampHeader) + "\n" + hex.EncodeToString(sum[:])
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil {
+		t.Errorf("%s %s: bad signature header: %s", r.Method, r.RequestURI, err)
+		return
+	}
+	if !ed25519.Verify(pub, []byte(msg), sig) {
+		t.Errorf("%s %s: signature doesn't verify for %q", r.Method, r.RequestURI, msg)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	store := openTestStore(t)
+	pub := devicePublicKey(t, store)
+
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		checkSignature(t, pub, r, body)
+	}))
+	t.Cleanup(srv.Close)
+	err := store.SetURL(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get, err := http.NewRequest("GET", srv.URL+"/objects?limit=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reader http.NewRequest doesn't know how to replay, so the
+	// request has no GetBody
+	post, err := http.NewRequest("POST", srv.URL+"/confirm", io.MultiReader(strings.NewReader(`{"id":"abc"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.GetBody != nil {
+		t.Fatal("test POST has a GetBody")
+	}
+
+	for _, req := range []*http.Request{get, post} {
+		resp, err := doRequest(store, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []string{"", `{"id":"abc"}`}
+	if len(bodies) != len(want) {
+		t.Fatalf("server got %d requests, want %d", len(bodies), len(want))
+	}
+	for i := range want {
+		if bodies[i] != want[i] {
+			t.Errorf("request %d body = %q, want %q", i, bodies[i], want[i])
+		}
+	}
+}
+
+func TestOAuthRetryIsSigned(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oldSignTime := signTime
+	signTime = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	t.Cleanup(func() { signTime = oldSignTime })
+
+	store := openTestStore(t)
+	pub := devicePublicKey(t, store)
+
+	var timestamps []string
+	s := &fakeOAuth{accessToken: "access-2"}
+	s.verify = func(r *http.Request, body []byte) {
+		checkSignature(t, pub, r, body)
+		timestamps = append(timestamps, r.Header.Get(timestampHeader))
+	}
+	dest := newOAuthDestination(t, store, s)
+	err := store.SetDestinationTokens(dest.ID, "access-1", "refresh-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := store.Destination(dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", server.URL, io.MultiReader(strings.NewReader(`{"id":"abc"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doServerRequest(store, server, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 after the refresh", resp.StatusCode)
+	}
+	if len(timestamps) != 2 {
+		t.Fatalf("upload requests = %d, want 2", len(timestamps))
+	}
+	if timestamps[0] == timestamps[1] {
+		t.Errorf("retry sent with the first request's signature from %s", timestamps[0])
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	store := openTestStore(t)
+	pub, err := DevicePublicKey(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceID, err := store.DeviceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got enrollRequest
+	enrolls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/"+enrollPath {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		enrolls++
+		body, _ := io.ReadAll(r.Body)
+		err := json.Unmarshal(body, &got)
+		if err != nil {
+			t.Errorf("bad enroll request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// the enrollment is signed by the key it registers
+		key, err := base64.StdEncoding.DecodeString(got.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			t.Errorf("bad public key %q", got.PublicKey)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		checkSignature(t, ed25519.PublicKey(key), r, body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(srv.Close)
+	err = store.SetURL(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Enroll(store, db.PrimaryDestinationID, "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrolls != 1 {
+		t.Fatalf("enroll requests = %d, want 1", enrolls)
+	}
+	if got.PublicKey != pub {
+		t.Errorf("enrolled public key %s, want the device key", got.PublicKey)
+	}
+	if got.DeviceID != deviceID || got.Code != "123456" {
+		t.Errorf("enrolled device %q with code %q, want %q and 123456", got.DeviceID, got.Code, deviceID)
+	}
+}
@@ -0,0 +1,106 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// RestoreFromServer replaces a corrupt local file with the copy on
+// the server, as long as that copy matches the original hash.
+func RestoreFromServer(store *db.DB, name string) error {
+	f, err := store.GetFile(name)
+	if err != nil {
+		return err
+	}
+	if f.OriginalSHA256 == "" {
+		return fmt.Errorf("no original hash recorded for %s", name)
+	}
+	if f.UploadedSHA256 != "" && f.UploadedSHA256 != f.OriginalSHA256 {
+		return fmt.Errorf("server copy of %s was transformed before upload, not restoring over the original", name)
+	}
+
+	err = downloadObject(store, f.OriginalSHA256, f.Path, f.Created)
+	if err != nil {
+		return err
+	}
+
+	plog.Printf("restored %s from server", name)
+
+	err = store.EndUpload(name, db.UploadSuccess)
+	if err != nil {
+		return err
+	}
+	return store.MarkVerified(name, time.Now())
+}
+
+// downloadObject fetches GET <url>/objects/<id> into dst. The body is
+// written to a temp file next to dst, checked against id (its
+// sha256), given mtime, and renamed into place.
+func downloadObject(store *db.DB, id, dst string, mtime time.Time) error {
+	serverURL, err := store.URL()
+	if err != nil {
+		return err
+	}
+	objURL, err := url.JoinPath(serverURL, objectsPath, id)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", objURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest(store, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return newStatusError(resp)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	summer := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, summer), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	got := hex.EncodeToString(summer.Sum(nil))
+	if got != id {
+		return &MismatchError{Field: "sha256", Want: id, Got: got}
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmp.Name(), mtime, mtime)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRetryAfter is used when the server asks us to back off
+// without saying for how long.
+var defaultRetryAfter = 1 * time.Hour
+
+// StatusError is returned for unexpected HTTP responses and for
+// negotiation replies whose Status is not ok or skip. Message holds
+// the server's error string when the body included one.
+type StatusError struct {
+	StatusCode int
+	Status     Status
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	var msg string
+	if e.StatusCode != 200 && e.StatusCode != http.StatusConflict {
+		msg = fmt.Sprintf("non-200 status code: %d", e.StatusCode)
+	} else {
+		msg = fmt.Sprintf("server status: %s", e.Status)
+	}
+	if e.Code != "" {
+		msg += fmt.Sprintf(" [%s]", e.Code)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Rejected reports whether the server said the file should never be
+// retried, either with a rejected status or a code saying the file
+// can't be accepted.
+func (e *StatusError) Rejected() bool {
+	return e.Status == StatusRejected || e.Code == ErrCodeTooLarge || e.Code == ErrCodeUnsupported
+}
+
+// Deferred reports whether just this file should be retried later.
+func (e *StatusError) Deferred() bool {
+	return e.Status == StatusDefer
+}
+
+// Backoff reports whether the server wants all uploads to stop for a
+// while, either because of a quota or because it is overloaded.
+func (e *StatusError) Backoff() bool {
+	if e.Status == StatusQuotaExceeded || e.Code == ErrCodeQuota || e.Code == ErrCodeBusy {
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// RetryTime returns when the request may be retried.
+func (e *StatusError) RetryTime() time.Time {
+	wait := e.RetryAfter
+	if wait <= 0 {
+		wait = defaultRetryAfter
+	}
+	return time.Now().Add(wait)
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	statusErr := StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     StatusErr,
+		RetryAfter: parseRetryAfter(resp.Header.Get("retry-after")),
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var dest UploadDestination
+	if json.Unmarshal(body, &dest) == nil && (dest.Error != "" || dest.Status != "") {
+		if dest.Status != "" {
+			statusErr.Status = dest.Status
+		}
+		statusErr.Code = dest.Code
+		statusErr.Message = dest.Error
+		if dest.RetryAfter > 0 {
+			statusErr.RetryAfter = time.Duration(dest.RetryAfter) * time.Second
+		}
+	} else if !strings.HasPrefix(resp.Header.Get("content-type"), "text/html") {
+		statusErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return &statusErr
+}
+
+// parseRetryAfter handles both forms of the Retry-After header:
+// delay-seconds and an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
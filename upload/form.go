@@ -0,0 +1,262 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// formBackend POSTs each file as a multipart form, for file drops
+// that don't speak the media-backup protocol. The destination's
+// options configure the form:
+//
+//	file_field      field holding the file (default file)
+//	name_field      field set to the file name
+//	sha256_field    field set to the hex sha256 of the file
+//	mtime_field     field set to the RFC 3339 modification time
+//	field.NAME      a static field sent with every file
+//	success_status  comma separated status codes that mean success
+//	                (default any 2xx)
+//	success_json    dotted path into the JSON response, such as
+//	                files.0.ok, that must be set and not false, 0 or ""
+//	success_value   the value success_json must have instead
+//
+// Credentials are sent as the auth option says.
+type formBackend struct {
+	store *db.DB
+	dest  db.Destination
+
+	fileField   string
+	nameField   string
+	sha256Field string
+	mtimeField  string
+	static      [][2]string
+
+	successStatus []int
+	successJSON   []string
+	successValue  *string
+}
+
+func newFormBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	if dest.URL == "" {
+		return nil, fmt.Errorf("form destination %s needs a url", dest.Name)
+	}
+	opts, err := url.ParseQuery(dest.Options)
+	if err != nil {
+		return nil, fmt.Errorf("form destination %s options: %w", dest.Name, err)
+	}
+
+	b := &formBackend{
+		store:     store,
+		dest:      dest,
+		fileField: "file",
+	}
+	for key, vals := range opts {
+		val := vals[len(vals)-1]
+		switch {
+		case key == "file_field":
+			b.fileField = val
+		case key == "name_field":
+			b.nameField = val
+		case key == "sha256_field":
+			b.sha256Field = val
+		case key == "mtime_field":
+			b.mtimeField = val
+		case strings.HasPrefix(key, "field."):
+			b.static = append(b.static, [2]string{strings.TrimPrefix(key, "field."), val})
+		case key == "success_status":
+			for _, s := range strings.Split(val, ",") {
+				code, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil {
+					return nil, fmt.Errorf("form destination %s: bad success_status %q", dest.Name, val)
+				}
+				b.successStatus = append(b.successStatus, code)
+			}
+		case key == "success_json":
+			b.successJSON = strings.Split(strings.TrimPrefix(val, "$."), ".")
+		case key == "success_value":
+			b.successValue = &val
+		case isAuthOption(key):
+			// used by authorize
+		default:
+			return nil, fmt.Errorf("form destination %s: unknown option %q", dest.Name, key)
+		}
+	}
+	if cfg, err := parseAuth(dest.Options); err == nil && cfg.mode == AuthDevice {
+		return nil, fmt.Errorf("form destination %s: auth=device only works with media-backup servers", dest.Name)
+	}
+	if b.fileField == "" {
+		return nil, fmt.Errorf("form destination %s: file_field can't be empty", dest.Name)
+	}
+	if b.successValue != nil && b.successJSON == nil {
+		return nil, fmt.Errorf("form destination %s: success_value needs success_json", dest.Name)
+	}
+	sort.Slice(b.static, func(i, j int) bool {
+		return b.static[i][0] < b.static[j][0]
+	})
+
+	return b, nil
+}
+
+func (b *formBackend) Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (bool, error) {
+	name := storedName(meta)
+
+	fields := append([][2]string(nil), b.static...)
+	if b.nameField != "" {
+		fields = append(fields, [2]string{b.nameField, name})
+	}
+	if b.sha256Field != "" {
+		fields = append(fields, [2]string{b.sha256Field, meta.ID})
+	}
+	if b.mtimeField != "" {
+		fields = append(fields, [2]string{b.mtimeField, meta.Mtime.UTC().Format(time.RFC3339)})
+	}
+
+	attempt.Phase = db.PhaseTransfer
+	// the file is opened again if the request has to be resent after
+	// an OAuth token refresh
+	var (
+		r  io.ReadCloser
+		cr *countingReader
+	)
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+	newRequest := func() (*http.Request, error) {
+		if r != nil {
+			r.Close()
+		}
+		var err error
+		r, err = open()
+		if err != nil {
+			return nil, err
+		}
+		cr = &countingReader{r: r}
+
+		body, contentType, size, err := multipartBody(fields, b.fileField, name, meta.ContentType, cr, meta.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", b.dest.URL, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("content-type", contentType)
+		return req, authorize(b.store, &b.dest, req)
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return false, err
+	}
+	client, err := httpClient(&b.dest)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := sendWithRefresh(b.store, &b.dest, client, req, newRequest)
+	attempt.BytesSent = cr.n
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	attempt.HTTPStatus = resp.StatusCode
+
+	if !b.statusOK(resp.StatusCode) {
+		return false, newStatusError(resp)
+	}
+
+	if b.successJSON != nil {
+		attempt.Phase = db.PhaseConfirm
+		respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return false, err
+		}
+		err = b.checkJSON(respBody)
+		if err != nil {
+			attempt.ServerError = string(respBody)
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func (b *formBackend) statusOK(code int) bool {
+	if len(b.successStatus) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, ok := range b.successStatus {
+		if code == ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkJSON applies the success_json rule to a response body.
+func (b *formBackend) checkJSON(body []byte) error {
+	path := strings.Join(b.successJSON, ".")
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return fmt.Errorf("bad json response: %w", err)
+	}
+
+	for _, key := range b.successJSON {
+		switch cur := v.(type) {
+		case map[string]interface{}:
+			v = cur[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(cur) {
+				return fmt.Errorf("response has no %s", path)
+			}
+			v = cur[i]
+		default:
+			return fmt.Errorf("response has no %s", path)
+		}
+	}
+
+	var got string
+	switch cur := v.(type) {
+	case nil:
+		return fmt.Errorf("response has no %s", path)
+	case string:
+		got = cur
+	case json.Number:
+		got = cur.String()
+	case bool:
+		got = strconv.FormatBool(cur)
+	default:
+		raw, _ := json.Marshal(cur)
+		got = string(raw)
+	}
+
+	if b.successValue != nil {
+		if got != *b.successValue {
+			return fmt.Errorf("response %s is %q, want %q", path, got, *b.successValue)
+		}
+		return nil
+	}
+	switch got {
+	case "", "false", "0":
+		return fmt.Errorf("response %s is %q", path, got)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// immichBackend uploads to an Immich server's asset API. The
+// destination's password holds an Immich API key, and its url is the
+// server root (with or without the trailing /api).
+type immichBackend struct {
+	client   *http.Client
+	apiURL   string
+	apiKey   string
+	deviceID string
+}
+
+func newImmichBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	if dest.Password == "" {
+		return nil, fmt.Errorf("immich destination %s needs an api key in its password", dest.Name)
+	}
+	apiURL := strings.TrimSuffix(dest.URL, "/")
+	if !strings.HasSuffix(apiURL, "/api") {
+		apiURL += "/api"
+	}
+	deviceID, err := store.DeviceID()
+	if err != nil {
+		return nil, err
+	}
+	client, err := httpClient(&dest)
+	if err != nil {
+		return nil, err
+	}
+	return &immichBackend{
+		client:   client,
+		apiURL:   apiURL,
+		apiKey:   dest.Password,
+		deviceID: deviceID,
+	}, nil
+}
+
+type immichUploadResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // created or duplicate
+}
+
+type immichBulkCheckRequest struct {
+	Assets []immichBulkCheckAsset `json:"assets"`
+}
+
+type immichBulkCheckAsset struct {
+	ID       string `json:"id"`
+	Checksum string `json:"checksum"`
+}
+
+type immichBulkCheckResponse struct {
+	Results []struct {
+		ID      string `json:"id"`
+		Action  string `json:"action"` // accept or reject
+		Reason  string `json:"reason,omitempty"`
+		AssetID string `json:"assetId,omitempty"`
+	} `json:"results"`
+}
+
+type immichAsset struct {
+	ID       string `json:"id"`
+	Checksum string `json:"checksum"` // base64 sha1
+}
+
+func (b *immichBackend) Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (bool, error) {
+	attempt.Phase = db.PhaseNegotiate
+
+	// Immich deduplicates on the sha1 of the asset.
+	r, err := open()
+	if err != nil {
+		return false, err
+	}
+	summer := sha1.New()
+	_, err = io.Copy(summer, r)
+	r.Close()
+	if err != nil {
+		return false, err
+	}
+	checksum := summer.Sum(nil)
+
+	deviceAssetID := immichDeviceAssetID(meta)
+	dup, err := b.checkDuplicate(deviceAssetID, checksum, attempt)
+	if err != nil {
+		return false, err
+	}
+	if dup {
+		return true, nil
+	}
+
+	created := meta.Mtime
+	if meta.Capture != nil && meta.Capture.CaptureTime != nil {
+		created = *meta.Capture.CaptureTime
+	}
+	fields := [][2]string{
+		{"deviceAssetId", deviceAssetID},
+		{"deviceId", b.deviceID},
+		{"fileCreatedAt", created.UTC().Format(time.RFC3339Nano)},
+		{"fileModifiedAt", meta.Mtime.UTC().Format(time.RFC3339Nano)},
+	}
+	if meta.Capture != nil && meta.Capture.Duration > 0 {
+		fields = append(fields, [2]string{"duration", immichDuration(meta.Capture.Duration)})
+	}
+
+	attempt.Phase = db.PhaseTransfer
+	r, err = open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	// the file is read again to send it, and must still be what was
+	// checked for duplicates
+	vr := &verifyingReader{
+		r:     r,
+		h:     sha1.New(),
+		field: "sha1",
+		want:  hex.EncodeToString(checksum),
+		wantN: meta.Bytes,
+	}
+
+	body, contentType, size, err := multipartBody(fields, "assetData", meta.Name, meta.ContentType, vr, meta.Bytes)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", b.apiURL+"/assets", body)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = size
+	req.Header.Set("content-type", contentType)
+	req.Header.Set("x-immich-checksum", hex.EncodeToString(checksum))
+	b.prepare(req)
+
+	resp, err := b.client.Do(req)
+	attempt.BytesSent = vr.n
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	attempt.HTTPStatus = resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return false, newStatusError(resp)
+	}
+
+	var uploaded immichUploadResponse
+	err = json.NewDecoder(resp.Body).Decode(&uploaded)
+	if err != nil {
+		return false, fmt.Errorf("bad json response: %w", err)
+	}
+	if uploaded.Status == "duplicate" {
+		return true, nil
+	}
+
+	attempt.Phase = db.PhaseConfirm
+	return false, b.confirm(uploaded.ID, checksum, attempt)
+}
+
+// checkDuplicate asks the server whether it already has an asset
+// with checksum, so the file doesn't have to be sent.
+func (b *immichBackend) checkDuplicate(deviceAssetID string, checksum []byte, attempt *db.Attempt) (bool, error) {
+	reqBody, err := json.Marshal(immichBulkCheckRequest{
+		Assets: []immichBulkCheckAsset{
+			{ID: deviceAssetID, Checksum: hex.EncodeToString(checksum)},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", b.apiURL+"/assets/bulk-upload-check", bytes.NewReader(reqBody))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("content-type", "application/json")
+	b.prepare(req)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	attempt.HTTPStatus = resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK {
+		return false, newStatusError(resp)
+	}
+
+	var check immichBulkCheckResponse
+	err = json.NewDecoder(resp.Body).Decode(&check)
+	if err != nil {
+		return false, fmt.Errorf("bad json response: %w", err)
+	}
+	for _, res := range check.Results {
+		if res.ID == deviceAssetID && res.Action == "reject" && res.Reason == "duplicate" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// confirm fetches the asset the server created and compares its
+// checksum with what was sent.
+func (b *immichBackend) confirm(id string, checksum []byte, attempt *db.Attempt) error {
+	req, err := http.NewRequest("GET", b.apiURL+"/assets/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	b.prepare(req)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	attempt.HTTPStatus = resp.StatusCode
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &MismatchError{Field: "object", Want: id, Got: "not found"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	var asset immichAsset
+	err = json.NewDecoder(resp.Body).Decode(&asset)
+	if err != nil {
+		return fmt.Errorf("bad json response: %w", err)
+	}
+
+	want := base64.StdEncoding.EncodeToString(checksum)
+	if asset.Checksum != want {
+		return &MismatchError{Field: "sha1", Want: want, Got: asset.Checksum}
+	}
+	return nil
+}
+
+func (b *immichBackend) prepare(req *http.Request) {
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("x-api-key", b.apiKey)
+}
+
+// immichDeviceAssetID identifies a file on this device the way the
+// Immich mobile app does, by name and size.
+func immichDeviceAssetID(meta FileMetadata) string {
+	return fmt.Sprintf("%s-%d", meta.Name, meta.Bytes)
+}
+
+// immichDuration formats seconds as Immich's H:MM:SS.ffffff.
+func immichDuration(secs float64) string {
+	d := time.Duration(secs * float64(time.Second))
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := float64(d%time.Minute) / float64(time.Second)
+	return fmt.Sprintf("%d:%02d:%09.6f", h, m, s)
+}
+
+// multipartBody streams a multipart/form-data body with fields
+// followed by a single file part read from r, without buffering the
+// file. It returns the body, its content type and its total length.
+func multipartBody(fields [][2]string, fileField, fileName, contentType string, r io.Reader, size int64) (io.Reader, string, int64, error) {
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	for _, f := range fields {
+		err := mw.WriteField(f[0], f[1])
+		if err != nil {
+			return nil, "", 0, err
+		}
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(fileField), escapeQuotes(fileName)))
+	h.Set("Content-Type", contentType)
+	_, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	headLen := head.Len()
+
+	err = mw.Close()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	tail := append([]byte(nil), head.Bytes()[headLen:]...)
+	head.Truncate(headLen)
+
+	body := io.MultiReader(&head, r, bytes.NewReader(tail))
+	return body, mw.FormDataContentType(), int64(headLen) + size + int64(len(tail)), nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
@@ -0,0 +1,257 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/upload/mediameta"
+)
+
+// fakeImmich is a stand-in for the parts of the Immich asset API the
+// backend uses.
+type fakeImmich struct {
+	t *testing.T
+
+	// bulkAction and bulkReason answer bulk-upload-check.
+	bulkAction string
+	bulkReason string
+	// uploadStatus is the status of the upload response.
+	uploadStatus string
+	// checksum, if set, replaces the real checksum in the asset
+	// returned to confirm.
+	checksum string
+
+	form     map[string]string
+	file     []byte
+	uploads  int
+	confirms int
+}
+
+const immichTestKey = "test-api-key"
+
+func (s *fakeImmich) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get("x-api-key"); got != immichTestKey {
+		s.t.Errorf("%s %s x-api-key = %q, want %q", r.Method, r.URL.Path, got, immichTestKey)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/assets/bulk-upload-check":
+		var req immichBulkCheckRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || len(req.Assets) != 1 {
+			s.t.Errorf("bad bulk check request: %v %+v", err, req)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": []map[string]string{
+				{"id": req.Assets[0].ID, "action": s.bulkAction, "reason": s.bulkReason},
+			},
+		})
+
+	case r.Method == "POST" && r.URL.Path == "/api/assets":
+		s.uploads++
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			s.t.Errorf("parse upload form: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.form = make(map[string]string)
+		for k, v := range r.MultipartForm.Value {
+			s.form[k] = v[0]
+		}
+		f, _, err := r.FormFile("assetData")
+		if err != nil {
+			s.t.Errorf("upload has no assetData: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.file, _ = io.ReadAll(f)
+		f.Close()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(immichUploadResponse{ID: "asset-1", Status: s.uploadStatus})
+
+	case r.Method == "GET" && r.URL.Path == "/api/assets/asset-1":
+		s.confirms++
+		sum := sha1.Sum(s.file)
+		checksum := base64.StdEncoding.EncodeToString(sum[:])
+		if s.checksum != "" {
+			checksum = s.checksum
+		}
+		json.NewEncoder(w).Encode(immichAsset{ID: "asset-1", Checksum: checksum})
+
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var (
+	immichTestBody    = []byte("not really a jpeg")
+	immichTestMtime   = time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	immichTestCapture = time.Date(2019, 8, 17, 14, 30, 5, 0, time.UTC)
+)
+
+// runImmichUpload sends one file to s and returns what Upload did.
+func runImmichUpload(t *testing.T, s *fakeImmich) (bool, *db.Attempt, error) {
+	t.Helper()
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(immichTestBody)), nil
+	}
+	return runImmichUploadOpen(t, s, open)
+}
+
+// runImmichUploadOpen is runImmichUpload reading the file with open.
+func runImmichUploadOpen(t *testing.T, s *fakeImmich, open func() (io.ReadCloser, error)) (bool, *db.Attempt, error) {
+	t.Helper()
+	s.t = t
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	b := &immichBackend{
+		client:   srv.Client(),
+		apiURL:   srv.URL + "/api",
+		apiKey:   immichTestKey,
+		deviceID: "device-1",
+	}
+	captured := immichTestCapture
+	meta := FileMetadata{
+		ID:          "sha256-of-file",
+		Name:        "IMG_0001.jpg",
+		Mtime:       immichTestMtime,
+		Bytes:       int64(len(immichTestBody)),
+		ContentType: "image/jpeg",
+		Capture:     &mediameta.Metadata{CaptureTime: &captured},
+	}
+
+	var attempt db.Attempt
+	skipped, err := b.Upload(meta, open, nil, &attempt)
+	return skipped, &attempt, err
+}
+
+func TestImmichUpload(t *testing.T) {
+	s := &fakeImmich{bulkAction: "accept", uploadStatus: "created"}
+	skipped, attempt, err := runImmichUpload(t, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped {
+		t.Error("new asset reported as skipped")
+	}
+	if s.uploads != 1 || s.confirms != 1 {
+		t.Errorf("uploads=%d confirms=%d, want 1 and 1", s.uploads, s.confirms)
+	}
+	if attempt.HTTPStatus != http.StatusOK {
+		t.Errorf("attempt status = %d, want the confirm's 200", attempt.HTTPStatus)
+	}
+	if !bytes.Equal(s.file, immichTestBody) {
+		t.Errorf("server got file %q, want %q", s.file, immichTestBody)
+	}
+
+	for field, want := range map[string]string{
+		"deviceAssetId":  "IMG_0001.jpg-17",
+		"deviceId":       "device-1",
+		"fileCreatedAt":  immichTestCapture.Format(time.RFC3339Nano),
+		"fileModifiedAt": immichTestMtime.Format(time.RFC3339Nano),
+	} {
+		if got := s.form[field]; got != want {
+			t.Errorf("form field %s = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestImmichFileChangedBetweenReads(t *testing.T) {
+	s := &fakeImmich{bulkAction: "accept", uploadStatus: "created"}
+	changed := bytes.ToUpper(immichTestBody)
+	reads := 0
+	open := func() (io.ReadCloser, error) {
+		reads++
+		if reads > 1 {
+			return io.NopCloser(bytes.NewReader(changed)), nil
+		}
+		return io.NopCloser(bytes.NewReader(immichTestBody)), nil
+	}
+
+	skipped, _, err := runImmichUploadOpen(t, s, open)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Upload err = %v, want a *MismatchError", err)
+	}
+	if mismatch.Field != "sha1" {
+		t.Errorf("mismatch field = %q, want sha1", mismatch.Field)
+	}
+	if skipped {
+		t.Error("changed file reported as skipped")
+	}
+	if reads != 2 {
+		t.Errorf("file opened %d times, want 2", reads)
+	}
+	if s.confirms != 0 {
+		t.Errorf("changed file confirmed %d times", s.confirms)
+	}
+}
+
+func TestImmichSkipsDuplicates(t *testing.T) {
+	t.Run("bulk check", func(t *testing.T) {
+		s := &fakeImmich{bulkAction: "reject", bulkReason: "duplicate"}
+		skipped, _, err := runImmichUpload(t, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !skipped {
+			t.Error("duplicate from bulk check not reported as skipped")
+		}
+		if s.uploads != 0 {
+			t.Errorf("file uploaded %d times after bulk check found a duplicate", s.uploads)
+		}
+	})
+
+	t.Run("upload response", func(t *testing.T) {
+		s := &fakeImmich{bulkAction: "accept", uploadStatus: "duplicate"}
+		skipped, _, err := runImmichUpload(t, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !skipped {
+			t.Error("duplicate upload response not reported as skipped")
+		}
+		if s.confirms != 0 {
+			t.Errorf("duplicate confirmed %d times", s.confirms)
+		}
+	})
+}
+
+func TestImmichChecksumMismatch(t *testing.T) {
+	s := &fakeImmich{
+		bulkAction:   "accept",
+		uploadStatus: "created",
+		checksum:     base64.StdEncoding.EncodeToString(make([]byte, sha1.Size)),
+	}
+	skipped, attempt, err := runImmichUpload(t, s)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Upload err = %v, want a *MismatchError", err)
+	}
+	if mismatch.Field != "sha1" {
+		t.Errorf("mismatch field = %q, want sha1", mismatch.Field)
+	}
+	if skipped {
+		t.Error("mismatched upload reported as skipped")
+	}
+	if attempt.Phase != db.PhaseConfirm {
+		t.Errorf("attempt phase = %s, want %s", attempt.Phase, db.PhaseConfirm)
+	}
+}
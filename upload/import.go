@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"path/filepath"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+type ImportResult struct {
+	// Matched files had the same name, size and mtime as a server object.
+	Matched int
+	// Hashed files shared a name with a server object but differed in
+	// size or mtime, so they were hashed to decide.
+	Hashed int
+	// HashMatched is how many of the Hashed files turned out to be on
+	// the server.
+	HashMatched int
+	// Unmatched files are pending and have no server object by that name.
+	Unmatched int
+}
+
+// ImportInventory marks pending local files as uploaded if the server
+// already has them, so a fresh db doesn't re-hash and re-negotiate
+// every file. Only files whose name matches a server object but whose
+// size or mtime differ are hashed.
+func ImportInventory(store *db.DB) (*ImportResult, error) {
+	objs, err := FullInventory(store)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string][]InventoryObject)
+	byID := make(map[string]InventoryObject)
+	for _, obj := range objs {
+		name := filepath.Base(obj.Name)
+		byName[name] = append(byName[name], obj)
+		byID[obj.ID] = obj
+	}
+
+	fileInfos, dbFiles, err := ScanFiles(store)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ImportResult
+
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		dbFile := dbFiles[name]
+		if dbFile == nil || (dbFile.State != db.UploadPending && dbFile.State != db.UploadFailed && dbFile.State != db.UploadPreviewed) {
+			continue
+		}
+
+		candidates := byName[name]
+		if len(candidates) == 0 {
+			result.Unmatched++
+			continue
+		}
+
+		matched := false
+		for _, obj := range candidates {
+			if obj.Bytes == fi.Size() && sameMtime(obj.Mtime, fi.ModTime()) {
+				// The server copy may have been transformed, so only
+				// record its id, not a local hash.
+				err = store.SetUploaded(name, db.PrimaryDestinationID, obj.ID, obj.Bytes)
+				if err != nil {
+					return &result, err
+				}
+				matched = true
+				result.Matched++
+				break
+			}
+		}
+
+		if !matched {
+			result.Hashed++
+			localSum, err := hashFile(dbFile.Path)
+			if err != nil {
+				plog.Printf("import: hash %s err: %s", name, err)
+				continue
+			}
+			if _, ok := byID[localSum]; !ok {
+				continue
+			}
+			err = store.SetFileSHA256(name, localSum)
+			if err != nil {
+				return &result, err
+			}
+			result.HashMatched++
+		}
+
+		err = store.EndUpload(name, db.UploadSuccess)
+		if err != nil {
+			return &result, err
+		}
+	}
+
+	plog.Printf("import: server=%d matched=%d hashed=%d hash_matched=%d unmatched=%d",
+		len(objs), result.Matched, result.Hashed, result.HashMatched, result.Unmatched)
+
+	return &result, nil
+}
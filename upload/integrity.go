@@ -0,0 +1,106 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/jgo/power"
+	"github.com/psanford/android-media-backup/ui/plog"
+	"github.com/retailnext/unixtime"
+)
+
+var (
+	// integrityBytesPerPass and integrityFilesPerPass bound how much
+	// is re-read in one background run, so the full library is
+	// covered slowly over many runs.
+	integrityBytesPerPass int64 = 512 << 20
+	integrityFilesPerPass       = 200
+
+	// integrityPause is slept between files to keep the I/O gentle.
+	integrityPause = 250 * time.Millisecond
+)
+
+// CheckIntegrity re-hashes some local files and compares them with
+// the hash recorded when they were first read. A file whose contents
+// changed while its mtime and size did not is marked UploadCorrupt,
+// so it won't be uploaded over the good copy on the server. It only
+// runs while the device is charging or idle.
+func CheckIntegrity(store *db.DB) error {
+	charging, _ := power.Charging()
+	idle, _ := power.Idle()
+	if !charging && !idle {
+		plog.Printf("integrity check: device in use and not charging, skipping")
+		return nil
+	}
+
+	files, err := store.FilesToVerify(integrityFilesPerPass)
+	if err != nil {
+		return err
+	}
+
+	var (
+		budget  int64
+		checked int
+		corrupt int
+	)
+	for _, f := range files {
+		if budget >= integrityBytesPerPass {
+			break
+		}
+
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			// deleted files are handled by ScanFiles
+			continue
+		}
+
+		if !sameMtime(info.ModTime(), f.Created) || info.Size() != f.Size {
+			// the file was edited, which isn't corruption
+			store.MarkVerified(f.Name, time.Now())
+			continue
+		}
+
+		budget += f.Size
+		sum, err := hashFile(f.Path)
+		if err != nil {
+			plog.Printf("integrity check: hash err for=%s err=%s", f.Name, err)
+			continue
+		}
+
+		checked++
+		if sum != f.OriginalSHA256 {
+			corrupt++
+			plog.Printf("integrity check: %s changed without an mtime change, marking corrupt", f.Name)
+			store.SetFileState(f.Name, db.UploadCorrupt)
+		}
+		store.MarkVerified(f.Name, time.Now())
+
+		time.Sleep(integrityPause)
+	}
+
+	plog.Printf("integrity check: checked=%d corrupt=%d bytes=%d", checked, corrupt, budget)
+	return nil
+}
+
+func sameMtime(a, b time.Time) bool {
+	return unixtime.ToUnix(a, time.Millisecond) == unixtime.ToUnix(b, time.Millisecond)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	summer := sha256.New()
+	_, err = io.Copy(summer, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(summer.Sum(nil)), nil
+}
@@ -0,0 +1,211 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+var (
+	inventoryPath     = "inventory"
+	inventoryPageSize = 500
+	maxThumbnailBytes = int64(8 << 20)
+)
+
+// InventoryObject is one file the server holds for this device. ID is
+// the file's sha256, the same id used when it was uploaded.
+type InventoryObject struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Bytes       int64     `json:"size"`
+	Mtime       time.Time `json:"mtime"`
+	ContentType string    `json:"content_type"`
+	// ThumbnailURL is optional. It may be relative to the server URL.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// InventoryPage is the response to GET <url>/inventory. Objects are
+// sorted newest mtime first. NextCursor is empty on the last page.
+type InventoryPage struct {
+	Objects    []InventoryObject `json:"objects"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// ListInventory fetches one page of the server's inventory for this
+// device. Pass an empty cursor for the first page.
+func ListInventory(store *db.DB, cursor string, limit int) (*InventoryPage, error) {
+	serverURL, err := store.URL()
+	if err != nil {
+		return nil, err
+	}
+	deviceID, err := store.DeviceID()
+	if err != nil {
+		return nil, err
+	}
+
+	invURL, err := url.JoinPath(serverURL, inventoryPath)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(invURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("device", deviceID)
+	q.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(store, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, newStatusError(resp)
+	}
+
+	var page InventoryPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, fmt.Errorf("bad json response: %w", err)
+	}
+
+	return &page, nil
+}
+
+// FullInventory fetches every page of the server's inventory.
+func FullInventory(store *db.DB) ([]InventoryObject, error) {
+	caps := serverCapabilities(store)
+	if !caps.Has(FeatureInventory) {
+		return nil, errors.New("server does not support inventory")
+	}
+
+	var (
+		objs   []InventoryObject
+		cursor string
+	)
+	for {
+		page, err := ListInventory(store, cursor, inventoryPageSize)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, page.Objects...)
+		if page.NextCursor == "" {
+			return objs, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// BrowseInventory fetches one page of the inventory like ListInventory,
+// and caches it so the same page can be shown while offline. fromCache
+// is true if the server couldn't be reached and a cached copy was used.
+func BrowseInventory(store *db.DB, cursor string, limit int) (page *InventoryPage, fromCache bool, err error) {
+	cachePath := inventoryCachePath(store, cursor, limit)
+
+	page, err = ListInventory(store, cursor, limit)
+	if err == nil {
+		if cachePath != "" {
+			if data, jerr := json.Marshal(page); jerr == nil {
+				os.MkdirAll(filepath.Dir(cachePath), 0755)
+				os.WriteFile(cachePath, data, 0644)
+			}
+		}
+		return page, false, nil
+	}
+
+	var statusErr *StatusError
+	if cachePath == "" || errors.As(err, &statusErr) {
+		return nil, false, err
+	}
+
+	data, cacheErr := os.ReadFile(cachePath)
+	if cacheErr != nil {
+		return nil, false, err
+	}
+	var cached InventoryPage
+	if json.Unmarshal(data, &cached) != nil {
+		return nil, false, err
+	}
+	return &cached, true, nil
+}
+
+func inventoryCachePath(store *db.DB, cursor string, limit int) string {
+	if store.CacheDir() == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", cursor, limit)))
+	return filepath.Join(store.CacheDir(), "remote", "inventory-"+hex.EncodeToString(h[:8])+".json")
+}
+
+// ThumbnailFetcher returns a func that downloads obj's thumbnail, for
+// use with db.RemoteThumbnail. It returns nil if the server didn't
+// provide a thumbnail. Credentials are only sent if the thumbnail is
+// on the configured server's host.
+func ThumbnailFetcher(store *db.DB, obj InventoryObject) func() ([]byte, error) {
+	if obj.ThumbnailURL == "" {
+		return nil
+	}
+
+	return func() ([]byte, error) {
+		server, err := store.Destination(db.PrimaryDestinationID)
+		if err != nil {
+			return nil, err
+		}
+		base, err := url.Parse(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(obj.ThumbnailURL)
+		if err != nil {
+			return nil, err
+		}
+		thumbURL := base.ResolveReference(ref)
+
+		req, err := http.NewRequest("GET", thumbURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// only send credentials to the server itself
+		var resp *http.Response
+		if thumbURL.Host == base.Host {
+			resp, err = doServerRequest(store, server, req)
+		} else {
+			var client *http.Client
+			client, err = httpClient(server)
+			if err == nil {
+				resp, err = client.Do(req)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return nil, newStatusError(resp)
+		}
+
+		return io.ReadAll(io.LimitReader(resp.Body, maxThumbnailBytes))
+	}
+}
@@ -0,0 +1,180 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// localBackend copies files into a directory, such as an SD card, a
+// USB drive or a mounted share. Files are laid out as YYYY/MM/name by
+// capture time, written under a temporary name, checked against their
+// hash and then renamed into place.
+type localBackend struct {
+	dir string
+}
+
+func newLocalBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	dir, err := localDir(dest.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &localBackend{dir: dir}, nil
+}
+
+// localDir accepts either a plain path or a file:// url.
+func localDir(raw string) (string, error) {
+	if strings.HasPrefix(raw, "file:") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return "", err
+		}
+		raw = u.Path
+	}
+	if raw == "" || !filepath.IsAbs(raw) {
+		return "", fmt.Errorf("local destination needs an absolute directory, not %q", raw)
+	}
+	return filepath.Clean(raw), nil
+}
+
+func (b *localBackend) Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (bool, error) {
+	attempt.Phase = db.PhaseNegotiate
+
+	// a missing root usually means the card or drive isn't mounted
+	if _, err := os.Stat(b.dir); err != nil {
+		return false, &UnavailableError{Err: err}
+	}
+
+	dst, exists, err := b.target(meta)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return true, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	attempt.Phase = db.PhaseTransfer
+	r, err := open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	tmpName := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(tmpName)
+		}
+	}()
+
+	summer := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, summer), r)
+	attempt.BytesSent = n
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if n != meta.Bytes {
+		return false, &MismatchError{Field: "size", Want: fmt.Sprint(meta.Bytes), Got: fmt.Sprint(n)}
+	}
+	if sum := hex.EncodeToString(summer.Sum(nil)); sum != meta.ID {
+		return false, &MismatchError{Field: "sha256", Want: meta.ID, Got: sum}
+	}
+
+	err = os.Chtimes(tmpName, meta.Mtime, meta.Mtime)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmpName, dst)
+	if err != nil {
+		return false, err
+	}
+	committed = true
+
+	// read back what landed on the disk, not what we wrote
+	attempt.Phase = db.PhaseConfirm
+	sum, err := hashFile(dst)
+	if err != nil {
+		return false, err
+	}
+	if sum != meta.ID {
+		os.Remove(dst)
+		return false, &MismatchError{Field: "sha256", Want: meta.ID, Got: sum}
+	}
+
+	return false, nil
+}
+
+// target returns where meta should be written, and whether an
+// identical copy is already there. A different file with the same
+// name gets the start of its hash appended.
+func (b *localBackend) target(meta FileMetadata) (string, bool, error) {
+	ts := meta.Mtime
+	if meta.Capture != nil && meta.Capture.CaptureTime != nil {
+		ts = *meta.Capture.CaptureTime
+	}
+	dir := filepath.Join(b.dir, ts.Format("2006"), ts.Format("01"))
+
+	name := storedName(meta)
+	ext := filepath.Ext(name)
+	candidates := []string{
+		filepath.Join(dir, name),
+		filepath.Join(dir, strings.TrimSuffix(name, ext)+"-"+meta.ID[:12]+ext),
+	}
+	for _, path := range candidates {
+		fi, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if fi.Size() != meta.Bytes {
+			continue
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return "", false, err
+		}
+		if sum == meta.ID {
+			return path, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("%s and %s both exist with other contents", candidates[0], candidates[1])
+}
+
+// storedName is the file name meta is kept under at destinations that
+// store plain files. Derivatives sit next to the original as
+// name.preview.jpg.
+func storedName(meta FileMetadata) string {
+	name := filepath.Base(meta.Name)
+	if meta.Derivative != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "." + string(meta.Derivative) + ".jpg"
+	}
+	return name
+}
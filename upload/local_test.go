@@ -0,0 +1,222 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/upload/mediameta"
+)
+
+var (
+	localTestMtime   = time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	localTestCapture = time.Date(2019, 8, 17, 14, 30, 5, 0, time.UTC)
+)
+
+func localTestMeta(body []byte) FileMetadata {
+	sum := sha256.Sum256(body)
+	captured := localTestCapture
+	return FileMetadata{
+		ID:          hex.EncodeToString(sum[:]),
+		Name:        "IMG_0001.jpg",
+		Mtime:       localTestMtime,
+		Bytes:       int64(len(body)),
+		ContentType: "image/jpeg",
+		Capture:     &mediameta.Metadata{CaptureTime: &captured},
+	}
+}
+
+// checkReader calls check once, before handing out the first byte of
+// r.
+type checkReader struct {
+	r       io.Reader
+	check   func()
+	checked bool
+}
+
+func (c *checkReader) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		c.check()
+	}
+	return c.r.Read(p)
+}
+
+// localFiles lists the regular files under dir, relative to it.
+func localFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestLocalUpload(t *testing.T) {
+	dir := t.TempDir()
+	b := &localBackend{dir: dir}
+	body := []byte("not really a jpeg")
+	meta := localTestMeta(body)
+	dst := filepath.Join(dir, "2019", "08", "IMG_0001.jpg")
+
+	open := func() (io.ReadCloser, error) {
+		r := &checkReader{r: bytes.NewReader(body), check: func() {
+			// the file is written under a temporary name first
+			if _, err := os.Stat(dst); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s exists before the copy finished: %v", dst, err)
+			}
+			files := localFiles(t, dir)
+			if len(files) != 1 || !strings.HasPrefix(files[0], "2019/08/.IMG_0001.jpg.tmp-") {
+				t.Errorf("files during the copy = %q, want one temporary file", files)
+			}
+		}}
+		return io.NopCloser(r), nil
+	}
+
+	var attempt db.Attempt
+	skipped, err := b.Upload(meta, open, nil, &attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped {
+		t.Error("new file reported as skipped")
+	}
+	if attempt.Phase != db.PhaseConfirm || attempt.BytesSent != meta.Bytes {
+		t.Errorf("attempt phase=%s bytes=%d, want %s and %d", attempt.Phase, attempt.BytesSent, db.PhaseConfirm, meta.Bytes)
+	}
+
+	// laid out by capture time, not mtime
+	if files := localFiles(t, dir); len(files) != 1 || files[0] != "2019/08/IMG_0001.jpg" {
+		t.Fatalf("files = %q, want only 2019/08/IMG_0001.jpg", files)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("stored %q, want %q", got, body)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(localTestMtime) {
+		t.Errorf("stored mtime %s, want %s", fi.ModTime(), localTestMtime)
+	}
+
+	// sending the same file again finds the copy
+	opens := 0
+	again := func() (io.ReadCloser, error) {
+		opens++
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	skipped, err = b.Upload(meta, again, nil, &db.Attempt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !skipped {
+		t.Error("identical file not reported as skipped")
+	}
+	if opens != 0 {
+		t.Errorf("identical file read %d times", opens)
+	}
+}
+
+func TestLocalUploadNameClash(t *testing.T) {
+	dir := t.TempDir()
+	b := &localBackend{dir: dir}
+	monthDir := filepath.Join(dir, "2019", "08")
+	err := os.MkdirAll(monthDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(monthDir, "IMG_0001.jpg"), []byte("another photo"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("not really a jpeg")
+	meta := localTestMeta(body)
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	_, err = b.Upload(meta, open, nil, &db.Attempt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "2019/08/IMG_0001-" + meta.ID[:12] + ".jpg"
+	files := localFiles(t, dir)
+	if len(files) != 2 || files[0] != want {
+		t.Errorf("files = %q, want the original and %s", files, want)
+	}
+}
+
+func TestLocalUploadMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		sent  []byte
+		field string
+	}{
+		{"changed", []byte("NOT REALLY A JPEG"), "sha256"},
+		{"truncated", []byte("not really"), "size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := &localBackend{dir: dir}
+			meta := localTestMeta([]byte("not really a jpeg"))
+			open := func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(tc.sent)), nil
+			}
+
+			skipped, err := b.Upload(meta, open, nil, &db.Attempt{})
+			var mismatch *MismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("Upload err = %v, want a *MismatchError", err)
+			}
+			if mismatch.Field != tc.field {
+				t.Errorf("mismatch field = %q, want %s", mismatch.Field, tc.field)
+			}
+			if skipped {
+				t.Error("mismatched file reported as skipped")
+			}
+			if files := localFiles(t, dir); len(files) != 0 {
+				t.Errorf("files left after a mismatch: %q", files)
+			}
+		})
+	}
+}
+
+func TestStoredName(t *testing.T) {
+	for _, tc := range []struct {
+		meta FileMetadata
+		want string
+	}{
+		{FileMetadata{Name: "IMG_0001.jpg"}, "IMG_0001.jpg"},
+		{FileMetadata{Name: "sub/VID_0002.mp4"}, "VID_0002.mp4"},
+		{FileMetadata{Name: "VID_0002.mp4", Derivative: DerivativePreview}, "VID_0002.preview.jpg"},
+	} {
+		if got := storedName(tc.meta); got != tc.want {
+			t.Errorf("storedName(%q, %q) = %q, want %q", tc.meta.Name, tc.meta.Derivative, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package mediameta
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	// mp4 times count seconds from 1904-01-01 UTC
+	mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	iso6709Re = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+	heifBrands = map[string]bool{
+		"heic": true,
+		"heix": true,
+		"heim": true,
+		"heis": true,
+		"mif1": true,
+		"msf1": true,
+		"avif": true,
+	}
+)
+
+type box struct {
+	typ string
+	// offset and size of the box body, after the header
+	off  int64
+	size int64
+}
+
+// readBoxes lists the boxes in r between off and end.
+func readBoxes(r io.ReaderAt, off, end int64) ([]box, error) {
+	var boxes []box
+	hdr := make([]byte, 16)
+	for off+8 <= end {
+		_, err := r.ReadAt(hdr[:8], off)
+		if err != nil {
+			return boxes, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:8])
+		hdrLen := int64(8)
+
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			_, err := r.ReadAt(hdr[8:16], off+8)
+			if err != nil {
+				return boxes, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hdrLen = 16
+		}
+		if size < hdrLen || off+size > end {
+			return boxes, errors.New("bad box size")
+		}
+
+		boxes = append(boxes, box{typ: typ, off: off + hdrLen, size: size - hdrLen})
+		off += size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+func readBody(r io.ReaderAt, b box, max int64) ([]byte, error) {
+	if b.size > max {
+		return nil, errors.New("box too large")
+	}
+	buf := make([]byte, b.size)
+	_, err := r.ReadAt(buf, b.off)
+	return buf, err
+}
+
+func parseISOBMFF(r io.ReaderAt, size int64, brand string, m *Metadata) error {
+	top, err := readBoxes(r, 0, size)
+	if len(top) == 0 {
+		return err
+	}
+
+	if heifBrands[brand] {
+		return parseHEIF(r, top, m)
+	}
+	return parseMP4(r, top, m)
+}
+
+// parseHEIF finds the Exif item through the meta box's item info
+// (iinf) and item location (iloc) tables.
+func parseHEIF(r io.ReaderAt, top []box, m *Metadata) error {
+	meta, ok := findBox(top, "meta")
+	if !ok {
+		return nil
+	}
+	// meta is a full box: skip version and flags
+	children, _ := readBoxes(r, meta.off+4, meta.off+meta.size)
+
+	iinf, ok := findBox(children, "iinf")
+	if !ok {
+		return nil
+	}
+	iinfData, err := readBody(r, iinf, maxTagBytes)
+	if err != nil {
+		return err
+	}
+	if len(iinfData) < 1 {
+		return nil
+	}
+	countLen := int64(2)
+	if iinfData[0] != 0 {
+		countLen = 4
+	}
+	entries, _ := readBoxes(r, iinf.off+4+countLen, iinf.off+iinf.size)
+
+	var exifID uint32
+	for _, e := range entries {
+		if e.typ != "infe" {
+			continue
+		}
+		infe, err := readBody(r, e, 1024)
+		if err != nil || len(infe) < 4 || infe[0] < 2 {
+			continue
+		}
+		var (
+			id  uint32
+			typ string
+		)
+		if infe[0] == 2 && len(infe) >= 12 {
+			id = uint32(binary.BigEndian.Uint16(infe[4:]))
+			typ = string(infe[8:12])
+		} else if len(infe) >= 14 {
+			id = binary.BigEndian.Uint32(infe[4:])
+			typ = string(infe[10:14])
+		}
+		if typ == "Exif" {
+			exifID = id
+			break
+		}
+	}
+	if exifID == 0 {
+		return nil
+	}
+
+	iloc, ok := findBox(children, "iloc")
+	if !ok {
+		return nil
+	}
+	ilocData, err := readBody(r, iloc, maxTagBytes)
+	if err != nil {
+		return err
+	}
+	off, length, ok := ilocExtent(ilocData, exifID)
+	if !ok || length < 8 || length > maxTagBytes {
+		return nil
+	}
+
+	exif := make([]byte, length)
+	_, err = r.ReadAt(exif, off)
+	if err != nil {
+		return err
+	}
+	// the Exif item starts with the offset to the TIFF header
+	tiffOff := int64(binary.BigEndian.Uint32(exif)) + 4
+	if tiffOff >= length {
+		return nil
+	}
+	return parseTIFF(io.NewSectionReader(r, off+tiffOff, length-tiffOff), m)
+}
+
+// ilocExtent returns the file offset and length of the first extent
+// of item id.
+func ilocExtent(data []byte, id uint32) (int64, int64, bool) {
+	p := &byteParser{data: data}
+	version := p.u8()
+	p.skip(3)
+	sizes := p.u8()
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = p.u8()
+	baseSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+
+	var count uint32
+	if version < 2 {
+		count = uint32(p.uint(2))
+	} else {
+		count = uint32(p.uint(4))
+	}
+
+	for i := uint32(0); i < count && !p.err; i++ {
+		var itemID uint32
+		if version < 2 {
+			itemID = uint32(p.uint(2))
+		} else {
+			itemID = uint32(p.uint(4))
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = p.uint(2) & 0xf
+		}
+		p.skip(2) // data reference index
+		base := p.uint(baseSize)
+		extents := int(p.uint(2))
+
+		for j := 0; j < extents && !p.err; j++ {
+			p.skip(indexSize)
+			extOff := p.uint(offsetSize)
+			extLen := p.uint(lengthSize)
+			if itemID == id && j == 0 && method == 0 && !p.err {
+				return int64(base + extOff), int64(extLen), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func parseMP4(r io.ReaderAt, top []box, m *Metadata) error {
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return nil
+	}
+	children, _ := readBoxes(r, moov.off, moov.off+moov.size)
+
+	if mvhd, ok := findBox(children, "mvhd"); ok {
+		data, err := readBody(r, mvhd, 1024)
+		if err == nil {
+			parseMVHD(data, m)
+		}
+	}
+
+	for _, b := range children {
+		switch b.typ {
+		case "trak":
+			if m.Width != 0 {
+				continue
+			}
+			trak, _ := readBoxes(r, b.off, b.off+b.size)
+			if tkhd, ok := findBox(trak, "tkhd"); ok {
+				data, err := readBody(r, tkhd, 1024)
+				if err == nil {
+					parseTKHD(data, m)
+				}
+			}
+		case "udta":
+			udta, _ := readBoxes(r, b.off, b.off+b.size)
+			if xyz, ok := findBox(udta, "\xa9xyz"); ok {
+				data, err := readBody(r, xyz, 1024)
+				if err == nil && len(data) > 4 {
+					// 2 byte length, 2 byte language, then ISO 6709
+					m.GPS = parseISO6709(string(data[4:]))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parseMVHD(data []byte, m *Metadata) {
+	p := &byteParser{data: data}
+	version := p.u8()
+	p.skip(3)
+
+	var created, timescale, duration uint64
+	if version == 1 {
+		created = p.uint(8)
+		p.skip(8)
+		timescale = p.uint(4)
+		duration = p.uint(8)
+	} else {
+		created = p.uint(4)
+		p.skip(4)
+		timescale = p.uint(4)
+		duration = p.uint(4)
+	}
+	if p.err {
+		return
+	}
+
+	if created != 0 {
+		ts := mp4Epoch.Add(time.Duration(created) * time.Second)
+		m.CaptureTime = &ts
+	}
+	if timescale != 0 {
+		m.Duration = float64(duration) / float64(timescale)
+	}
+}
+
+func parseTKHD(data []byte, m *Metadata) {
+	p := &byteParser{data: data}
+	version := p.u8()
+	p.skip(3)
+	if version == 1 {
+		p.skip(8 + 8 + 4 + 4 + 8)
+	} else {
+		p.skip(4 + 4 + 4 + 4 + 4)
+	}
+	p.skip(8 + 2 + 2 + 2 + 2)
+
+	var matrix [9]int32
+	for i := range matrix {
+		matrix[i] = int32(p.uint(4))
+	}
+	width := p.uint(4) >> 16
+	height := p.uint(4) >> 16
+	if p.err || width == 0 || height == 0 {
+		return
+	}
+
+	m.Width = int(width)
+	m.Height = int(height)
+
+	const one = 1 << 16
+	switch {
+	case matrix[0] == 0 && matrix[1] == one:
+		m.Orientation = 6 // rotate 90
+	case matrix[0] == -one && matrix[1] == 0:
+		m.Orientation = 3 // rotate 180
+	case matrix[0] == 0 && matrix[1] == -one:
+		m.Orientation = 8 // rotate 270
+	default:
+		m.Orientation = 1
+	}
+}
+
+func parseISO6709(s string) *GPS {
+	match := iso6709Re.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	lat, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return nil
+	}
+	lon, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return nil
+	}
+	gps := GPS{Latitude: lat, Longitude: lon}
+	if match[3] != "" {
+		if alt, err := strconv.ParseFloat(match[3], 64); err == nil {
+			gps.Altitude = &alt
+		}
+	}
+	return &gps
+}
+
+// byteParser reads big endian fields, recording rather than returning
+// out of bounds reads.
+type byteParser struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+func (p *byteParser) skip(n int) {
+	p.pos += n
+	if p.pos > len(p.data) {
+		p.err = true
+	}
+}
+
+func (p *byteParser) u8() byte {
+	return byte(p.uint(1))
+}
+
+func (p *byteParser) uint(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if p.pos+n > len(p.data) {
+		p.err = true
+		p.pos = len(p.data)
+		return 0
+	}
+	var v uint64
+	for _, b := range p.data[p.pos : p.pos+n] {
+		v = v<<8 | uint64(b)
+	}
+	p.pos += n
+	return v
+}
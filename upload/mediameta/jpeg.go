@@ -0,0 +1,78 @@
+package mediameta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// parseJPEG walks the JPEG markers up to the first frame header,
+// reading the EXIF and XMP APP1 segments along the way.
+func parseJPEG(r io.ReaderAt, size int64, m *Metadata) error {
+	off := int64(2)
+	hdr := make([]byte, 4)
+	for off+4 <= size {
+		_, err := r.ReadAt(hdr, off)
+		if err != nil {
+			return err
+		}
+		if hdr[0] != 0xff {
+			return errors.New("bad jpeg marker")
+		}
+		marker := hdr[1]
+		if marker == 0xff {
+			// fill byte
+			off++
+			continue
+		}
+		if marker == 0xd8 || (marker >= 0xd0 && marker <= 0xd7) {
+			off += 2
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			// end of image or start of scan, no more metadata
+			return nil
+		}
+
+		segLen := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if segLen < 2 {
+			return errors.New("bad jpeg segment length")
+		}
+		body := io.NewSectionReader(r, off+4, segLen-2)
+
+		switch {
+		case marker == 0xe1:
+			data := make([]byte, segLen-2)
+			_, err := io.ReadFull(body, data)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(data, exifHeader) {
+				err = parseTIFF(bytes.NewReader(data[len(exifHeader):]), m)
+				if err != nil {
+					return err
+				}
+			} else if bytes.HasPrefix(data, xmpHeader) {
+				parseXMP(data[len(xmpHeader):], m)
+			}
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			// start of frame: precision(1) height(2) width(2)
+			sof := make([]byte, 5)
+			_, err := io.ReadFull(body, sof)
+			if err == nil && (m.Width == 0 || m.Height == 0) {
+				m.Height = int(binary.BigEndian.Uint16(sof[1:]))
+				m.Width = int(binary.BigEndian.Uint16(sof[3:]))
+			}
+			return nil
+		}
+
+		off += 2 + segLen
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Package mediameta reads capture metadata (EXIF, XMP and MP4/MOV
+// headers) from photos and videos without decoding them.
+package mediameta
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrUnknownFormat = errors.New("unknown media format")
+
+// Metadata is the capture information found in a file. Fields the
+// file doesn't carry are left empty.
+type Metadata struct {
+	// CaptureTime is when the photo or video was taken. EXIF times
+	// without an offset are assumed to be in the device's time zone.
+	CaptureTime *time.Time `json:"capture_time,omitempty"`
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	// Orientation is the EXIF orientation (1-8). For videos it is
+	// derived from the track rotation.
+	Orientation int  `json:"orientation,omitempty"`
+	GPS         *GPS `json:"gps,omitempty"`
+	// Duration of a video, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Read parses the metadata in the file at path. It returns
+// ErrUnknownFormat for files that aren't JPEG, TIFF/DNG, HEIF or
+// MP4/MOV.
+func Read(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(f, fi.Size())
+}
+
+// Parse reads metadata from r, which holds size bytes.
+func Parse(r io.ReaderAt, size int64) (*Metadata, error) {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	var m Metadata
+	var err error
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8}):
+		err = parseJPEG(r, size, &m)
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		err = parseTIFF(io.NewSectionReader(r, 0, size), &m)
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		err = parseISOBMFF(r, size, string(head[8:12]), &m)
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,260 @@
+package mediameta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	tagImageWidth   = 0x0100
+	tagImageLength  = 0x0101
+	tagMake         = 0x010f
+	tagModel        = 0x0110
+	tagOrientation  = 0x0112
+	tagDateTime     = 0x0132
+	tagExifIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagDateOriginal = 0x9003
+	tagOffsetOrig   = 0x9011
+	tagPixelX       = 0xa002
+	tagPixelY       = 0xa003
+
+	tagGPSLatRef = 0x0001
+	tagGPSLat    = 0x0002
+	tagGPSLonRef = 0x0003
+	tagGPSLon    = 0x0004
+	tagGPSAltRef = 0x0005
+	tagGPSAlt    = 0x0006
+
+	maxIFDEntries = 1000
+	maxTagBytes   = 64 << 10
+)
+
+// sizes of the TIFF field types, indexed by type
+var tiffTypeSize = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+	bo    binary.ByteOrder
+}
+
+func (e tiffEntry) str() string {
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (e tiffEntry) uint(i int) (uint32, bool) {
+	switch e.typ {
+	case 1, 7:
+		if i < len(e.data) {
+			return uint32(e.data[i]), true
+		}
+	case 3:
+		if 2*i+2 <= len(e.data) {
+			return uint32(e.bo.Uint16(e.data[2*i:])), true
+		}
+	case 4, 9:
+		if 4*i+4 <= len(e.data) {
+			return e.bo.Uint32(e.data[4*i:]), true
+		}
+	}
+	return 0, false
+}
+
+func (e tiffEntry) rational(i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || 8*i+8 > len(e.data) {
+		return 0, false
+	}
+	num := e.bo.Uint32(e.data[8*i:])
+	den := e.bo.Uint32(e.data[8*i+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+type tiffReader struct {
+	r  io.ReaderAt
+	bo binary.ByteOrder
+}
+
+func (t *tiffReader) readIFD(off uint32) (map[uint16]tiffEntry, error) {
+	buf := make([]byte, 2)
+	_, err := t.r.ReadAt(buf, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	n := int(t.bo.Uint16(buf))
+	if n > maxIFDEntries {
+		return nil, fmt.Errorf("too many ifd entries: %d", n)
+	}
+
+	raw := make([]byte, n*12)
+	_, err = t.r.ReadAt(raw, int64(off)+2)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[uint16]tiffEntry, n)
+	for i := 0; i < n; i++ {
+		ent := raw[i*12 : i*12+12]
+		e := tiffEntry{
+			typ:   t.bo.Uint16(ent[2:]),
+			count: t.bo.Uint32(ent[4:]),
+			bo:    t.bo,
+		}
+		if int(e.typ) >= len(tiffTypeSize) || e.typ == 0 {
+			continue
+		}
+		size := int64(tiffTypeSize[e.typ]) * int64(e.count)
+		if size > maxTagBytes {
+			continue
+		}
+		if size <= 4 {
+			e.data = ent[8 : 8+size]
+		} else {
+			e.data = make([]byte, size)
+			_, err := t.r.ReadAt(e.data, int64(t.bo.Uint32(ent[8:])))
+			if err != nil {
+				continue
+			}
+		}
+		entries[t.bo.Uint16(ent)] = e
+	}
+	return entries, nil
+}
+
+// parseTIFF reads EXIF data from a TIFF structure, which is either a
+// whole TIFF/DNG file or the payload of a JPEG or HEIF Exif block.
+func parseTIFF(r io.ReaderAt, m *Metadata) error {
+	hdr := make([]byte, 8)
+	_, err := r.ReadAt(hdr, 0)
+	if err != nil {
+		return err
+	}
+
+	t := tiffReader{r: r}
+	switch string(hdr[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return errors.New("bad tiff byte order")
+	}
+
+	ifd0, err := t.readIFD(t.bo.Uint32(hdr[4:]))
+	if err != nil {
+		return err
+	}
+
+	if e, ok := ifd0[tagMake]; ok {
+		m.Make = e.str()
+	}
+	if e, ok := ifd0[tagModel]; ok {
+		m.Model = e.str()
+	}
+	if v, ok := ifd0[tagOrientation].uint(0); ok {
+		m.Orientation = int(v)
+	}
+	if v, ok := ifd0[tagImageWidth].uint(0); ok {
+		m.Width = int(v)
+	}
+	if v, ok := ifd0[tagImageLength].uint(0); ok {
+		m.Height = int(v)
+	}
+
+	dateTime := ifd0[tagDateTime].str()
+	var offset string
+
+	if off, ok := ifd0[tagExifIFD].uint(0); ok {
+		exif, err := t.readIFD(off)
+		if err == nil {
+			if s := exif[tagDateOriginal].str(); s != "" {
+				dateTime = s
+			}
+			offset = exif[tagOffsetOrig].str()
+			if v, ok := exif[tagPixelX].uint(0); ok && v > 0 {
+				m.Width = int(v)
+			}
+			if v, ok := exif[tagPixelY].uint(0); ok && v > 0 {
+				m.Height = int(v)
+			}
+		}
+	}
+
+	if ts, ok := parseExifTime(dateTime, offset); ok {
+		m.CaptureTime = &ts
+	}
+
+	if off, ok := ifd0[tagGPSIFD].uint(0); ok {
+		gps, err := t.readIFD(off)
+		if err == nil {
+			m.GPS = parseGPS(gps)
+		}
+	}
+
+	return nil
+}
+
+func parseExifTime(dateTime, offset string) (time.Time, bool) {
+	if dateTime == "" || strings.HasPrefix(dateTime, "0000") {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		ts, err := time.Parse("2006:01:02 15:04:05-07:00", dateTime+offset)
+		if err == nil {
+			return ts, true
+		}
+	}
+	ts, err := time.ParseInLocation("2006:01:02 15:04:05", dateTime, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+func parseGPS(ifd map[uint16]tiffEntry) *GPS {
+	lat, ok := dms(ifd[tagGPSLat])
+	if !ok {
+		return nil
+	}
+	lon, ok := dms(ifd[tagGPSLon])
+	if !ok {
+		return nil
+	}
+	if strings.HasPrefix(ifd[tagGPSLatRef].str(), "S") {
+		lat = -lat
+	}
+	if strings.HasPrefix(ifd[tagGPSLonRef].str(), "W") {
+		lon = -lon
+	}
+
+	gps := GPS{Latitude: lat, Longitude: lon}
+	if alt, ok := ifd[tagGPSAlt].rational(0); ok {
+		if ref, _ := ifd[tagGPSAltRef].uint(0); ref == 1 {
+			alt = -alt
+		}
+		gps.Altitude = &alt
+	}
+	return &gps
+}
+
+// dms converts a degrees, minutes, seconds rational triple to degrees.
+func dms(e tiffEntry) (float64, bool) {
+	d, ok1 := e.rational(0)
+	m, ok2 := e.rational(1)
+	s, ok3 := e.rational(2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	return d + m/60 + s/3600, true
+}
@@ -0,0 +1,34 @@
+package mediameta
+
+import (
+	"regexp"
+	"time"
+)
+
+var xmpDateRe = regexp.MustCompile(`(?:exif:DateTimeOriginal|xmp:CreateDate|photoshop:DateCreated)(?:="|>)([^"<]+)`)
+
+// parseXMP fills in the capture time from an XMP packet if EXIF
+// didn't have one.
+func parseXMP(data []byte, m *Metadata) {
+	if m.CaptureTime != nil {
+		return
+	}
+	match := xmpDateRe.FindSubmatch(data)
+	if match == nil {
+		return
+	}
+	s := string(match[1])
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"} {
+		if ts, err := time.Parse(layout, s); err == nil {
+			m.CaptureTime = &ts
+			return
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if ts, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			m.CaptureTime = &ts
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+type Derivative string
+
+var (
+	DerivativePreview Derivative = "preview" // reduced resolution JPEG, sent over mobile data
+)
+
+// previewTransform replaces an image with a reduced resolution JPEG.
+// It isn't part of the user's transform chain: previews are uploaded
+// as their own derivative object.
+type previewTransform struct {
+	maxSize int
+	quality int
+}
+
+func (previewTransform) Name() Transform {
+	return TransformPreview
+}
+
+func (previewTransform) Applies(store *db.DB, path string, meta FileMetadata) (bool, error) {
+	return previewable(meta.ContentType), nil
+}
+
+func (t previewTransform) Wrap(r io.Reader, meta *FileMetadata) (io.Reader, error) {
+	meta.ContentType = "image/jpeg"
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.EncodePreview(pw, r, t.maxSize, t.quality))
+	}()
+	return pr, nil
+}
+
+// OutputSize is unknown until the image has been encoded.
+func (previewTransform) OutputSize(size int64) int64 {
+	return -1
+}
+
+func previewable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// previewableFile sniffs the file at path to see if a preview can be
+// made from it.
+func previewableFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	return previewable(http.DetectContentType(header[:n]))
+}
+
+func newPreviewPipeline(store *db.DB) (*pipeline, error) {
+	size, err := store.PreviewSize()
+	if err != nil {
+		return nil, err
+	}
+	quality, err := store.PreviewQuality()
+	if err != nil {
+		return nil, err
+	}
+	return &pipeline{
+		stages: []Transformer{previewTransform{maxSize: size, quality: quality}},
+	}, nil
+}
@@ -0,0 +1,200 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+	"github.com/psanford/android-media-backup/upload/restic"
+)
+
+// resticBackend adds files to an existing restic repository, either a
+// local path or a rest: url. The destination's password is the
+// repository password. Each run that sends anything ends with one
+// snapshot of the camera directory, with the device name as its host
+// and tag.
+type resticBackend struct {
+	store    *db.DB
+	dest     db.Destination
+	hostname string
+
+	repo   *restic.Repo
+	backup *restic.Backup
+	// sent holds the files added this run, which go back to pending
+	// if the snapshot can't be written.
+	sent []string
+}
+
+func newResticBackend(store *db.DB, dest db.Destination) (Backend, error) {
+	if dest.Password == "" {
+		return nil, fmt.Errorf("restic destination %s needs the repository password", dest.Name)
+	}
+	hostname, err := store.DeviceName()
+	if err != nil {
+		return nil, err
+	}
+	return &resticBackend{
+		store:    store,
+		dest:     dest,
+		hostname: hostname,
+	}, nil
+}
+
+// open unlocks the repository on first use, since that costs a key
+// derivation and reading the whole index.
+func (b *resticBackend) open() error {
+	if b.backup != nil {
+		return nil
+	}
+
+	client, err := httpClient(&b.dest)
+	if err != nil {
+		return err
+	}
+
+	repo, err := restic.Open(b.dest.URL, b.dest.Password, b.hostname, client)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, restic.ErrLocked) || errors.As(err, &netErr) {
+			return &UnavailableError{Err: err}
+		}
+		return err
+	}
+
+	backup, err := repo.NewBackup(mediaPath, []string{b.hostname})
+	if err != nil {
+		repo.Close()
+		return err
+	}
+	b.repo = repo
+	b.backup = backup
+	return nil
+}
+
+func (b *resticBackend) Upload(meta FileMetadata, open func() (io.ReadCloser, error), md5sum []byte, attempt *db.Attempt) (bool, error) {
+	attempt.Phase = db.PhaseNegotiate
+	err := b.open()
+	if err != nil {
+		return false, err
+	}
+
+	attempt.Phase = db.PhaseTransfer
+	r, err := open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	vr := &verifyingReader{
+		r:     r,
+		h:     sha256.New(),
+		want:  meta.ID,
+		wantN: meta.Bytes,
+	}
+	name := storedName(meta)
+	unchanged, err := b.backup.Add(name, meta.Mtime, vr)
+	attempt.BytesSent = vr.n
+	if err != nil {
+		return false, err
+	}
+	if unchanged {
+		return true, nil
+	}
+
+	b.sent = append(b.sent, meta.Name)
+	return false, nil
+}
+
+// Finish writes this run's snapshot, then requeues files recorded as
+// backed up that the snapshot doesn't have, such as ones sent by a
+// run that was killed before it could write its snapshot.
+func (b *resticBackend) Finish() error {
+	if b.repo == nil {
+		return nil
+	}
+	defer func() {
+		err := b.repo.Close()
+		if err != nil {
+			plog.Printf("restic unlock err for destination=%s err=%s", b.dest.Name, err)
+		}
+		b.repo = nil
+		b.backup = nil
+	}()
+
+	if b.backup.Changed() {
+		id, err := b.backup.Commit()
+		if err != nil {
+			for _, name := range b.sent {
+				b.store.SetFileDestinationState(name, b.dest.ID, db.UploadPending, time.Time{}, "")
+			}
+			return fmt.Errorf("restic snapshot: %w", err)
+		}
+		plog.Printf("destination %s wrote restic snapshot %s with %d new files", b.dest.Name, id.String()[:8], len(b.sent))
+	}
+
+	fileDests, err := b.store.AllFileDestinations()
+	if err != nil {
+		return err
+	}
+	for name, fds := range fileDests {
+		fd := fileDestination(fds, b.dest.ID)
+		var stored string
+		switch fd.State {
+		case db.UploadSuccess:
+			stored = storedName(FileMetadata{Name: name})
+		case db.UploadPreviewed:
+			stored = storedName(FileMetadata{Name: name, Derivative: DerivativePreview})
+		default:
+			continue
+		}
+		if b.backup.Contains(stored) {
+			continue
+		}
+		plog.Printf("%s is missing from the latest restic snapshot at %s, requeueing", name, b.dest.Name)
+		err := b.store.SetFileDestinationState(name, b.dest.ID, db.UploadPending, time.Time{}, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyingReader fails at the end of the data instead of returning
+// io.EOF if what was read doesn't match the hash and size expected,
+// so nothing is recorded for a file that changed while being read.
+type verifyingReader struct {
+	r io.Reader
+	h hash.Hash
+	// field names h in the MismatchError, sha256 if empty.
+	field string
+	want  string
+	wantN int64
+	n     int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.n += int64(n)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if v.n != v.wantN {
+			return n, &MismatchError{Field: "size", Want: fmt.Sprint(v.wantN), Got: fmt.Sprint(v.n)}
+		}
+		if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.want {
+			field := v.field
+			if field == "" {
+				field = "sha256"
+			}
+			return n, &MismatchError{Field: field, Want: v.want, Got: sum}
+		}
+	}
+	return n, err
+}
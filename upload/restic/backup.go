@@ -0,0 +1,478 @@
+package restic
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/restic/chunker"
+)
+
+// packSize is how large a pack grows before it is written, restic's
+// default.
+const packSize = 16 << 20
+
+const (
+	modeFile = 0644
+	// modeDir is os.ModeDir|0755 as restic stores it.
+	modeDir = uint32(os.ModeDir | 0755)
+)
+
+type snapshot struct {
+	Time     time.Time `json:"time"`
+	Parent   *ID       `json:"parent,omitempty"`
+	Tree     *ID       `json:"tree"`
+	Paths    []string  `json:"paths"`
+	Hostname string    `json:"hostname,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+// tree keeps nodes as raw json so that anything restic wrote is
+// carried over unchanged.
+type tree struct {
+	Nodes []json.RawMessage `json:"nodes"`
+}
+
+type node struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Mode       uint32    `json:"mode,omitempty"`
+	ModTime    time.Time `json:"mtime,omitempty"`
+	AccessTime time.Time `json:"atime,omitempty"`
+	ChangeTime time.Time `json:"ctime,omitempty"`
+	UID        uint32    `json:"uid"`
+	GID        uint32    `json:"gid"`
+	Size       uint64    `json:"size,omitempty"`
+	Links      uint64    `json:"links,omitempty"`
+	Content    []ID      `json:"content"`
+	Subtree    *ID       `json:"subtree,omitempty"`
+}
+
+// dir is one directory of the snapshot being built.
+type dir struct {
+	nodes map[string]json.RawMessage
+}
+
+func newDir(t *tree) (*dir, error) {
+	d := &dir{nodes: make(map[string]json.RawMessage)}
+	if t == nil {
+		return d, nil
+	}
+	for _, raw := range t.Nodes {
+		var n node
+		err := json.Unmarshal(raw, &n)
+		if err != nil {
+			return nil, err
+		}
+		d.nodes[n.Name] = raw
+	}
+	return d, nil
+}
+
+func (d *dir) get(name string) (*node, bool) {
+	raw, ok := d.nodes[name]
+	if !ok {
+		return nil, false
+	}
+	var n node
+	if json.Unmarshal(raw, &n) != nil {
+		return nil, false
+	}
+	return &n, true
+}
+
+func (d *dir) set(n node) error {
+	raw, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	d.nodes[n.Name] = raw
+	return nil
+}
+
+// encode returns the tree json, with nodes sorted by name as restic
+// requires.
+func (d *dir) encode() ([]byte, error) {
+	names := make([]string, 0, len(d.nodes))
+	for name := range d.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	t := tree{Nodes: make([]json.RawMessage, 0, len(names))}
+	for _, name := range names {
+		t.Nodes = append(t.Nodes, d.nodes[name])
+	}
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// Backup adds files to a directory and records them in a new
+// snapshot. Each snapshot starts from the latest one with the same
+// host, path and tags, so it holds everything backed up so far.
+type Backup struct {
+	repo *Repo
+	path string
+	tags []string
+
+	parent *ID
+	// dirs holds each directory from the root down to path.
+	dirs  []*dir
+	added int
+
+	pack  packer
+	packs []indexPackJSON
+}
+
+type packer struct {
+	buf   []byte
+	blobs []indexBlobJSON
+}
+
+// NewBackup starts a snapshot of the absolute directory dirPath.
+func (r *Repo) NewBackup(dirPath string, tags []string) (*Backup, error) {
+	err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{
+		repo: r,
+		path: path.Clean(dirPath),
+		tags: tags,
+	}
+
+	parent, err := r.latestSnapshot(b.path, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var t *tree
+	if parent != nil {
+		b.parent = parent.id
+		t, err = r.loadTree(*parent.Tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, name := range append([]string{""}, b.components()...) {
+		if i > 0 {
+			t, err = b.subtree(b.dirs[i-1], name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		d, err := newDir(t)
+		if err != nil {
+			return nil, err
+		}
+		b.dirs = append(b.dirs, d)
+	}
+
+	return b, nil
+}
+
+func (b *Backup) components() []string {
+	return strings.Split(strings.Trim(b.path, "/"), "/")
+}
+
+func (b *Backup) subtree(parent *dir, name string) (*tree, error) {
+	n, ok := parent.get(name)
+	if !ok || n.Type != "dir" || n.Subtree == nil {
+		return nil, nil
+	}
+	return b.repo.loadTree(*n.Subtree)
+}
+
+type loadedSnapshot struct {
+	snapshot
+	id *ID
+}
+
+// latestSnapshot returns the newest snapshot from this host of
+// dirPath carrying all of tags, or nil if there is none.
+func (r *Repo) latestSnapshot(dirPath string, tags []string) (*loadedSnapshot, error) {
+	names, err := r.store.list(typeSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("list snapshots: %w", err)
+	}
+
+	var latest *loadedSnapshot
+	for _, name := range names {
+		var sn snapshot
+		err := r.loadJSON(typeSnapshot, name, &sn)
+		if err != nil {
+			return nil, fmt.Errorf("load snapshot: %w", err)
+		}
+		if sn.Hostname != r.hostname || len(sn.Paths) != 1 || sn.Paths[0] != dirPath || !hasTags(sn.Tags, tags) || sn.Tree == nil {
+			continue
+		}
+		if latest != nil && !sn.Time.After(latest.Time) {
+			continue
+		}
+		var id ID
+		err = id.UnmarshalJSON([]byte(`"` + name + `"`))
+		if err != nil {
+			return nil, err
+		}
+		latest = &loadedSnapshot{snapshot: sn, id: &id}
+	}
+	return latest, nil
+}
+
+func hasTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether the snapshot being built has a file called
+// name, from this backup or an earlier one.
+func (b *Backup) Contains(name string) bool {
+	n, ok := b.dirs[len(b.dirs)-1].get(name)
+	return ok && n.Type == "file"
+}
+
+// Add chunks rd and stores the blobs the repository doesn't have yet,
+// as the file name. unchanged is set if the previous snapshot already
+// had identical contents under that name. Blobs from several files
+// share a pack, which is written once it reaches packSize or by
+// Commit, so nothing Add stores is safe until Commit succeeds.
+func (b *Backup) Add(name string, mtime time.Time, rd io.Reader) (unchanged bool, err error) {
+	if name == "" || strings.Contains(name, "/") {
+		return false, fmt.Errorf("invalid file name %q", name)
+	}
+	err = b.repo.refreshLock()
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		content []ID
+		size    uint64
+	)
+	ch := chunker.New(rd, b.repo.cfg.ChunkerPolynomial)
+	buf := make([]byte, chunker.MaxSize)
+	for {
+		chunk, err := ch.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		buf = chunk.Data
+
+		id := hashID(chunk.Data)
+		content = append(content, id)
+		size += uint64(chunk.Length)
+
+		if b.repo.data[id] {
+			continue
+		}
+		err = b.addBlob("data", id, chunk.Data)
+		if err != nil {
+			return false, err
+		}
+	}
+	if content == nil {
+		content = []ID{}
+	}
+
+	leaf := b.dirs[len(b.dirs)-1]
+	if prev, ok := leaf.get(name); ok && prev.Type == "file" && prev.Size == size && equalIDs(prev.Content, content) {
+		return true, nil
+	}
+
+	mtime = mtime.Local()
+	err = leaf.set(node{
+		Name:       name,
+		Type:       "file",
+		Mode:       modeFile,
+		ModTime:    mtime,
+		AccessTime: mtime,
+		ChangeTime: mtime,
+		Size:       size,
+		Links:      1,
+		Content:    content,
+	})
+	if err != nil {
+		return false, err
+	}
+	b.added++
+	return false, nil
+}
+
+func equalIDs(a, b []ID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Changed reports whether Add has stored anything for Commit to
+// record.
+func (b *Backup) Changed() bool {
+	return b.added > 0
+}
+
+// Commit writes the trees, an index of everything stored, and the
+// snapshot.
+func (b *Backup) Commit() (ID, error) {
+	now := time.Now()
+	names := b.components()
+
+	var id ID
+	for i := len(b.dirs) - 1; i >= 0; i-- {
+		d := b.dirs[i]
+		if i < len(b.dirs)-1 {
+			subtree := id
+			err := d.set(node{
+				Name:       names[i],
+				Type:       "dir",
+				Mode:       modeDir,
+				ModTime:    now,
+				AccessTime: now,
+				ChangeTime: now,
+				Subtree:    &subtree,
+			})
+			if err != nil {
+				return ID{}, err
+			}
+		}
+		buf, err := d.encode()
+		if err != nil {
+			return ID{}, err
+		}
+		id = hashID(buf)
+		if _, ok := b.repo.trees[id]; !ok {
+			err = b.addBlob("tree", id, buf)
+			if err != nil {
+				return ID{}, err
+			}
+		}
+	}
+	err := b.flush()
+	if err != nil {
+		return ID{}, err
+	}
+
+	if len(b.packs) > 0 {
+		_, err = b.repo.saveJSON(typeIndex, indexJSON{Packs: b.packs})
+		if err != nil {
+			return ID{}, fmt.Errorf("save index: %w", err)
+		}
+		b.packs = nil
+	}
+
+	root := id
+	snID, err := b.repo.saveJSON(typeSnapshot, snapshot{
+		Time:     now,
+		Parent:   b.parent,
+		Tree:     &root,
+		Paths:    []string{b.path},
+		Hostname: b.repo.hostname,
+		Tags:     b.tags,
+	})
+	if err != nil {
+		return ID{}, fmt.Errorf("save snapshot: %w", err)
+	}
+	b.parent = &snID
+	b.added = 0
+	return snID, nil
+}
+
+func (b *Backup) addBlob(blobType string, id ID, plaintext []byte) error {
+	sealed := b.repo.key.seal(plaintext)
+	b.pack.blobs = append(b.pack.blobs, indexBlobJSON{
+		ID:     id,
+		Type:   blobType,
+		Offset: uint(len(b.pack.buf)),
+		Length: uint(len(sealed)),
+	})
+	b.pack.buf = append(b.pack.buf, sealed...)
+
+	if blobType == "data" {
+		b.repo.data[id] = true
+	}
+
+	if len(b.pack.buf) >= packSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush writes the current pack: the encrypted blobs followed by an
+// encrypted header listing them and the header's length.
+func (b *Backup) flush() error {
+	if len(b.pack.blobs) == 0 {
+		return nil
+	}
+
+	var header []byte
+	for _, blob := range b.pack.blobs {
+		var blobType byte
+		switch blob.Type {
+		case "data":
+			blobType = 0
+		case "tree":
+			blobType = 1
+		default:
+			return errors.New("unknown blob type " + blob.Type)
+		}
+		header = append(header, packHeaderEntry(blobType, uint32(blob.Length), blob.ID)...)
+	}
+	sealedHeader := b.repo.key.seal(header)
+
+	buf := append(b.pack.buf, sealedHeader...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(sealedHeader)))
+
+	id := hashID(buf)
+	err := b.repo.store.save(typeData, id.String(), buf)
+	if err != nil {
+		for _, blob := range b.pack.blobs {
+			delete(b.repo.data, blob.ID)
+		}
+		b.pack = packer{}
+		return fmt.Errorf("save pack: %w", err)
+	}
+
+	for _, blob := range b.pack.blobs {
+		if blob.Type == "tree" {
+			b.repo.trees[blob.ID] = blobLocation{
+				pack:   id,
+				offset: blob.Offset,
+				length: blob.Length,
+			}
+		}
+	}
+	b.packs = append(b.packs, indexPackJSON{ID: id, Blobs: b.pack.blobs})
+	b.pack = packer{buf: b.pack.buf[:0]}
+	return nil
+}
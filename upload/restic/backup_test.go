@@ -0,0 +1,127 @@
+package restic
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		location func(dir string) string
+	}{
+		{"local", func(dir string) string { return dir }},
+		{"rest", func(dir string) string { return serveREST(t, dir) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := initRepo(t)
+			location := tc.location(dir)
+			const dirPath = "/sdcard/DCIM/Camera"
+			mtime := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+
+			// large enough to be split into several chunks
+			large := make([]byte, 3<<20)
+			rand.New(rand.NewSource(1)).Read(large)
+			want := map[string][]byte{
+				"IMG_0001.jpg": []byte("first photo"),
+				"IMG_0002.jpg": []byte("first photo"),
+				"VID_0003.mp4": large,
+			}
+
+			r, err := Open(location, testPassword, "phone", http.DefaultClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := r.NewBackup(dirPath, []string{"phone"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Changed() {
+				t.Error("new backup reports changes")
+			}
+			for _, name := range []string{"IMG_0001.jpg", "IMG_0002.jpg", "VID_0003.mp4"} {
+				unchanged, err := b.Add(name, mtime, bytes.NewReader(want[name]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if unchanged {
+					t.Errorf("%s reported unchanged in the first backup", name)
+				}
+				if !b.Contains(name) {
+					t.Errorf("backup doesn't contain %s after Add", name)
+				}
+			}
+			first, err := b.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the files, the duplicate's blob stored once, and the trees
+			// all share one pack
+			packs, err := (&localStorage{dir: dir}).list(typeData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packs) != 1 {
+				t.Errorf("first backup wrote %d packs, want 1", len(packs))
+			}
+			if locks := listLocks(t, dir); len(locks) != 0 {
+				t.Errorf("locks left after Close: %q", locks)
+			}
+			checkRepo(t, location, testPassword, dirPath, want)
+
+			r, err = Open(location, testPassword, "phone", http.DefaultClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			b, err = r.NewBackup(dirPath, []string{"phone"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !b.Contains("VID_0003.mp4") {
+				t.Error("second backup doesn't see the first one's files")
+			}
+			unchanged, err := b.Add("VID_0003.mp4", mtime, bytes.NewReader(large))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !unchanged || b.Changed() {
+				t.Errorf("re-adding the same content: unchanged=%v changed=%v", unchanged, b.Changed())
+			}
+
+			want["IMG_0004.jpg"] = []byte("fourth photo")
+			_, err = b.Add("IMG_0004.jpg", mtime, bytes.NewReader(want["IMG_0004.jpg"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !b.Changed() {
+				t.Error("backup with a new file not changed")
+			}
+			_, err = b.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRepo(t, location, testPassword, dirPath, want)
+
+			err = r.loadIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sn, err := r.latestSnapshot(dirPath, []string{"phone"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sn.Parent == nil || *sn.Parent != first {
+				t.Errorf("second snapshot's parent = %v, want %s", sn.Parent, first)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package restic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ivSize  = aes.BlockSize
+	macSize = poly1305.TagSize
+
+	// overhead is what sealing adds to a plaintext.
+	overhead = ivSize + macSize
+)
+
+var errUnauthenticated = errors.New("ciphertext verification failed")
+
+// key is restic's master key: AES-256-CTR for encryption and
+// Poly1305-AES for authentication.
+type key struct {
+	encrypt [32]byte
+	macK    [16]byte
+	macR    [16]byte
+}
+
+type jsonMACKey struct {
+	K []byte `json:"k"`
+	R []byte `json:"r"`
+}
+
+type jsonKey struct {
+	MAC     jsonMACKey `json:"mac"`
+	Encrypt []byte     `json:"encrypt"`
+}
+
+func (k *key) UnmarshalJSON(data []byte) error {
+	var j jsonKey
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	if len(j.Encrypt) != len(k.encrypt) || len(j.MAC.K) != len(k.macK) || len(j.MAC.R) != len(k.macR) {
+		return errors.New("invalid key lengths")
+	}
+	copy(k.encrypt[:], j.Encrypt)
+	copy(k.macK[:], j.MAC.K)
+	copy(k.macR[:], j.MAC.R)
+	maskMACKey(&k.macR)
+	return nil
+}
+
+// kdf derives the key that unlocks a key file from the password.
+func kdf(password string, salt []byte, n, r, p int) (*key, error) {
+	buf, err := scrypt.Key([]byte(password), salt, n, r, p, 64)
+	if err != nil {
+		return nil, err
+	}
+	var k key
+	copy(k.encrypt[:], buf[:32])
+	copy(k.macK[:], buf[32:48])
+	copy(k.macR[:], buf[48:64])
+	maskMACKey(&k.macR)
+	return &k, nil
+}
+
+var poly1305KeyMask = [16]byte{
+	0xff, 0xff, 0xff, 0x0f,
+	0xfc, 0xff, 0xff, 0x0f,
+	0xfc, 0xff, 0xff, 0x0f,
+	0xfc, 0xff, 0xff, 0x0f,
+}
+
+func maskMACKey(r *[16]byte) {
+	for i := range r {
+		r[i] &= poly1305KeyMask[i]
+	}
+}
+
+func (k *key) macKey(nonce []byte) *[32]byte {
+	var mk [32]byte
+	block, err := aes.NewCipher(k.macK[:])
+	if err != nil {
+		panic(err)
+	}
+	block.Encrypt(mk[16:], nonce)
+	copy(mk[:16], k.macR[:])
+	return &mk
+}
+
+// seal encrypts plaintext with a fresh nonce, returning
+// nonce || ciphertext || mac.
+func (k *key) seal(plaintext []byte) []byte {
+	out := make([]byte, ivSize+len(plaintext)+macSize)
+	nonce := out[:ivSize]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(fmt.Sprintf("read random nonce: %s", err))
+	}
+
+	ciphertext := out[ivSize : ivSize+len(plaintext)]
+	block, err := aes.NewCipher(k.encrypt[:])
+	if err != nil {
+		panic(err)
+	}
+	cipher.NewCTR(block, nonce).XORKeyStream(ciphertext, plaintext)
+
+	var mac [macSize]byte
+	poly1305.Sum(&mac, ciphertext, k.macKey(nonce))
+	copy(out[ivSize+len(plaintext):], mac[:])
+	return out
+}
+
+// open authenticates and decrypts the output of seal.
+func (k *key) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < overhead {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := sealed[:ivSize]
+	ciphertext := sealed[ivSize : len(sealed)-macSize]
+	var mac [macSize]byte
+	copy(mac[:], sealed[len(sealed)-macSize:])
+
+	if !poly1305.Verify(&mac, ciphertext, k.macKey(nonce)) {
+		return nil, errUnauthenticated
+	}
+
+	block, err := aes.NewCipher(k.encrypt[:])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, nonce).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
@@ -0,0 +1,111 @@
+package restic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// newTestKey returns a random master key.
+func newTestKey(t *testing.T) *key {
+	t.Helper()
+	var k key
+	err := json.Unmarshal(newTestKeyJSON(t), &k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &k
+}
+
+// newTestKeyJSON returns a random master key as restic stores it in a
+// key file.
+func newTestKeyJSON(t *testing.T) []byte {
+	t.Helper()
+	j := jsonKey{
+		MAC:     jsonMACKey{K: make([]byte, 16), R: make([]byte, 16)},
+		Encrypt: make([]byte, 32),
+	}
+	for _, b := range [][]byte{j.MAC.K, j.MAC.R, j.Encrypt} {
+		_, err := rand.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestSealOpen(t *testing.T) {
+	k := newTestKey(t)
+	plaintext := []byte("a blob of plaintext")
+
+	sealed := k.seal(plaintext)
+	if len(sealed) != len(plaintext)+overhead {
+		t.Errorf("sealed length = %d, want %d", len(sealed), len(plaintext)+overhead)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("sealed data contains the plaintext")
+	}
+	if again := k.seal(plaintext); bytes.Equal(again, sealed) {
+		t.Error("sealing twice gave the same output, nonce not random")
+	}
+
+	got, err := k.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("open = %q, want %q", got, plaintext)
+	}
+
+	// flip a bit in the nonce, the ciphertext and the mac
+	for _, i := range []int{0, ivSize, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		_, err := k.open(tampered)
+		if !errors.Is(err, errUnauthenticated) {
+			t.Errorf("open with byte %d changed err = %v, want errUnauthenticated", i, err)
+		}
+	}
+
+	_, err = newTestKey(t).open(sealed)
+	if !errors.Is(err, errUnauthenticated) {
+		t.Errorf("open with another key err = %v, want errUnauthenticated", err)
+	}
+	_, err = k.open(sealed[:overhead-1])
+	if err == nil {
+		t.Error("open of a short ciphertext succeeded")
+	}
+}
+
+func TestKDF(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	a, err := kdf("password", salt, 1024, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := kdf("password", salt, 1024, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *a != *b {
+		t.Error("kdf not deterministic")
+	}
+	other, err := kdf("Password", salt, 1024, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *other == *a {
+		t.Error("different passwords derived the same key")
+	}
+
+	_, err = other.open(a.seal([]byte("master key")))
+	if !errors.Is(err, errUnauthenticated) {
+		t.Errorf("key from the wrong password opened data, err = %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+// Package restic writes files into an existing restic repository, so
+// they show up in snapshots next to backups made by restic itself.
+// Repositories are created with restic init; this package only adds
+// to them.
+package restic
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/restic/chunker"
+)
+
+// ID is the sha256 of a blob's plaintext or of a stored file.
+type ID [32]byte
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(id.String())
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return fmt.Errorf("invalid id %q", s)
+	}
+	copy(id[:], b)
+	return nil
+}
+
+func hashID(data []byte) ID {
+	return sha256.Sum256(data)
+}
+
+// ErrLocked means another restic process, such as a prune, holds an
+// exclusive lock on the repository.
+var ErrLocked = errors.New("repository is locked exclusively")
+
+const (
+	// staleLock matches restic: locks not refreshed this long are
+	// ignored, and ours are refreshed well before.
+	staleLock        = 30 * time.Minute
+	lockRefresh      = 5 * time.Minute
+	maxSupportedRepo = 2
+)
+
+type config struct {
+	Version           uint        `json:"version"`
+	ID                string      `json:"id"`
+	ChunkerPolynomial chunker.Pol `json:"chunker_polynomial"`
+}
+
+type keyFile struct {
+	KDF  string `json:"kdf"`
+	N    int    `json:"N"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+	Data []byte `json:"data"`
+}
+
+type lock struct {
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	Username  string    `json:"username"`
+	PID       int       `json:"pid"`
+}
+
+// blobLocation is where a blob is stored.
+type blobLocation struct {
+	pack               ID
+	offset             uint
+	length             uint
+	uncompressedLength uint
+}
+
+// Repo is an open repository.
+type Repo struct {
+	store    storage
+	key      *key
+	cfg      config
+	hostname string
+
+	lockID   ID
+	lockTime time.Time
+
+	// data holds the data blobs known to the index. Trees are kept
+	// with their location so snapshots can be read back.
+	data  map[ID]bool
+	trees map[ID]blobLocation
+
+	zstd *zstd.Decoder
+}
+
+// Open unlocks the repository at location with password and takes a
+// shared lock on it in hostname's name. Requests to a rest: repository
+// are sent with client. A missing local repository returns an error
+// wrapping fs.ErrNotExist.
+func Open(location, password, hostname string, client *http.Client) (*Repo, error) {
+	store, err := openStorage(location, client)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedCfg, err := store.load(typeConfig, "", 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	r := &Repo{
+		store:    store,
+		hostname: hostname,
+	}
+
+	r.key, err = r.unlock(password)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgJSON, err := r.key.open(sealedCfg)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt config: %w", err)
+	}
+	err = json.Unmarshal(cfgJSON, &r.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	if r.cfg.Version < 1 || r.cfg.Version > maxSupportedRepo {
+		return nil, fmt.Errorf("unsupported repository version %d", r.cfg.Version)
+	}
+
+	err = r.lock()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// unlock tries password against each key file.
+func (r *Repo) unlock(password string) (*key, error) {
+	names, err := r.store.list(typeKeys)
+	if err != nil {
+		return nil, fmt.Errorf("list keys: %w", err)
+	}
+	for _, name := range names {
+		buf, err := r.store.load(typeKeys, name, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		var kf keyFile
+		err = json.Unmarshal(buf, &kf)
+		if err != nil || kf.KDF != "scrypt" {
+			continue
+		}
+		userKey, err := kdf(password, kf.Salt, kf.N, kf.R, kf.P)
+		if err != nil {
+			continue
+		}
+		masterJSON, err := userKey.open(kf.Data)
+		if err != nil {
+			continue
+		}
+		var master key
+		err = json.Unmarshal(masterJSON, &master)
+		if err != nil {
+			return nil, fmt.Errorf("parse key %s: %w", name, err)
+		}
+		return &master, nil
+	}
+	return nil, errors.New("wrong password or no key found")
+}
+
+// lock takes a shared lock, failing with ErrLocked if someone holds
+// an exclusive one.
+func (r *Repo) lock() error {
+	names, err := r.store.list(typeLocks)
+	if err != nil {
+		return fmt.Errorf("list locks: %w", err)
+	}
+	for _, name := range names {
+		var l lock
+		err := r.loadJSON(typeLocks, name, &l)
+		if err != nil {
+			// removed while we were listing, or unreadable
+			continue
+		}
+		if l.Exclusive && time.Since(l.Time) < staleLock {
+			return fmt.Errorf("%w by %s pid %d", ErrLocked, l.Hostname, l.PID)
+		}
+	}
+
+	now := time.Now()
+	id, err := r.saveJSON(typeLocks, lock{
+		Time:     now,
+		Hostname: r.hostname,
+		PID:      os.Getpid(),
+	})
+	if err != nil {
+		return err
+	}
+	r.lockID = id
+	r.lockTime = now
+	return nil
+}
+
+// refreshLock replaces our lock before restic would consider it stale.
+func (r *Repo) refreshLock() error {
+	if time.Since(r.lockTime) < lockRefresh {
+		return nil
+	}
+	old := r.lockID
+	err := r.lock()
+	if err != nil {
+		return err
+	}
+	return r.store.remove(typeLocks, old.String())
+}
+
+// Close releases the lock. Anything not yet committed is left as
+// unreferenced data for restic prune to clean up.
+func (r *Repo) Close() error {
+	if r.zstd != nil {
+		r.zstd.Close()
+	}
+	return r.store.remove(typeLocks, r.lockID.String())
+}
+
+// saveJSON encrypts v and stores it under the hash of the result.
+func (r *Repo) saveJSON(t string, v interface{}) (ID, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return ID{}, err
+	}
+	sealed := r.key.seal(plaintext)
+	id := hashID(sealed)
+	return id, r.store.save(t, id.String(), sealed)
+}
+
+// loadJSON reads and decrypts a file written by saveJSON or restic.
+func (r *Repo) loadJSON(t, name string, v interface{}) error {
+	sealed, err := r.store.load(t, name, 0, 0)
+	if err != nil {
+		return err
+	}
+	if hashID(sealed).String() != name {
+		return fmt.Errorf("%s/%s: content does not match its name", t, name)
+	}
+	plaintext, err := r.key.open(sealed)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %w", t, name, err)
+	}
+	// version 2 repositories may zstd compress, marked by a leading 2
+	if r.cfg.Version >= 2 && len(plaintext) > 0 && plaintext[0] == 2 {
+		plaintext, err = r.decompress(plaintext[1:])
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", t, name, err)
+		}
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func (r *Repo) decompress(data []byte) ([]byte, error) {
+	if r.zstd == nil {
+		var err error
+		r.zstd, err = zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.zstd.DecodeAll(data, nil)
+}
+
+type indexJSON struct {
+	Supersedes []ID            `json:"supersedes,omitempty"`
+	Packs      []indexPackJSON `json:"packs"`
+}
+
+type indexPackJSON struct {
+	ID    ID              `json:"id"`
+	Blobs []indexBlobJSON `json:"blobs"`
+}
+
+type indexBlobJSON struct {
+	ID                 ID     `json:"id"`
+	Type               string `json:"type"`
+	Offset             uint   `json:"offset"`
+	Length             uint   `json:"length"`
+	UncompressedLength uint   `json:"uncompressed_length,omitempty"`
+}
+
+// loadIndex reads every index file so blobs already in the repository
+// aren't stored again.
+func (r *Repo) loadIndex() error {
+	if r.data != nil {
+		return nil
+	}
+	names, err := r.store.list(typeIndex)
+	if err != nil {
+		return fmt.Errorf("list index: %w", err)
+	}
+
+	r.data = make(map[ID]bool)
+	r.trees = make(map[ID]blobLocation)
+	for _, name := range names {
+		var idx indexJSON
+		err := r.loadJSON(typeIndex, name, &idx)
+		if err != nil {
+			return fmt.Errorf("load index: %w", err)
+		}
+		for _, p := range idx.Packs {
+			for _, b := range p.Blobs {
+				switch b.Type {
+				case "data":
+					r.data[b.ID] = true
+				case "tree":
+					r.trees[b.ID] = blobLocation{
+						pack:               p.ID,
+						offset:             b.Offset,
+						length:             b.Length,
+						uncompressedLength: b.UncompressedLength,
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadTree reads a tree blob.
+func (r *Repo) loadTree(id ID) (*tree, error) {
+	loc, ok := r.trees[id]
+	if !ok {
+		return nil, fmt.Errorf("tree %s not in index", id)
+	}
+	sealed, err := r.store.load(typeData, loc.pack.String(), int64(loc.offset), int64(loc.length))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := r.key.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("tree %s: %w", id, err)
+	}
+	if loc.uncompressedLength != 0 {
+		plaintext, err = r.decompress(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("tree %s: %w", id, err)
+		}
+	}
+	if hashID(plaintext) != id {
+		return nil, fmt.Errorf("tree %s: content does not match its id", id)
+	}
+
+	var t tree
+	err = json.Unmarshal(plaintext, &t)
+	if err != nil {
+		return nil, fmt.Errorf("tree %s: %w", id, err)
+	}
+	return &t, nil
+}
+
+// packHeaderEntry is one blob's entry in an uncompressed pack header:
+// type, encrypted length and id.
+func packHeaderEntry(blobType byte, length uint32, id ID) []byte {
+	entry := make([]byte, 0, 1+4+len(id))
+	entry = append(entry, blobType)
+	entry = binary.LittleEndian.AppendUint32(entry, length)
+	return append(entry, id[:]...)
+}
@@ -0,0 +1,386 @@
+package restic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/chunker"
+)
+
+const testPassword = "correct horse"
+
+// initRepo creates an empty version 2 repository the way restic init
+// does, with cheap scrypt parameters.
+func initRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	store := &localStorage{dir: dir}
+
+	masterJSON := newTestKeyJSON(t)
+	var master key
+	err := json.Unmarshal(masterJSON, &master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := make([]byte, 64)
+	_, err = rand.Read(salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := kdf(testPassword, salt, 1024, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf, err := json.Marshal(keyFile{KDF: "scrypt", N: 1024, R: 8, P: 1, Salt: salt, Data: userKey.seal(masterJSON)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.save(typeKeys, hashID(kf).String(), kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pol, err := chunker.RandomPolynomial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoID := make([]byte, 32)
+	rand.Read(repoID)
+	cfg, err := json.Marshal(config{Version: 2, ID: hex.EncodeToString(repoID), ChunkerPolynomial: pol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.save(typeConfig, "", master.seal(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// copyRepo copies the repository in src to a temporary directory.
+func copyRepo(t *testing.T, src string) string {
+	t.Helper()
+	dst := t.TempDir()
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Join(dst, filepath.Dir(rel)), 0700)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0400)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func listLocks(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := (&localStorage{dir: dir}).list(typeLocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+type indexedBlob struct {
+	pack ID
+	indexBlobJSON
+}
+
+// readBlob decrypts a blob and checks it against its id.
+func readBlob(t *testing.T, r *Repo, b indexedBlob) []byte {
+	t.Helper()
+	sealed, err := r.store.load(typeData, b.pack.String(), int64(b.Offset), int64(b.Length))
+	if err != nil {
+		t.Fatalf("load blob %s: %s", b.ID, err)
+	}
+	plaintext, err := r.key.open(sealed)
+	if err != nil {
+		t.Fatalf("decrypt blob %s: %s", b.ID, err)
+	}
+	if b.UncompressedLength != 0 {
+		plaintext, err = r.decompress(plaintext)
+		if err != nil {
+			t.Fatalf("decompress blob %s: %s", b.ID, err)
+		}
+	}
+	if hashID(plaintext) != b.ID {
+		t.Fatalf("blob %s does not match its id", b.ID)
+	}
+	return plaintext
+}
+
+// checkRepo reads back everything in the repository at location: each
+// pack against the index, and the latest snapshot of dirPath, whose
+// files must be exactly want.
+func checkRepo(t *testing.T, location, password, dirPath string, want map[string][]byte) {
+	t.Helper()
+	r, err := Open(location, password, "phone", http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	indexes, err := r.store.list(typeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := make(map[ID]indexedBlob)
+	for _, name := range indexes {
+		var idx indexJSON
+		err := r.loadJSON(typeIndex, name, &idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range idx.Packs {
+			pack, err := r.store.load(typeData, p.ID.String(), 0, 0)
+			if err != nil {
+				t.Fatalf("load pack %s: %s", p.ID, err)
+			}
+			if hashID(pack) != p.ID {
+				t.Errorf("pack %s does not match its name", p.ID)
+			}
+
+			// the header at the end lists the same blobs as the index
+			headerLen := int(binary.LittleEndian.Uint32(pack[len(pack)-4:]))
+			header, err := r.key.open(pack[len(pack)-4-headerLen : len(pack)-4])
+			if err != nil {
+				t.Fatalf("pack %s header: %s", p.ID, err)
+			}
+			var want []byte
+			for _, b := range p.Blobs {
+				if b.UncompressedLength != 0 {
+					// restic's compressed entries also carry the
+					// uncompressed length, leave them to restic check
+					want = nil
+					break
+				}
+				blobType := byte(0)
+				if b.Type == "tree" {
+					blobType = 1
+				}
+				want = append(want, packHeaderEntry(blobType, uint32(b.Length), b.ID)...)
+			}
+			if want != nil && !bytes.Equal(header, want) {
+				t.Errorf("pack %s header doesn't match the index", p.ID)
+			}
+
+			for _, b := range p.Blobs {
+				ib := indexedBlob{pack: p.ID, indexBlobJSON: b}
+				readBlob(t, r, ib)
+				blobs[b.ID] = ib
+			}
+		}
+	}
+
+	err = r.loadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, err := r.latestSnapshot(dirPath, []string{"phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn == nil {
+		t.Fatalf("no snapshot of %s", dirPath)
+	}
+
+	tr, err := r.loadTree(*sn.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		d, err := newDir(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, ok := d.get(name)
+		if !ok || n.Type != "dir" || n.Subtree == nil {
+			t.Fatalf("snapshot has no directory %s on the way to %s", name, dirPath)
+		}
+		tr, err = r.loadTree(*n.Subtree)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, raw := range tr.Nodes {
+		var n node
+		err := json.Unmarshal(raw, &n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n.Name)
+
+		var content []byte
+		for _, id := range n.Content {
+			b, ok := blobs[id]
+			if !ok {
+				t.Fatalf("%s: blob %s not in the index", n.Name, id)
+			}
+			content = append(content, readBlob(t, r, b)...)
+		}
+		if n.Type != "file" || n.Size != uint64(len(content)) {
+			t.Errorf("%s: type %s size %d, want a file of %d bytes", n.Name, n.Type, n.Size, len(content))
+		}
+		if w, ok := want[n.Name]; ok && !bytes.Equal(content, w) {
+			t.Errorf("%s: snapshot content differs from what was added", n.Name)
+		}
+	}
+
+	var wantNames []string
+	for name := range want {
+		wantNames = append(wantNames, name)
+	}
+	sort.Strings(wantNames)
+	if strings.Join(got, ",") != strings.Join(wantNames, ",") {
+		t.Errorf("snapshot of %s has %q, want %q", dirPath, got, wantNames)
+	}
+}
+
+// goldenRepo is a repository made by restic 0.17.3 with
+//
+//	restic init
+//	restic backup --host phone --tag phone /tmp/fixture/Camera
+//
+// with the password goldenPassword.
+const (
+	goldenRepo     = "testdata/repo"
+	goldenPassword = "test"
+)
+
+var goldenFiles = map[string][]byte{
+	"IMG_0001.jpg": []byte("first photo\n"),
+	"IMG_0002.jpg": []byte("second photo, a little longer\n"),
+}
+
+func TestOpenWrongPassword(t *testing.T) {
+	dir := initRepo(t)
+	_, err := Open(dir, "wrong", "phone", nil)
+	if err == nil {
+		t.Fatal("Open with the wrong password succeeded")
+	}
+	if locks := listLocks(t, dir); len(locks) != 0 {
+		t.Errorf("locks left after a failed open: %q", locks)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		lock   lock
+		locked bool
+	}{
+		{"exclusive", lock{Time: time.Now(), Exclusive: true, Hostname: "nas", PID: 42}, true},
+		{"stale exclusive", lock{Time: time.Now().Add(-2 * staleLock), Exclusive: true, Hostname: "nas", PID: 42}, false},
+		{"shared", lock{Time: time.Now(), Hostname: "nas", PID: 42}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := initRepo(t)
+			holder, err := Open(dir, testPassword, "nas", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = holder.saveJSON(typeLocks, tc.lock)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := Open(dir, testPassword, "phone", nil)
+			if tc.locked {
+				if !errors.Is(err, ErrLocked) {
+					t.Fatalf("Open err = %v, want ErrLocked", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			locks := len(listLocks(t, dir))
+			err = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after := len(listLocks(t, dir)); after != locks-1 {
+				t.Errorf("locks after Close = %d, want %d", after, locks-1)
+			}
+		})
+	}
+}
+
+func TestGoldenRepo(t *testing.T) {
+	dir := copyRepo(t, goldenRepo)
+	const dirPath = "/tmp/fixture/Camera"
+
+	checkRepo(t, dir, goldenPassword, dirPath, goldenFiles)
+
+	r, err := Open(dir, goldenPassword, "phone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.NewBackup(dirPath, []string{"phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range goldenFiles {
+		if !b.Contains(name) {
+			t.Errorf("backup doesn't see %s from restic's snapshot", name)
+		}
+		unchanged, err := b.Add(name, time.Now(), bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !unchanged {
+			t.Errorf("%s with restic's content not reported unchanged", name)
+		}
+	}
+	if b.Changed() {
+		t.Error("backup changed by files restic already has")
+	}
+
+	added := []byte("third photo\n")
+	_, err = b.Add("IMG_0003.jpg", time.Now(), bytes.NewReader(added))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{"IMG_0003.jpg": added}
+	for name, content := range goldenFiles {
+		want[name] = content
+	}
+	checkRepo(t, dir, goldenPassword, dirPath, want)
+}
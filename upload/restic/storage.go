@@ -0,0 +1,290 @@
+package restic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File types, named after their directories in the repository.
+const (
+	typeConfig   = "config"
+	typeData     = "data"
+	typeKeys     = "keys"
+	typeIndex    = "index"
+	typeSnapshot = "snapshots"
+	typeLocks    = "locks"
+)
+
+// storage is where a repository's files live.
+type storage interface {
+	// load returns length bytes of a file starting at off, or the
+	// whole file if length is 0.
+	load(t, name string, off, length int64) ([]byte, error)
+	save(t, name string, data []byte) error
+	remove(t, name string) error
+	list(t string) ([]string, error)
+}
+
+// openStorage accepts the locations restic does for local and REST
+// repositories: a path, local:/path, file:///path or rest:http(s)://...
+func openStorage(location string, client *http.Client) (storage, error) {
+	switch {
+	case strings.HasPrefix(location, "rest:"):
+		return newRESTStorage(strings.TrimPrefix(location, "rest:"), client)
+	case strings.HasPrefix(location, "local:"):
+		location = strings.TrimPrefix(location, "local:")
+	case strings.HasPrefix(location, "file:"):
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		location = u.Path
+	}
+	if location == "" || !filepath.IsAbs(location) {
+		return nil, fmt.Errorf("restic repository must be an absolute path or a rest: url, not %q", location)
+	}
+	return &localStorage{dir: filepath.Clean(location)}, nil
+}
+
+type localStorage struct {
+	dir string
+}
+
+func (s *localStorage) path(t, name string) string {
+	switch t {
+	case typeConfig:
+		return filepath.Join(s.dir, "config")
+	case typeData:
+		return filepath.Join(s.dir, t, name[:2], name)
+	}
+	return filepath.Join(s.dir, t, name)
+}
+
+func (s *localStorage) load(t, name string, off, length int64) ([]byte, error) {
+	f, err := os.Open(s.path(t, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if length == 0 {
+		return io.ReadAll(f)
+	}
+	buf := make([]byte, length)
+	_, err = f.ReadAt(buf, off)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *localStorage) save(t, name string, data []byte) error {
+	dst := s.path(t, name)
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// restic keeps repository files read-only
+		err = os.Chmod(tmp.Name(), 0400)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *localStorage) remove(t, name string) error {
+	return os.Remove(s.path(t, name))
+}
+
+func (s *localStorage) list(t string) ([]string, error) {
+	dir := filepath.Join(s.dir, t)
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() && !strings.HasPrefix(d.Name(), ".") {
+			names = append(names, d.Name())
+		}
+		return nil
+	})
+	return names, err
+}
+
+// restV2 asks rest-server to list names with sizes.
+const restV2 = "application/vnd.x.restic.rest.v2"
+
+// restStorage speaks restic's REST backend protocol, as served by
+// rest-server.
+type restStorage struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+}
+
+func newRESTStorage(raw string, client *http.Client) (*restStorage, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("rest repository needs an http or https url, not %q", raw)
+	}
+	s := &restStorage{client: client}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+		u.User = nil
+	}
+	s.url = strings.TrimSuffix(u.String(), "/")
+	return s, nil
+}
+
+func (s *restStorage) path(t, name string) string {
+	if t == typeConfig {
+		return s.url + "/config"
+	}
+	return s.url + "/" + t + "/" + name
+}
+
+func (s *restStorage) do(method, path string, body []byte, header http.Header) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, path, rd)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", restV2)
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.client.Do(req)
+}
+
+func (s *restStorage) load(t, name string, off, length int64) ([]byte, error) {
+	header := make(http.Header)
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	}
+	resp, err := s.do("GET", s.path(t, name), nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s/%s: %w", t, name, fs.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("load %s/%s: %s", t, name, resp.Status)
+	}
+	if length > 0 && resp.StatusCode == http.StatusOK {
+		// the server ignored the range
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(buf)) < off+length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return buf[off : off+length], nil
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *restStorage) save(t, name string, data []byte) error {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do("POST", s.path(t, name), data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("save %s/%s: %s", t, name, resp.Status)
+	}
+	return nil
+}
+
+func (s *restStorage) remove(t, name string) error {
+	resp, err := s.do("DELETE", s.path(t, name), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("remove %s/%s: %s", t, name, resp.Status)
+	}
+	return nil
+}
+
+func (s *restStorage) list(t string) ([]string, error) {
+	resp, err := s.do("GET", s.url+"/"+t+"/", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list %s: %s", t, resp.Status)
+	}
+
+	var names []string
+	if resp.Header.Get("Content-Type") == restV2 {
+		var entries []struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&names)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list %s: bad json response: %w", t, err)
+	}
+	return names, nil
+}
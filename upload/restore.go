@@ -0,0 +1,128 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// MediaPath is the camera directory that is backed up, and the
+// default restore destination.
+func MediaPath() string {
+	return mediaPath
+}
+
+type RestoreOptions struct {
+	// Dir is where files are written. Defaults to the camera directory.
+	Dir string
+	// From and To limit the restore to files whose mtime falls in
+	// [From, To). Zero values are unbounded.
+	From time.Time
+	To   time.Time
+}
+
+type RestoreProgress struct {
+	Total      int
+	Done       int
+	Skipped    int
+	Failed     int
+	Bytes      int64
+	TotalBytes int64
+}
+
+// Restore downloads files from the server's inventory for this device.
+// Each download is verified against its sha256, given its original
+// mtime, and recorded in the db as already uploaded. Files that
+// already exist locally are skipped.
+func Restore(store *db.DB, opts RestoreOptions, progress func(RestoreProgress)) (*RestoreProgress, error) {
+	dir := opts.Dir
+	if dir == "" {
+		dir = mediaPath
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	objs, err := FullInventory(store)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []InventoryObject
+	var p RestoreProgress
+	for _, obj := range objs {
+		if !opts.From.IsZero() && obj.Mtime.Before(opts.From) {
+			continue
+		}
+		if !opts.To.IsZero() && !obj.Mtime.Before(opts.To) {
+			continue
+		}
+		selected = append(selected, obj)
+		p.Total++
+		p.TotalBytes += obj.Bytes
+	}
+
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	report()
+
+	plog.Printf("restore: %d of %d files selected into %s", len(selected), len(objs), dir)
+
+	for _, obj := range selected {
+		err := restoreOne(store, dir, obj)
+		if errors.Is(err, os.ErrExist) {
+			p.Skipped++
+		} else if err != nil {
+			plog.Printf("restore %s err: %s", obj.Name, err)
+			p.Failed++
+		} else {
+			p.Done++
+			p.Bytes += obj.Bytes
+		}
+		report()
+	}
+
+	plog.Printf("restore: done=%d skipped=%d failed=%d", p.Done, p.Skipped, p.Failed)
+	return &p, nil
+}
+
+// RestoreObject downloads a single inventory object into the camera
+// directory. It returns os.ErrExist if a file with that name is
+// already there.
+func RestoreObject(store *db.DB, obj InventoryObject) error {
+	return restoreOne(store, mediaPath, obj)
+}
+
+// OnDevice reports whether obj already exists in the camera directory.
+func OnDevice(obj InventoryObject) bool {
+	_, err := os.Stat(filepath.Join(mediaPath, filepath.Base(obj.Name)))
+	return err == nil
+}
+
+func restoreOne(store *db.DB, dir string, obj InventoryObject) error {
+	name := filepath.Base(obj.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+		return errors.New("refusing to restore unsafe file name " + obj.Name)
+	}
+
+	dst := filepath.Join(dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+
+	err := downloadObject(store, obj.ID, dst, obj.Mtime)
+	if err != nil {
+		return err
+	}
+
+	return store.CreateRestored(name, dst, obj.Mtime, obj.Bytes, obj.ID)
+}
@@ -0,0 +1,392 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	// Extended XMP continues a packet too large for one segment. Each
+	// segment holds a 32 byte GUID, the full length and the offset of
+	// its chunk, then the chunk.
+	xmpExtHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+	maxStripHeader = 4 << 20
+
+	// EXIF tags removed along with the whole GPS IFD.
+	stripIFD0Tags = map[uint16]bool{
+		0x8825: true, // GPS IFD pointer
+		0xc62f: true, // CameraSerialNumber (DNG)
+	}
+	stripExifTags = map[uint16]bool{
+		0xa430: true, // CameraOwnerName
+		0xa431: true, // BodySerialNumber
+		0xa435: true, // LensSerialNumber
+	}
+
+	stripXMPNames = regexp.MustCompile(`^(?:exif:GPS\w+|exifEX:(?:BodySerialNumber|LensSerialNumber|CameraOwnerName)|aux:(?:SerialNumber|LensSerialNumber|OwnerName))$`)
+	xmpAttrRe     = regexp.MustCompile(`\s([\w:]+)\s*=\s*(?:"[^"]*"|'[^']*')`)
+	xmpElemRe     = regexp.MustCompile(`<([\w:]+)[^>]*?(/?)>`)
+)
+
+// stripMetadata is the transform that removes GPS, serial number and
+// owner tags from JPEGs, when enabled in settings for the file's
+// directory.
+type stripMetadata struct{}
+
+func (stripMetadata) Name() Transform {
+	return TransformStripMetadata
+}
+
+func (stripMetadata) Applies(store *db.DB, path string, meta FileMetadata) (bool, error) {
+	if meta.ContentType != "image/jpeg" {
+		return false, nil
+	}
+	return store.ShouldStripMetadata(filepath.Dir(path))
+}
+
+// Wrap strips the file's bytes. GPS in meta.Capture is cleared by
+// prepare, for every file type.
+func (stripMetadata) Wrap(r io.Reader, meta *FileMetadata) (io.Reader, error) {
+	return stripJPEG(r)
+}
+
+// OutputSize is the input size: tags are blanked in place.
+func (stripMetadata) OutputSize(size int64) int64 {
+	return size
+}
+
+// tiffTypeSize is the size of each TIFF field type, indexed by type.
+var tiffTypeSize = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// stripJPEG returns a reader over the JPEG in r with GPS, serial
+// number and owner tags blanked out of its EXIF and XMP segments,
+// including extended XMP. The image data is passed through untouched
+// and the output is exactly the size of the input.
+func stripJPEG(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	var (
+		header bytes.Buffer
+		ext    []xmpExtChunk
+	)
+
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(br, soi)
+	if err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errors.New("not a jpeg")
+	}
+	header.Write(soi)
+
+	for {
+		if header.Len() > maxStripHeader {
+			return nil, errors.New("jpeg metadata too large")
+		}
+
+		marker, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header.WriteByte(marker)
+		if marker != 0xff {
+			return nil, errors.New("bad jpeg marker")
+		}
+
+		typ, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if typ == 0xff {
+			// fill byte, the next byte is the marker type
+			br.UnreadByte()
+			continue
+		}
+		header.WriteByte(typ)
+
+		if typ == 0xda || typ == 0xd9 {
+			// start of scan or end of image: the rest is image data
+			err = stripExtendedXMP(header.Bytes(), ext)
+			if err != nil {
+				return nil, fmt.Errorf("strip extended xmp: %w", err)
+			}
+			return io.MultiReader(&header, br), nil
+		}
+		if typ == 0x01 || (typ >= 0xd0 && typ <= 0xd7) {
+			continue
+		}
+
+		lenBuf := make([]byte, 2)
+		_, err = io.ReadFull(br, lenBuf)
+		if err != nil {
+			return nil, err
+		}
+		header.Write(lenBuf)
+		segLen := int(binary.BigEndian.Uint16(lenBuf))
+		if segLen < 2 {
+			return nil, errors.New("bad jpeg segment length")
+		}
+
+		body := make([]byte, segLen-2)
+		_, err = io.ReadFull(br, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == 0xe1 {
+			if bytes.HasPrefix(body, exifHeader) {
+				err = stripExif(body[len(exifHeader):])
+				if err != nil {
+					return nil, fmt.Errorf("strip exif: %w", err)
+				}
+			} else if bytes.HasPrefix(body, xmpHeader) {
+				stripXMP(body[len(xmpHeader):])
+			} else if bytes.HasPrefix(body, xmpExtHeader) {
+				chunk, err := parseXMPExtChunk(body[len(xmpExtHeader):])
+				if err != nil {
+					return nil, err
+				}
+				chunk.pos += header.Len() + len(xmpExtHeader)
+				ext = append(ext, chunk)
+			}
+		}
+		header.Write(body)
+	}
+}
+
+// stripExif edits the TIFF structure in b in place, removing the
+// entries in stripIFD0Tags and stripExifTags and zeroing their data.
+func stripExif(b []byte) error {
+	if len(b) < 8 {
+		return errors.New("short tiff header")
+	}
+	var bo binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return errors.New("bad tiff byte order")
+	}
+
+	ifd0 := bo.Uint32(b[4:])
+	removed, err := stripIFD(b, bo, ifd0, stripIFD0Tags)
+	if err != nil {
+		return err
+	}
+
+	if gpsOff, ok := removed[0x8825]; ok {
+		err = zeroIFD(b, bo, gpsOff)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := readIFDEntries(b, bo, ifd0)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if bo.Uint16(ent) == 0x8769 {
+			_, err = stripIFD(b, bo, bo.Uint32(ent[8:]), stripExifTags)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readIFDEntries(b []byte, bo binary.ByteOrder, off uint32) ([][]byte, error) {
+	if int64(off)+2 > int64(len(b)) {
+		return nil, errors.New("ifd out of range")
+	}
+	n := int(bo.Uint16(b[off:]))
+	end := int64(off) + 2 + int64(n)*12 + 4
+	if end > int64(len(b)) {
+		return nil, errors.New("ifd out of range")
+	}
+
+	entries := make([][]byte, n)
+	for i := range entries {
+		start := int(off) + 2 + i*12
+		entries[i] = b[start : start+12]
+	}
+	return entries, nil
+}
+
+// stripIFD removes the entries whose tags are in strip from the IFD at
+// off, compacting the remaining entries in place. It returns the
+// value of each removed entry, which for IFD pointers is the offset of
+// the sub-IFD.
+func stripIFD(b []byte, bo binary.ByteOrder, off uint32, strip map[uint16]bool) (map[uint16]uint32, error) {
+	entries, err := readIFDEntries(b, bo, off)
+	if err != nil {
+		return nil, err
+	}
+	n := len(entries)
+	nextIFD := bo.Uint32(b[int(off)+2+n*12:])
+
+	var kept [][]byte
+	removed := make(map[uint16]uint32)
+	for _, ent := range entries {
+		tag := bo.Uint16(ent)
+		if !strip[tag] {
+			kept = append(kept, append([]byte(nil), ent...))
+			continue
+		}
+		removed[tag] = bo.Uint32(ent[8:])
+		zeroEntryData(b, bo, ent)
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	start := int(off)
+	end := start + 2 + n*12 + 4
+	for i := start; i < end; i++ {
+		b[i] = 0
+	}
+	bo.PutUint16(b[start:], uint16(len(kept)))
+	for i, ent := range kept {
+		copy(b[start+2+i*12:], ent)
+	}
+	bo.PutUint32(b[start+2+len(kept)*12:], nextIFD)
+
+	return removed, nil
+}
+
+// zeroIFD blanks an entire IFD, including any data its entries point to.
+func zeroIFD(b []byte, bo binary.ByteOrder, off uint32) error {
+	entries, err := readIFDEntries(b, bo, off)
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		zeroEntryData(b, bo, ent)
+	}
+	end := int(off) + 2 + len(entries)*12 + 4
+	for i := int(off); i < end; i++ {
+		b[i] = 0
+	}
+	return nil
+}
+
+// zeroEntryData blanks the out of line value of an IFD entry, if it
+// has one.
+func zeroEntryData(b []byte, bo binary.ByteOrder, ent []byte) {
+	typ := bo.Uint16(ent[2:])
+	if int(typ) >= len(tiffTypeSize) {
+		return
+	}
+	size := int64(tiffTypeSize[typ]) * int64(bo.Uint32(ent[4:]))
+	if size <= 4 {
+		return
+	}
+	start := int64(bo.Uint32(ent[8:]))
+	if start+size > int64(len(b)) {
+		return
+	}
+	for i := start; i < start+size; i++ {
+		b[i] = 0
+	}
+}
+
+// stripXMP blanks GPS, serial number and owner properties in an XMP
+// packet with spaces, so the packet stays valid XML of the same size.
+func stripXMP(b []byte) {
+	for _, m := range xmpAttrRe.FindAllSubmatchIndex(b, -1) {
+		if stripXMPNames.Match(b[m[2]:m[3]]) {
+			blank(b[m[0]:m[1]])
+		}
+	}
+
+	for _, m := range xmpElemRe.FindAllSubmatchIndex(b, -1) {
+		name := string(b[m[2]:m[3]])
+		// skip elements already blanked as part of an enclosing one
+		if !stripXMPNames.MatchString(name) || b[m[0]] == ' ' {
+			continue
+		}
+		end := m[1]
+		if m[4] == m[5] {
+			// not self closing, blank through the closing tag
+			closeTag := "</" + name + ">"
+			i := strings.Index(string(b[end:]), closeTag)
+			if i < 0 {
+				continue
+			}
+			end += i + len(closeTag)
+		}
+		blank(b[m[0]:end])
+	}
+}
+
+// xmpExtChunk is one extended XMP segment. pos is where its chunk
+// starts in the JPEG header.
+type xmpExtChunk struct {
+	guid   string
+	total  int
+	offset int
+	pos    int
+	size   int
+}
+
+func parseXMPExtChunk(b []byte) (xmpExtChunk, error) {
+	if len(b) < 40 {
+		return xmpExtChunk{}, errors.New("short extended xmp segment")
+	}
+	c := xmpExtChunk{
+		guid:   string(b[:32]),
+		total:  int(binary.BigEndian.Uint32(b[32:36])),
+		offset: int(binary.BigEndian.Uint32(b[36:40])),
+		pos:    40,
+		size:   len(b) - 40,
+	}
+	if c.total > maxStripHeader || c.offset+c.size > c.total {
+		return xmpExtChunk{}, errors.New("bad extended xmp chunk")
+	}
+	return c, nil
+}
+
+// stripExtendedXMP reassembles each extended XMP packet from its
+// chunks in header, strips it, and writes the chunks back. Properties
+// can span chunks, so they can't be stripped one segment at a time.
+func stripExtendedXMP(header []byte, chunks []xmpExtChunk) error {
+	packets := make(map[string][]byte)
+	for _, c := range chunks {
+		p := packets[c.guid]
+		if p == nil {
+			p = make([]byte, c.total)
+			packets[c.guid] = p
+		} else if len(p) != c.total {
+			return errors.New("extended xmp chunks disagree on length")
+		}
+		copy(p[c.offset:], header[c.pos:c.pos+c.size])
+	}
+	for _, p := range packets {
+		stripXMP(p)
+	}
+	for _, c := range chunks {
+		copy(header[c.pos:c.pos+c.size], packets[c.guid][c.offset:])
+	}
+	return nil
+}
+
+func blank(b []byte) {
+	for i := range b {
+		b[i] = ' '
+	}
+}
@@ -0,0 +1,345 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// CertificateError means a server's certificate wasn't trusted by the
+// destination's TLS settings. Fingerprint identifies the server's
+// key, so the user can check it and pin it.
+type CertificateError struct {
+	Host        string
+	Fingerprint string
+	Err         error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("certificate for %s is not trusted (key %s): %s", e.Host, e.Fingerprint, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// KeyFingerprint returns the sha256/ fingerprint of cert's public
+// key, in the form used by HPKP and curl's --pinnedpubkey.
+func KeyFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsConfig returns the config for connections to host. The server's
+// chain is checked here rather than by crypto/tls so a pinned key can
+// stand in for a CA, and so failures carry the key fingerprint.
+func tlsConfig(t db.TLSSettings, host string) (*tls.Config, error) {
+	roots, err := rootPool(t.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			fingerprint := KeyFingerprint(leaf)
+			if t.Pin != "" {
+				if fingerprint != t.Pin {
+					return &CertificateError{Host: host, Fingerprint: fingerprint, Err: errors.New("key doesn't match the pinned key")}
+				}
+				return nil
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       host,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := leaf.Verify(opts)
+			if err != nil {
+				return &CertificateError{Host: host, Fingerprint: fingerprint, Err: err}
+			}
+			return nil
+		},
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// rootPool returns the system roots plus any certificates in caPEM, or
+// nil for just the system roots.
+func rootPool(caPEM string) (*x509.CertPool, error) {
+	if caPEM == "" {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, errors.New("no certificates found in the CA")
+	}
+	return pool, nil
+}
+
+// serverTransport sends requests for the server's host with the
+// destination's TLS settings. Other hosts, such as presigned storage
+// urls, only get the extra CA: the pin and client certificate are for
+// the server alone.
+type serverTransport struct {
+	host   string
+	server http.RoundTripper
+	other  http.RoundTripper
+}
+
+func (t *serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if canonicalHost(req.URL) == t.host {
+		return t.server.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
+
+func canonicalHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+var (
+	clientMux sync.Mutex
+	// clients holds one client per destination so connections are
+	// reused, replaced when the url or TLS settings change.
+	clients = make(map[int64]*cachedClient)
+)
+
+type cachedClient struct {
+	url    string
+	tls    db.TLSSettings
+	client *http.Client
+}
+
+// httpClient returns the client for requests on behalf of server.
+func httpClient(server *db.Destination) (*http.Client, error) {
+	clientMux.Lock()
+	defer clientMux.Unlock()
+	if c := clients[server.ID]; c != nil && c.url == server.URL && c.tls == server.TLS {
+		return c.client, nil
+	}
+
+	u, err := url.Parse(tlsURL(server))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := tlsConfig(server.TLS, u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("destination %s tls: %w", server.Name, err)
+	}
+	st := http.DefaultTransport.(*http.Transport).Clone()
+	st.TLSClientConfig = cfg
+
+	var other http.RoundTripper = http.DefaultTransport
+	if server.TLS.CA != "" {
+		roots, err := rootPool(server.TLS.CA)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s tls: %w", server.Name, err)
+		}
+		ot := http.DefaultTransport.(*http.Transport).Clone()
+		ot.TLSClientConfig = &tls.Config{RootCAs: roots}
+		other = ot
+	}
+
+	if old := clients[server.ID]; old != nil {
+		old.client.CloseIdleConnections()
+	}
+	c := &cachedClient{
+		url: server.URL,
+		tls: server.TLS,
+		client: &http.Client{
+			Transport: &serverTransport{
+				host:   canonicalHost(u),
+				server: st,
+				other:  other,
+			},
+		},
+	}
+	clients[server.ID] = c
+	return c.client, nil
+}
+
+// tlsURL is the url whose host server's TLS settings are for. restic
+// destinations prefix it with rest:.
+func tlsURL(server *db.Destination) string {
+	if server.Backend == db.BackendRestic {
+		return strings.TrimPrefix(server.URL, "rest:")
+	}
+	return server.URL
+}
+
+// SetServerTLS validates and stores the CA and client certificate of
+// destination destID, keeping its pinned key. Each of ca, clientCert
+// and clientKey is PEM or the path of a PEM file; empty clears it.
+func SetServerTLS(store *db.DB, destID int64, ca, clientCert, clientKey string) error {
+	dest, err := store.Destination(destID)
+	if err != nil {
+		return err
+	}
+
+	t := db.TLSSettings{Pin: dest.TLS.Pin}
+	for _, f := range []struct {
+		name string
+		in   string
+		out  *string
+	}{
+		{"CA certificate", ca, &t.CA},
+		{"client certificate", clientCert, &t.ClientCert},
+		{"client key", clientKey, &t.ClientKey},
+	} {
+		*f.out, err = loadPEM(f.in)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+
+	_, err = rootPool(t.CA)
+	if err != nil {
+		return err
+	}
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return errors.New("client certificate and key must be set together")
+	}
+	if t.ClientCert != "" {
+		_, err = tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return fmt.Errorf("client certificate: %w", err)
+		}
+	}
+	return store.SetDestinationTLS(destID, t)
+}
+
+// loadPEM returns s if it is PEM, and otherwise reads the file it
+// names.
+func loadPEM(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(s, "-----BEGIN") {
+		buf, err := os.ReadFile(s)
+		if err != nil {
+			return "", err
+		}
+		s = strings.TrimSpace(string(buf))
+	}
+	if block, _ := pem.Decode([]byte(s)); block == nil {
+		return "", errors.New("not PEM")
+	}
+	return s + "\n", nil
+}
+
+// PinServerKey trusts the key with fingerprint for destination
+// destID's host, in place of any CA. An empty fingerprint removes
+// the pin.
+func PinServerKey(store *db.DB, destID int64, fingerprint string) error {
+	dest, err := store.Destination(destID)
+	if err != nil {
+		return err
+	}
+	t := dest.TLS
+	t.Pin = fingerprint
+	return store.SetDestinationTLS(destID, t)
+}
+
+// ServerCertificate describes the certificate a server presented.
+type ServerCertificate struct {
+	Fingerprint string
+	Subject     string
+	Issuer      string
+	NotAfter    time.Time
+	// Err is why the current settings don't trust the certificate,
+	// or nil if they do.
+	Err error
+}
+
+// FetchServerCertificate connects to destination destID's server and
+// returns its certificate, whether or not it is trusted, so the user
+// can decide to pin it.
+func FetchServerCertificate(store *db.DB, destID int64) (*ServerCertificate, error) {
+	dest, err := store.Destination(destID)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(tlsURL(dest))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("server url isn't https")
+	}
+
+	cfg, err := tlsConfig(dest.TLS, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	var verifyErr error
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		verifyErr = verify(cs)
+		return nil
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: connTestTimeout},
+		Config:    cfg,
+	}
+	conn, err := dialer.Dial("tcp", canonicalHost(u))
+	if err != nil {
+		return nil, err
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	conn.Close()
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("server sent no certificate")
+	}
+
+	leaf := state.PeerCertificates[0]
+	return &ServerCertificate{
+		Fingerprint: KeyFingerprint(leaf),
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		NotAfter:    leaf.NotAfter,
+		Err:         verifyErr,
+	}, nil
+}
@@ -0,0 +1,199 @@
+package upload
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/psanford/android-media-backup/db"
+)
+
+// A Transformer is one stage of the pipeline that files pass through
+// before upload. Stages must stream and be deterministic: the pipeline
+// is read once to hash its output and again to upload it.
+type Transformer interface {
+	// Name identifies the stage in the saved chain and in
+	// FileMetadata.Transforms.
+	Name() Transform
+	// Applies reports whether the stage runs for the file at path,
+	// described by meta as it was before any stage ran.
+	Applies(store *db.DB, path string, meta FileMetadata) (bool, error)
+	// Wrap returns a reader over the transformed bytes of r. It may
+	// change meta.ContentType. If the returned reader is an io.Closer
+	// it is closed once the upload is done with it.
+	Wrap(r io.Reader, meta *FileMetadata) (io.Reader, error)
+	// OutputSize returns the output size for an input of size bytes,
+	// or -1 if it isn't known until the output has been read.
+	OutputSize(size int64) int64
+}
+
+// transformers holds every available stage, in the default order.
+var transformers = []Transformer{
+	stripMetadata{},
+}
+
+func transformerByName(name Transform) Transformer {
+	for _, t := range transformers {
+		if t.Name() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Transforms returns the names of every available transform.
+func Transforms() []Transform {
+	names := make([]Transform, len(transformers))
+	for i, t := range transformers {
+		names[i] = t.Name()
+	}
+	return names
+}
+
+// TransformChain returns the enabled transforms in the order they run.
+// Until the user configures it, every transform is enabled in the
+// default order.
+func TransformChain(store *db.DB) ([]Transform, error) {
+	saved, err := store.TransformChain()
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil {
+		return Transforms(), nil
+	}
+
+	var chain []Transform
+	for _, name := range saved {
+		if transformerByName(Transform(name)) != nil {
+			chain = append(chain, Transform(name))
+		}
+	}
+	return chain, nil
+}
+
+func SetTransformChain(store *db.DB, chain []Transform) error {
+	names := make([]string, 0, len(chain))
+	for _, name := range chain {
+		if transformerByName(name) == nil {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+		names = append(names, string(name))
+	}
+	return store.SetTransformChain(names)
+}
+
+// pipeline is the chain of stages that apply to one file.
+type pipeline struct {
+	stages []Transformer
+}
+
+func newPipeline(store *db.DB, path string, meta FileMetadata) (*pipeline, error) {
+	chain, err := TransformChain(store)
+	if err != nil {
+		return nil, err
+	}
+
+	var p pipeline
+	for _, name := range chain {
+		t := transformerByName(name)
+		ok, err := t.Applies(store, path, meta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if ok {
+			p.stages = append(p.stages, t)
+		}
+	}
+	return &p, nil
+}
+
+func (p *pipeline) empty() bool {
+	return len(p.stages) == 0
+}
+
+// open seeks src to the start and returns a reader over the output of
+// every stage.
+func (p *pipeline) open(src io.ReadSeeker, meta *FileMetadata) (io.ReadCloser, error) {
+	_, err := src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &pipelineReader{r: src}
+	for _, t := range p.stages {
+		r, err := t.Wrap(out.r, meta)
+		if err != nil {
+			out.Close()
+			return nil, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		if c, ok := r.(io.Closer); ok {
+			out.closers = append(out.closers, c)
+		}
+		out.r = r
+	}
+	return out, nil
+}
+
+// outputSize returns the size of the pipeline's output for an input of
+// size bytes, or -1 if some stage can't say ahead of time.
+func (p *pipeline) outputSize(size int64) int64 {
+	for _, t := range p.stages {
+		if size < 0 {
+			return -1
+		}
+		size = t.OutputSize(size)
+	}
+	return size
+}
+
+// apply reads the pipeline's output once to fill in meta's id and
+// size, and returns its md5 for ETag verification.
+func (p *pipeline) apply(src io.ReadSeeker, meta *FileMetadata) ([]byte, error) {
+	expectSize := p.outputSize(meta.Bytes)
+
+	r, err := p.open(src, meta)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	summer := sha256.New()
+	md5summer := md5.New()
+	n, err := io.Copy(io.MultiWriter(summer, md5summer), r)
+	if err != nil {
+		return nil, err
+	}
+	if expectSize >= 0 && n != expectSize {
+		return nil, fmt.Errorf("transform output was %d bytes, expected %d", n, expectSize)
+	}
+
+	meta.OriginalID = meta.ID
+	meta.ID = hex.EncodeToString(summer.Sum(nil))
+	meta.Bytes = n
+	for _, t := range p.stages {
+		meta.Transforms = append(meta.Transforms, t.Name())
+	}
+	return md5summer.Sum(nil), nil
+}
+
+type pipelineReader struct {
+	r       io.Reader
+	closers []io.Closer
+}
+
+func (p *pipelineReader) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *pipelineReader) Close() error {
+	var firstErr error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if err := p.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.closers = nil
+	return firstErr
+}
@@ -2,7 +2,9 @@ package upload
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -12,21 +14,43 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/psanford/android-media-backup/db"
 	"github.com/psanford/android-media-backup/jgo/wifi"
 	"github.com/psanford/android-media-backup/ui/plog"
+	"github.com/psanford/android-media-backup/upload/mediameta"
 )
 
 var mediaPath = "/sdcard/DCIM/Camera"
 
-func Upload() error {
-	store, err := db.Open()
+// Trigger records what caused an upload run to start.
+type Trigger string
+
+var (
+	TriggerBackground Trigger = "background" // WorkManager periodic job
+	TriggerManual     Trigger = "manual"     // Upload Now button
+)
+
+func Upload(store *db.DB, trigger Trigger) (retErr error) {
+	run, err := store.StartRun(string(trigger))
 	if err != nil {
-		plog.Printf("open db err: %s", err)
+		plog.Printf("start run err: %s", err)
 		return err
 	}
+	plog.Printf("upload run %d start trigger=%s", run.ID, trigger)
+
+	defer func() {
+		if retErr != nil {
+			run.Err = retErr.Error()
+		}
+		err := store.EndRun(run)
+		if err != nil {
+			plog.Printf("end run err: %s", err)
+		}
+		plog.Printf("upload run %d end attempted=%d succeeded=%d skipped=%d failed=%d", run.ID, run.Attempted, run.Succeeded, run.Skipped, run.Failed)
+	}()
 
 	enabled, _ := store.Enabled()
 	if !enabled {
@@ -39,11 +63,74 @@ func Upload() error {
 		store.SetLastCheckTime(now)
 	}()
 
+	dests, err := store.Destinations()
+	if err != nil {
+		return err
+	}
+
+	u := &uploader{
+		store: store,
+		run:   run,
+	}
+
+	now := time.Now()
+	for _, dest := range dests {
+		if !dest.Enabled {
+			continue
+		}
+		if now.Before(dest.RetryAfter) {
+			if trigger != TriggerManual {
+				plog.Printf("destination %s asked us to back off until %s, not uploading to it", dest.Name, dest.RetryAfter)
+				continue
+			}
+			plog.Printf("ignoring backoff until %s from destination %s for manual upload", dest.RetryAfter, dest.Name)
+		}
+		if trigger != TriggerManual && !dest.Due(now) {
+			plog.Printf("destination %s last ran %s, not due yet", dest.Name, dest.LastRun)
+			continue
+		}
+		backend, err := newBackend(store, dest)
+		if err != nil {
+			plog.Printf("destination %s setup err: %s", dest.Name, err)
+			continue
+		}
+		u.targets = append(u.targets, &target{
+			dest:    dest,
+			backend: backend,
+		})
+	}
+	if len(u.targets) == 0 {
+		plog.Printf("no destinations to upload to")
+		return errors.New("no destinations")
+	}
+
+	defer func() {
+		for _, t := range u.targets {
+			if f, ok := t.backend.(Finisher); ok {
+				err := f.Finish()
+				if err != nil {
+					plog.Printf("destination %s finish err: %s", t.dest.Name, err)
+					if retErr == nil {
+						retErr = err
+					}
+				}
+			}
+			if t.used {
+				store.SetDestinationLastRun(t.dest.ID, now)
+			}
+		}
+	}()
+
 	files, dbFilesMap, err := ScanFiles(store)
 	if err != nil {
 		return err
 	}
 
+	fileDests, err := store.AllFileDestinations()
+	if err != nil {
+		return err
+	}
+
 	for _, f := range files {
 		enabled, _ := store.Enabled()
 		if !enabled {
@@ -52,13 +139,21 @@ func Upload() error {
 		}
 
 		connState, err := wifi.ConnectionState()
-		if err != nil || connState == wifi.ConnStateUnknown || connState == wifi.NoNetwork {
-			plog.Printf("no network connection, deferring remaining uploads")
-			return errors.New("no network")
+		if err != nil {
+			connState = wifi.ConnStateUnknown
 		}
+		run.NetState = connState.String()
 
-		allowMobile, _ := store.AllowMobileUpload()
-		if !allowMobile && connState < wifi.Wifi {
+		active := u.activeTargets(connState)
+		if len(active) == 0 {
+			if u.stopErr != nil {
+				plog.Printf("every destination requested backoff, deferring remaining uploads: %s", u.stopErr)
+				return u.stopErr
+			}
+			if connState == wifi.ConnStateUnknown || connState == wifi.NoNetwork {
+				plog.Printf("no network connection, deferring remaining uploads")
+				return errors.New("no network")
+			}
 			plog.Printf("not on wifi, deferring remaining uploads")
 			return errors.New("no wifi")
 		}
@@ -74,154 +169,612 @@ func Upload() error {
 
 		dbFile := dbFilesMap[filename]
 
-		if dbFile.State == db.UploadInProgress {
+		switch dbFile.State {
+		case db.UploadInProgress:
 			plog.Printf("upload already in-progress for %s, this probably needs to be retired", dbFile.Name)
-		} else if dbFile.State == db.UploadPending {
-			err := store.StartUpload(dbFile.Name)
-			if err != nil {
-				plog.Printf("set upload to in-progress failed for=%s err=%s", dbFile.Name, err)
+			continue
+		case db.UploadFileDeleted, db.UploadCorrupt, db.UploadTrashed, db.UploadCleaned:
+			continue
+		}
+
+		var needed []*target
+		for _, t := range active {
+			fd := fileDestination(fileDests[filename], t.dest.ID)
+			if fd.State != db.UploadPending && (fd.State != db.UploadPreviewed || t.previewOnly) {
 				continue
 			}
-
-			f, err := os.Open(fpath)
-			if err != nil {
-				plog.Printf("open file err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
+			if t.previewOnly && !previewableFile(fpath) {
+				// the original waits for wifi
 				continue
 			}
-
-			summer := sha256.New()
-			_, err = io.Copy(summer, f)
-			if err != nil {
-				plog.Printf("read file err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
+			if time.Now().Before(fd.RetryAfter) {
+				plog.Printf("upload deferred by %s for %s until %s", t.dest.Name, dbFile.Name, fd.RetryAfter)
 				continue
 			}
+			needed = append(needed, t)
+		}
+		if len(needed) == 0 {
+			continue
+		}
 
-			id := hex.EncodeToString(summer.Sum(nil))
+		for _, res := range u.uploadOne(dbFile, fpath, modTime, size, needed) {
+			run.Attempted++
+			run.BytesSent += res.sent
+			switch res.state {
+			case db.UploadSuccess, db.UploadPreviewed:
+				run.Succeeded++
+			case db.UploadSkipped:
+				run.Skipped++
+			case db.UploadPending:
+				// deferred by the server, will be retried later
+			default:
+				run.Failed++
+			}
 
-			_, err = f.Seek(0, io.SeekStart)
+			err := store.AddRunFile(run.ID, dbFile.Name, res.state, res.sent)
 			if err != nil {
-				plog.Printf("seek file err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
-				continue
+				plog.Printf("record run file err for=%s err=%s", dbFile.Name, err)
 			}
+		}
+	}
 
-			fileHeader := make([]byte, 512)
-			io.ReadFull(f, fileHeader)
+	u.maybeAudit()
 
-			contentType := http.DetectContentType(fileHeader)
+	return nil
+}
 
-			_, err = f.Seek(0, io.SeekStart)
-			if err != nil {
-				plog.Printf("seek file err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
-				continue
-			}
+// uploader holds the state shared by every file in an upload run.
+type uploader struct {
+	store   *db.DB
+	run     *db.Run
+	targets []*target
 
-			dest, err := requestUploadURL(store, id, dbFile.Name, contentType, modTime, size)
-			if err != nil {
-				plog.Printf("request upload url err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
-				continue
-			}
+	// stopErr is the most recent backoff request from a destination.
+	stopErr error
+}
+
+// target is a destination being uploaded to in this run.
+type target struct {
+	dest    db.Destination
+	backend Backend
+
+	// previewOnly is set on mobile data when only previews may be sent.
+	previewOnly bool
+	// stopped is set once the destination asks for all uploads to stop.
+	stopped bool
+	// used is set if anything was sent, to record the run time.
+	used bool
+}
+
+// activeTargets returns the destinations that may be uploaded to on
+// connState, setting each one's previewOnly flag. Destinations on the
+// device don't depend on the network.
+func (u *uploader) activeTargets(connState wifi.ConnState) []*target {
+	previewOnMobile, _ := u.store.PreviewOnMobile()
 
-			if dest.Status == StatusSkipUpload {
-				plog.Printf("upload file skipped for=%s", dbFile.Name)
-				store.EndUpload(dbFile.Name, db.UploadSkipped)
+	var active []*target
+	for _, t := range u.targets {
+		if t.stopped {
+			continue
+		}
+		// reload so settings changed during the run take effect
+		if dest, err := u.store.Destination(t.dest.ID); err == nil {
+			if !dest.Enabled {
 				continue
 			}
-
-			err = uploadFile(f, size, dest)
-			if err != nil {
-				plog.Printf("upload file err for=%s err=%s", dbFile.Name, err)
-				store.EndUpload(dbFile.Name, db.UploadFailed)
+			t.dest.AllowMobile = dest.AllowMobile
+		}
+		t.previewOnly = false
+		if t.dest.Local() {
+			active = append(active, t)
+			continue
+		}
+		if connState == wifi.ConnStateUnknown || connState == wifi.NoNetwork {
+			continue
+		}
+		if !t.dest.AllowMobile && connState < wifi.Wifi {
+			if !previewOnMobile {
 				continue
 			}
+			t.previewOnly = true
+		}
+		active = append(active, t)
+	}
+	return active
+}
 
-			plog.Printf("upload file success for=%s", dbFile.Name)
-			store.EndUpload(dbFile.Name, db.UploadSuccess)
+// fileDestination returns the state recorded for destID, or pending
+// if there is none.
+func fileDestination(fds []db.FileDestination, destID int64) db.FileDestination {
+	for _, fd := range fds {
+		if fd.DestinationID == destID {
+			return fd
 		}
 	}
+	return db.FileDestination{
+		DestinationID: destID,
+		State:         db.UploadPending,
+	}
+}
 
-	return nil
+// uploadResult is the outcome of sending one file to one destination.
+type uploadResult struct {
+	state db.UploadState
+	sent  int64
 }
 
-func requestUploadURL(store *db.DB, id, name, contentType string, mtime time.Time, size int64) (*UploadDestination, error) {
-	url, err := store.URL()
+// localFile is a file that has been hashed and is ready to be sent to
+// each destination that needs it.
+type localFile struct {
+	dbFile  *db.File
+	path    string
+	f       *os.File
+	meta    FileMetadata
+	md5sum  []byte
+	prepped map[bool]*prepared
+}
+
+// prepared is the bytes to send to a destination, either the file
+// run through the user's transform chain or a preview.
+type prepared struct {
+	meta   FileMetadata
+	md5sum []byte
+	pipe   *pipeline
+	err    error
+}
+
+// uploadOne sends a single file to each of targets, recording each
+// destination's final state and an attempt entry in the db.
+func (u *uploader) uploadOne(dbFile *db.File, fpath string, modTime time.Time, size int64, targets []*target) []uploadResult {
+	store := u.store
+
+	err := store.StartUpload(dbFile.Name)
 	if err != nil {
-		return nil, err
+		plog.Printf("set upload to in-progress failed for=%s err=%s", dbFile.Name, err)
+		return []uploadResult{{state: db.UploadFailed}}
+	}
+
+	lf, state, err := u.readLocal(dbFile, fpath, modTime, size)
+	if lf != nil {
+		defer lf.f.Close()
 	}
-	username, err := store.Username()
+	results := make([]uploadResult, 0, len(targets))
+	for _, t := range targets {
+		if err != nil {
+			attempt := u.newAttempt(dbFile, t)
+			state, sent := u.finish(dbFile, t, &attempt, nil, state, err)
+			results = append(results, uploadResult{state: state, sent: sent})
+			if state == db.UploadCorrupt {
+				break
+			}
+			continue
+		}
+		state, sent := u.send(lf, t)
+		results = append(results, uploadResult{state: state, sent: sent})
+	}
+	return results
+}
+
+func (u *uploader) newAttempt(dbFile *db.File, t *target) db.Attempt {
+	return db.Attempt{
+		Name:          dbFile.Name,
+		RunID:         u.run.ID,
+		DestinationID: t.dest.ID,
+		Started:       time.Now(),
+		Phase:         db.PhaseHash,
+	}
+}
+
+// readLocal hashes the file, checks it for corruption and reads its
+// content type and capture metadata. On error it returns the state
+// the file should be left in.
+func (u *uploader) readLocal(dbFile *db.File, fpath string, modTime time.Time, size int64) (*localFile, db.UploadState, error) {
+	store := u.store
+
+	f, err := os.Open(fpath)
 	if err != nil {
-		return nil, err
+		plog.Printf("open file err for=%s err=%s", dbFile.Name, err)
+		return nil, db.UploadFailed, err
+	}
+
+	lf := &localFile{
+		dbFile:  dbFile,
+		path:    fpath,
+		f:       f,
+		prepped: make(map[bool]*prepared),
+	}
+
+	summer := sha256.New()
+	md5summer := md5.New()
+	_, err = io.Copy(io.MultiWriter(summer, md5summer), f)
+	if err != nil {
+		plog.Printf("read file err for=%s err=%s", dbFile.Name, err)
+		return lf, db.UploadFailed, err
+	}
+
+	id := hex.EncodeToString(summer.Sum(nil))
+	lf.md5sum = md5summer.Sum(nil)
+
+	if dbFile.OriginalSHA256 != "" && id != dbFile.OriginalSHA256 && sameMtime(modTime, dbFile.Created) {
+		plog.Printf("local file corrupt for=%s, not uploading", dbFile.Name)
+		return lf, db.UploadCorrupt, errors.New("local file changed without an mtime change")
 	}
-	passwd, err := store.Password()
+
+	err = store.SetFileSHA256(dbFile.Name, id)
 	if err != nil {
-		return nil, err
+		plog.Printf("save sha256 err for=%s err=%s", dbFile.Name, err)
 	}
 
-	meta := FileMetadata{
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		plog.Printf("seek file err for=%s err=%s", dbFile.Name, err)
+		return lf, db.UploadFailed, err
+	}
+
+	fileHeader := make([]byte, 512)
+	io.ReadFull(f, fileHeader)
+
+	contentType := http.DetectContentType(fileHeader)
+
+	capture := readCapture(store, dbFile.Name, f, size, modTime)
+
+	lf.meta = FileMetadata{
 		ID:          id,
-		Name:        name,
-		Mtime:       mtime,
+		Name:        dbFile.Name,
+		Mtime:       modTime,
 		Bytes:       size,
 		ContentType: contentType,
+		Capture:     capture,
 	}
 
+	return lf, 0, nil
+}
+
+// prepare runs the file through the transform chain, or makes a
+// preview of it, once per run no matter how many destinations it is
+// sent to.
+func (u *uploader) prepare(lf *localFile, preview bool) *prepared {
+	if p := lf.prepped[preview]; p != nil {
+		return p
+	}
+
+	store := u.store
+	p := &prepared{
+		meta:   lf.meta,
+		md5sum: lf.md5sum,
+	}
+	lf.prepped[preview] = p
+
+	if p.meta.Capture != nil {
+		capture := *p.meta.Capture
+		p.meta.Capture = &capture
+
+		// Location is left out of the metadata sent to the server for
+		// every file type, not just the JPEGs whose bytes are stripped.
+		strip, err := store.ShouldStripMetadata(filepath.Dir(lf.path))
+		if err != nil {
+			p.err = err
+			return p
+		}
+		if strip {
+			p.meta.Capture.GPS = nil
+		}
+	}
+
+	if preview {
+		p.meta.DerivativeOf = p.meta.ID
+		p.meta.Derivative = DerivativePreview
+		p.pipe, p.err = newPreviewPipeline(store)
+	} else {
+		p.pipe, p.err = newPipeline(store, lf.path, p.meta)
+	}
+	if p.err != nil {
+		plog.Printf("transform setup err for=%s err=%s", lf.dbFile.Name, p.err)
+		return p
+	}
+	if !p.pipe.empty() {
+		p.md5sum, p.err = p.pipe.apply(lf.f, &p.meta)
+		if p.err != nil {
+			plog.Printf("transform err for=%s err=%s", lf.dbFile.Name, p.err)
+			return p
+		}
+	}
+	return p
+}
+
+// send uploads lf to one destination.
+func (u *uploader) send(lf *localFile, t *target) (db.UploadState, int64) {
+	dbFile := lf.dbFile
+	attempt := u.newAttempt(dbFile, t)
+
+	p := u.prepare(lf, t.previewOnly)
+	if p.err != nil {
+		return u.finish(dbFile, t, &attempt, nil, db.UploadFailed, p.err)
+	}
+
+	t.used = true
+	open := func() (io.ReadCloser, error) {
+		meta := p.meta
+		return p.pipe.open(lf.f, &meta)
+	}
+	skipped, err := t.backend.Upload(p.meta, open, p.md5sum, &attempt)
+	if err != nil {
+		plog.Printf("upload err for=%s destination=%s phase=%s err=%s", dbFile.Name, t.dest.Name, attempt.Phase, err)
+		return u.finish(dbFile, t, &attempt, &p.meta, db.UploadFailed, err)
+	}
+
+	state := db.UploadSuccess
+	if t.previewOnly {
+		state = db.UploadPreviewed
+	} else if skipped {
+		state = db.UploadSkipped
+	}
+	plog.Printf("upload file %s for=%s destination=%s preview=%t", state, dbFile.Name, t.dest.Name, t.previewOnly)
+	return u.finish(dbFile, t, &attempt, &p.meta, state, nil)
+}
+
+// finish records an attempt at sending dbFile to t and the state it
+// left the file in at that destination, adjusting state for errors
+// that should be retried. sent describes what was sent, or is nil if
+// the file never got that far; it is recorded as the destination's
+// copy once the upload succeeds.
+func (u *uploader) finish(dbFile *db.File, t *target, attempt *db.Attempt, sent *FileMetadata, state db.UploadState, err error) (db.UploadState, int64) {
+	store := u.store
+	attempt.Ended = time.Now()
+
+	var (
+		retryTime   time.Time
+		statusErr   *StatusError
+		mismatch    *MismatchError
+		unavailable *UnavailableError
+	)
+	if errors.As(err, &statusErr) {
+		attempt.Failure = db.FailureStatus
+		attempt.HTTPStatus = statusErr.StatusCode
+		attempt.ServerError = statusErr.Message
+		if statusErr.Rejected() {
+			state = db.UploadRejected
+		} else if statusErr.Deferred() || statusErr.Backoff() {
+			state = db.UploadPending
+			retryTime = statusErr.RetryTime()
+		}
+		if statusErr.Backoff() {
+			plog.Printf("destination %s requested backoff until %s", t.dest.Name, retryTime)
+			t.stopped = true
+			u.stopErr = statusErr
+			store.SetDestinationRetryAfter(t.dest.ID, retryTime)
+		}
+	} else if errors.As(err, &unavailable) {
+		plog.Printf("destination %s unavailable, skipping it this run: %s", t.dest.Name, err)
+		attempt.Failure = db.FailureUnavailable
+		state = db.UploadPending
+		t.stopped = true
+		u.stopErr = err
+	} else if errors.As(err, &mismatch) {
+		attempt.Failure = db.FailureMismatch
+		// The server stored something other than what we sent. Retry
+		// on the next run unless this keeps happening.
+		if u.verifyMismatches(dbFile.Name, t.dest.ID) < maxVerifyMismatches-1 {
+			state = db.UploadPending
+		}
+	} else if err != nil {
+		attempt.Failure = db.FailureOther
+	}
+	if err != nil {
+		attempt.Err = err.Error()
+	}
+	if t.previewOnly && state == db.UploadFailed {
+		// the original will still be sent on wifi
+		state = db.UploadPending
+	}
+
+	if recErr := store.RecordAttempt(attempt); recErr != nil {
+		plog.Printf("record attempt err for=%s err=%s", dbFile.Name, recErr)
+	}
+
+	if state == db.UploadCorrupt {
+		store.SetFileState(dbFile.Name, db.UploadCorrupt)
+		return state, attempt.BytesSent
+	}
+
+	recorded := state
+	if state == db.UploadPending {
+		fds, _ := store.FileDestinations(dbFile.Name)
+		if fileDestination(fds, t.dest.ID).State == db.UploadPreviewed {
+			recorded = db.UploadPreviewed
+		}
+	}
+	err = store.SetFileDestinationState(dbFile.Name, t.dest.ID, recorded, retryTime, attempt.ServerError)
+	if err != nil {
+		plog.Printf("save destination state err for=%s err=%s", dbFile.Name, err)
+	}
+	if sent != nil && (state == db.UploadSuccess || state == db.UploadSkipped) {
+		err = store.SetUploaded(dbFile.Name, t.dest.ID, sent.ID, sent.Bytes)
+		if err != nil {
+			plog.Printf("save uploaded sha256 err for=%s err=%s", dbFile.Name, err)
+		}
+	}
+	return state, attempt.BytesSent
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func requestUploadURL(store *db.DB, server *db.Destination, meta FileMetadata) (*UploadDestination, error) {
 	jsontxt, err := json.Marshal(meta)
 	if err != nil {
 		return nil, err
 	}
 	buf := bytes.NewBuffer(jsontxt)
 
-	req, err := http.NewRequest("POST", url, buf)
+	req, err := http.NewRequest("POST", server.URL, buf)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("content-type", "application/json")
-	req.SetBasicAuth(username, passwd)
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doServerRequest(store, server, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 && resp.StatusCode != http.StatusConflict {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+		return nil, newStatusError(resp)
 	}
 
-	var dest UploadDestination
+	dest := UploadDestination{StatusCode: resp.StatusCode}
 	err = json.NewDecoder(resp.Body).Decode(&dest)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("bad json response: %w", err)
+	}
+
+	switch dest.Status {
+	case StatusOK:
+		if dest.URL == "" {
+			return nil, &StatusError{
+				StatusCode: resp.StatusCode,
+				Status:     StatusErr,
+				Message:    "server returned no upload url",
+			}
+		}
+	case StatusSkipUpload:
+	case StatusErr, StatusDefer, StatusRejected, StatusQuotaExceeded:
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     dest.Status,
+			Code:       dest.Code,
+			Message:    dest.Error,
+			RetryAfter: time.Duration(dest.RetryAfter) * time.Second,
+		}
+	default:
+		return nil, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     StatusErr,
+			Message:    fmt.Sprintf("unknown status %q", dest.Status),
+		}
 	}
 
 	return &dest, nil
 }
 
-func uploadFile(r io.Reader, size int64, dest *UploadDestination) error {
+// captureFilesPerPass bounds how many files ReadCaptureTimes opens in
+// one background run.
+var captureFilesPerPass = 500
+
+// ReadCaptureTimes records the capture time of files that haven't
+// been uploaded since capture metadata was added, so the file list can
+// sort them. Files that are uploaded get theirs when they are hashed.
+func ReadCaptureTimes(store *db.DB) error {
+	files, err := store.FilesWithoutCaptureTime(captureFilesPerPass)
+	if err != nil {
+		return err
+	}
+
+	for _, dbFile := range files {
+		f, err := os.Open(dbFile.Path)
+		if os.IsNotExist(err) {
+			// fall back to mtime so the file isn't looked for again
+			store.SetCaptureTime(dbFile.Name, dbFile.Created)
+			continue
+		} else if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err == nil {
+			readCapture(store, dbFile.Name, f, info.Size(), info.ModTime())
+		}
+		f.Close()
+	}
+
+	if len(files) > 0 {
+		plog.Printf("read capture times for %d files", len(files))
+	}
+	return nil
+}
+
+// readCapture parses the capture metadata in r and records the
+// capture time, falling back to mtime so the file isn't read again.
+func readCapture(store *db.DB, name string, r io.ReaderAt, size int64, modTime time.Time) *mediameta.Metadata {
+	capture, err := mediameta.Parse(r, size)
+	if err != nil && err != mediameta.ErrUnknownFormat {
+		plog.Printf("read capture metadata err for=%s err=%s", name, err)
+	}
+
+	captured := modTime
+	if capture != nil && capture.CaptureTime != nil {
+		captured = *capture.CaptureTime
+	}
+	err = store.SetCaptureTime(name, captured)
+	if err != nil {
+		plog.Printf("save capture time err for=%s err=%s", name, err)
+	}
+
+	return capture
+}
+
+// prepareServerRequest adds the protocol version, device id,
+// signature and credentials to a request sent to a media-backup
+// protocol server.
+func prepareServerRequest(store *db.DB, server *db.Destination, req *http.Request) error {
+	deviceID, err := store.DeviceID()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("x-media-backup-protocol", strconv.Itoa(ProtocolVersion))
+	req.Header.Set("x-media-backup-device", deviceID)
+	err = signRequest(store, req)
+	if err != nil {
+		return err
+	}
+	return authorize(store, server, req)
+}
+
+// uploadFile sends the file body to dest, with server's TLS settings.
+// If contentMD5 is set it is sent as the Content-MD5 header so the
+// storage backend can reject a corrupted body. The response is
+// returned, with its body closed, for its status and headers.
+func uploadFile(server *db.Destination, r io.Reader, size int64, dest *UploadDestination, contentMD5 []byte) (*http.Response, error) {
 	if dest.Method == "" {
 		dest.Method = "PUT"
 	}
 	req, err := http.NewRequest(dest.Method, dest.URL, r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req.Header = dest.Headers
+	req.Header = dest.Headers.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if contentMD5 != nil {
+		req.Header.Set("content-md5", base64.StdEncoding.EncodeToString(contentMD5))
+	}
 	req.ContentLength = size
 
-	resp, err := http.DefaultClient.Do(req)
+	client, err := httpClient(server)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+		return nil, newStatusError(resp)
 	}
 
-	return nil
+	return resp, nil
 }
 
 func ScanFiles(store *db.DB) ([]fs.FileInfo, map[string]*db.File, error) {
@@ -281,6 +834,31 @@ func ScanFiles(store *db.DB) ([]fs.FileInfo, map[string]*db.File, error) {
 			plog.Printf("bgjob %s in db, state is %s", filename, dbFile.State)
 		}
 	}
+
+	onDisk := make(map[string]bool)
+	for _, ff := range fileInfos {
+		onDisk[ff.Name()] = true
+	}
+
+	// Files free up space moved to the trash are expected to be
+	// missing. If the trash copy is gone too, it was deleted for good.
+	for name, dbFile := range dbFilesMap {
+		if onDisk[name] || dbFile.State != db.UploadTrashed {
+			continue
+		}
+		if _, err := os.Stat(dbFile.TrashPath); !os.IsNotExist(err) {
+			continue
+		}
+		plog.Printf("bgjob %s removed from trash, marking cleaned", name)
+		err := store.CleanFile(name)
+		if err != nil {
+			plog.Printf("bgjob %s mark cleaned failed: %s", name, err)
+			continue
+		}
+		dbFile.State = db.UploadCleaned
+		dbFile.TrashPath = ""
+	}
+
 	return fileInfos, dbFilesMap, nil
 }
 
@@ -290,21 +868,71 @@ type FileMetadata struct {
 	Mtime       time.Time `json:"mtime"`
 	Bytes       int64     `json:"size"`
 	ContentType string    `json:"content_type"`
-	TestUpload  bool      `json:"test_upload"`
+	TestUpload  bool      `json:"test_upload"` // connection test, server may discard it
+	// Capture is the file's EXIF/XMP or MP4 metadata, if any was found.
+	Capture *mediameta.Metadata `json:"capture,omitempty"`
+
+	// Transforms lists the changes made to the file before upload. When
+	// it is set, ID is the hash of the transformed bytes and OriginalID
+	// is the hash of the file on the device.
+	Transforms []Transform `json:"transforms,omitempty"`
+	OriginalID string      `json:"original_id,omitempty"`
+
+	// DerivativeOf is set when this upload is a reduced copy of another
+	// file, and holds that file's ID. Derivative says what kind of copy.
+	DerivativeOf string     `json:"derivative_of,omitempty"`
+	Derivative   Derivative `json:"derivative,omitempty"`
+
+	// Overwrite asks the server to replace its copy rather than skip
+	// the upload, because that copy failed verification.
+	Overwrite bool `json:"overwrite,omitempty"`
 }
 
+type Transform string
+
+var (
+	TransformStripMetadata Transform = "strip_metadata" // GPS, serial number and owner tags removed
+	TransformPreview       Transform = "preview"        // downscaled JPEG, see DerivativePreview
+)
+
 type Status string
 
 var (
-	StatusOK         Status = "ok"
-	StatusSkipUpload Status = "skip" // file already exists
-	StatusErr        Status = "error"
+	StatusOK            Status = "ok"
+	StatusSkipUpload    Status = "skip"           // file already exists
+	StatusErr           Status = "error"          // failed, retry on the next reset
+	StatusDefer         Status = "defer"          // try this file again after retry_after
+	StatusRejected      Status = "rejected"       // never upload this file
+	StatusQuotaExceeded Status = "quota_exceeded" // stop all uploads until retry_after
+)
+
+// Machine-readable error codes a server may return in
+// UploadDestination.Code. Servers may send other values; clients
+// treat unknown codes like ErrCodeInternal.
+var (
+	ErrCodeInternal    = "internal"         // failed, retried like StatusErr
+	ErrCodeBadRequest  = "bad_request"      // failed, retried like StatusErr
+	ErrCodeUnsupported = "unsupported_type" // rejected, never retried
+	ErrCodeTooLarge    = "too_large"        // rejected, never retried
+	ErrCodeQuota       = "quota"            // all uploads back off
+	ErrCodeBusy        = "busy"             // all uploads back off
 )
 
+// UploadDestination is the server's reply to a FileMetadata
+// negotiation request. It is sent with either a 200 or 409 status
+// code. Any other status is treated as an error, and the body may
+// still be an UploadDestination carrying Error, Code and RetryAfter.
+// 429 and 503 responses honor the Retry-After header.
 type UploadDestination struct {
-	Status  Status      `json:"status"`
-	Error   string      `json:"error,omitempty"`
-	URL     string      `json:"url"`
-	Method  string      `json:"method"`
-	Headers http.Header `json:"headers"`
+	Status     Status      `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Code       string      `json:"code,omitempty"`
+	RetryAfter int         `json:"retry_after,omitempty"` // seconds
+	URL        string      `json:"url"`
+	Method     string      `json:"method"`
+	Headers    http.Header `json:"headers"`
+	Verify     Verify      `json:"verify,omitempty"`
+
+	// StatusCode is the http status of the negotiation response.
+	StatusCode int `json:"-"`
 }
@@ -0,0 +1,131 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/psanford/android-media-backup/db"
+	"github.com/psanford/android-media-backup/ui/plog"
+)
+
+// Verify selects how the client confirms that the server stored
+// exactly the bytes that were sent.
+type Verify string
+
+var (
+	VerifyNone    Verify = ""
+	VerifyConfirm Verify = "confirm" // ask the server's confirm endpoint for size and sha256
+	VerifyETag    Verify = "etag"    // S3 style: send Content-MD5 and compare the response ETag
+)
+
+// confirmPath is resolved relative to the configured server URL.
+var confirmPath = "confirm"
+
+// maxVerifyMismatches is how many verification mismatches in a row
+// a file may have before it is marked failed instead of retried.
+var maxVerifyMismatches = 3
+
+type ConfirmRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type ConfirmResponse struct {
+	ID     string `json:"id"`
+	Bytes  int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// MismatchError means the server's copy of a file does not match the
+// local file.
+type MismatchError struct {
+	Field string
+	Want  string
+	Got   string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("verify %s mismatch: want %s got %s", e.Field, e.Want, e.Got)
+}
+
+// confirmUpload asks the server for the size and sha256 of the object
+// it stored for meta.ID and compares them with the local file. The
+// response status is returned for the attempt record.
+func confirmUpload(store *db.DB, server *db.Destination, meta FileMetadata) (int, error) {
+	confirmURL, err := url.JoinPath(server.URL, confirmPath)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(ConfirmRequest{
+		ID:   meta.ID,
+		Name: meta.Name,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", confirmURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("content-type", "application/json")
+	resp, err := doServerRequest(store, server, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, &MismatchError{Field: "object", Want: meta.ID, Got: "not found"}
+	}
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, newStatusError(resp)
+	}
+
+	var confirm ConfirmResponse
+	err = json.NewDecoder(resp.Body).Decode(&confirm)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("bad json response: %w", err)
+	}
+
+	if confirm.Bytes != meta.Bytes {
+		return resp.StatusCode, &MismatchError{Field: "size", Want: fmt.Sprint(meta.Bytes), Got: fmt.Sprint(confirm.Bytes)}
+	}
+	if !strings.EqualFold(confirm.SHA256, meta.ID) {
+		return resp.StatusCode, &MismatchError{Field: "sha256", Want: meta.ID, Got: confirm.SHA256}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// verifyETag compares an S3 style ETag with the md5 of the file. This
+// only holds for single part uploads without SSE-KMS, which is what a
+// presigned PUT produces.
+func verifyETag(respHeader http.Header, md5sum []byte) error {
+	etag := strings.Trim(respHeader.Get("etag"), `"`)
+	want := hex.EncodeToString(md5sum)
+	if etag == "" {
+		return &MismatchError{Field: "etag", Want: want, Got: "missing"}
+	}
+	if !strings.EqualFold(etag, want) {
+		return &MismatchError{Field: "etag", Want: want, Got: etag}
+	}
+	return nil
+}
+
+// verifyMismatches counts the verification mismatches at the head of
+// a file's attempt history with one destination.
+func (u *uploader) verifyMismatches(name string, destID int64) int {
+	n, err := u.store.RecentMismatches(name, destID)
+	if err != nil {
+		plog.Printf("count mismatches err for=%s err=%s", name, err)
+		return 0
+	}
+	return n
+}